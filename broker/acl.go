@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/spf13/viper"
+)
+
+// Access rights checked by the access control list.
+const (
+	aclRead  = 1 << iota // Subscribing to a topic filter.
+	aclWrite             // Publishing to a topic.
+)
+
+// aclRule represents a single rule of the access control list.
+type aclRule struct {
+	Username string `mapstructure:"username"` // The username, "*" for any and "" for anonymous.
+	Topic    string `mapstructure:"topic"`    // The topic filter the rule applies to.
+	Access   string `mapstructure:"access"`   // One of "read", "write", "readwrite" or "deny".
+}
+
+// acl represents the access control list which authorizes the clients to subscribe and
+// publish on the topics. The first matching rule decides, the default policy applies
+// when no rule matches.
+type acl struct {
+	rules []aclRule
+	allow bool
+}
+
+// newACL creates an access control list from the "acl" section of the configuration.
+func newACL(cfg *viper.Viper) *acl {
+	cfg.SetDefault("acl.default", "allow")
+	a := &acl{allow: cfg.GetString("acl.default") != "deny"}
+	if err := cfg.UnmarshalKey("acl.rules", &a.rules); err != nil {
+		logging.Error("invalid acl rules", err)
+	}
+	return a
+}
+
+// Allowed returns whether the user has the access right on the topic, or the topic filter
+// when subscribing. Wildcards in a requested filter only match the same wildcards in the
+// rules, so a rule never grants more than it covers.
+func (a *acl) Allowed(username, topic string, access int) bool {
+	for _, rule := range a.rules {
+		if rule.Username != "*" && rule.Username != username {
+			continue
+		}
+		if !covers(rule.Topic, topic) {
+			continue
+		}
+		return rule.allows(access)
+	}
+	return a.allow
+}
+
+// allows returns whether the rule grants the access right.
+func (r *aclRule) allows(access int) bool {
+	switch strings.ToLower(r.Access) {
+	case "readwrite":
+		return true
+	case "read":
+		return access == aclRead
+	case "write":
+		return access == aclWrite
+	}
+	return false
+}
+
+// covers returns whether the topic filter of a rule covers the topic, or the requested
+// topic filter. A single-level wildcard does not cover a multi-level one.
+func covers(rule, topic string) bool {
+	if !matchTopic(rule, topic) {
+		return false
+	}
+
+	rules := strings.Split(rule, "/")
+	for i, level := range strings.Split(topic, "/") {
+		if level == "#" && (i >= len(rules) || rules[i] != "#") {
+			return false
+		}
+	}
+	return true
+}
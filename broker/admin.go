@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// adminPrefix is the path prefix of the admin API.
+const adminPrefix = "/admin/api/"
+
+// topicInfo represents a subscribed topic filter along with its subscriber count.
+type topicInfo struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// publishRequest represents a message to publish, as received over HTTP.
+type publishRequest struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     uint8  `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// publishResponse represents the outcome of a publish over HTTP.
+type publishResponse struct {
+	Matched int `json:"matched"`
+}
+
+// Occurs when a new admin API request is received.
+func (s *Service) onAdmin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	resource, id := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		resource, id = path[:i], path[i+1:]
+	}
+
+	switch {
+	case resource == "connections" && id == "" && r.Method == http.MethodGet:
+		s.onAdminConnections(w, r)
+	case resource == "connections" && id != "" && r.Method == http.MethodGet:
+		s.onAdminSession(w, r, id)
+	case resource == "connections" && id != "" && r.Method == http.MethodDelete:
+		s.onAdminDisconnect(w, r, id)
+	case resource == "topics" && id == "" && r.Method == http.MethodGet:
+		s.onAdminTopics(w, r)
+	case resource == "publish" && id == "" && r.Method == http.MethodPost:
+		s.onAdminPublish(w, r)
+	case resource == "backup" && id == "" && r.Method == http.MethodGet:
+		s.onAdminBackup(w, r)
+	case resource == "cluster" && id == "" && r.Method == http.MethodGet:
+		s.onAdminCluster(w, r)
+	case resource == "streams" && id == "" && r.Method == http.MethodGet:
+		s.onAdminStreams(w, r)
+	case resource == "streams" && id != "" && r.Method == http.MethodGet:
+		s.onAdminStream(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// onAdminConnections lists all of the live connections.
+func (s *Service) onAdminConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.conns.All()
+	infos := make([]connInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// onAdminSession shows a single connection, looked up by its client id.
+func (s *Service) onAdminSession(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c.info())
+}
+
+// onAdminDisconnect forcibly disconnects a client.
+func (s *Service) onAdminDisconnect(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	c.Disconnect()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// onAdminTopics lists the subscribed topic filters with their subscriber counts.
+func (s *Service) onAdminTopics(w http.ResponseWriter, r *http.Request) {
+	topics := s.subscriptions.Topics()
+	infos := make([]topicInfo, 0, len(topics))
+	for topic, count := range topics {
+		infos = append(infos, topicInfo{Topic: topic, Subscribers: count})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Topic < infos[j].Topic
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// onAdminPublish publishes a message as the server.
+func (s *Service) onAdminPublish(w http.ResponseWriter, r *http.Request) {
+	var req publishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if !validTopic(req.Topic) || req.QoS > 2 {
+		writeError(w, http.StatusBadRequest, "invalid topic or qos")
+		return
+	}
+
+	matched := s.publish(&Message{
+		Topic:   req.Topic,
+		Payload: []byte(req.Payload),
+		QoS:     req.QoS,
+		Retain:  req.Retain,
+	})
+	writeJSON(w, http.StatusOK, publishResponse{Matched: matched})
+}
+
+// onAdminBackup streams a snapshot of the store, taken while the broker keeps serving.
+func (s *Service) onAdminBackup(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.store.(backuper)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "the store does not support backups")
+		return
+	}
+
+	name := fmt.Sprintf("live-go-%s.db", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if _, err := b.Backup(w); err != nil {
+		logging.Error("backup failed", err)
+	}
+}
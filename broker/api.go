@@ -0,0 +1,218 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/numb3r3/live-go/network/mqtt"
+)
+
+// Limits of the HTTP publish API.
+const (
+	maxBatchMessages = 1000    // The maximum number of messages in a batch.
+	maxBatchBodySize = 4 << 20 // The maximum size of a batch request body.
+)
+
+// apiMessage represents a message to publish over the HTTP API. The payload is base64
+// encoded in JSON.
+type apiMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     uint8  `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// apiResult represents the outcome of a single message of a batch.
+type apiResult struct {
+	Matched int    `json:"matched"`
+	Error   string `json:"error,omitempty"`
+}
+
+// batchResponse represents the outcome of a batch publish.
+type batchResponse struct {
+	Matched int         `json:"matched"`
+	Results []apiResult `json:"results"`
+}
+
+// historyMessage represents a recorded message, as returned by the history API. The
+// payload is base64 encoded in JSON.
+type historyMessage struct {
+	ID      uint64    `json:"id"`
+	Seq     uint64    `json:"seq"` // The sequence of the message on its topic, as "from" expects.
+	Topic   string    `json:"topic"`
+	Payload []byte    `json:"payload"`
+	QoS     uint8     `json:"qos"`
+	Time    time.Time `json:"time"`
+}
+
+// Occurs when a message is published over HTTP. The message is either a JSON object,
+// or the raw request body along with the topic, qos and retain query parameters.
+func (s *Service) onAPIPublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	msg, err := readAPIMessage(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	matched, err := s.publishAPIMessage(username, msg)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, publishResponse{Matched: matched})
+	case errUnauthorized:
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// Occurs when a batch of messages is published over HTTP, as a JSON array.
+func (s *Service) onAPIPublishBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var batch []apiMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize)).Decode(&batch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(batch) > maxBatchMessages {
+		writeError(w, http.StatusRequestEntityTooLarge, "too many messages in the batch")
+		return
+	}
+
+	// Every message is published on its own, a failed one does not fail the batch
+	resp := batchResponse{Results: make([]apiResult, 0, len(batch))}
+	for i := range batch {
+		matched, err := s.publishAPIMessage(username, &batch[i])
+		result := apiResult{Matched: matched}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		resp.Matched += matched
+		resp.Results = append(resp.Results, result)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// publishAPIMessage validates the message and publishes it on behalf of the user,
+// through the same path as the messages published by the connections.
+func (s *Service) publishAPIMessage(username string, msg *apiMessage) (int, error) {
+	if !validTopic(msg.Topic) {
+		return 0, errInvalidTopic
+	}
+	if msg.QoS > 2 {
+		return 0, mqtt.ErrInvalidQoS
+	}
+	if len(msg.Payload) > mqtt.MaxMessageSize {
+		return 0, mqtt.ErrMessageTooLarge
+	}
+
+	return s.onPublish(nil, username, &Message{
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		QoS:     msg.QoS,
+		Retain:  msg.Retain,
+	})
+}
+
+// readAPIMessage reads the message to publish from the request.
+func readAPIMessage(w http.ResponseWriter, r *http.Request) (*apiMessage, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*mqtt.MaxMessageSize))
+	if err != nil {
+		return nil, mqtt.ErrMessageTooLarge
+	}
+
+	msg := new(apiMessage)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, msg); err != nil {
+			return nil, errInvalidBody
+		}
+		return msg, nil
+	}
+
+	query := r.URL.Query()
+	msg.Topic = query.Get("topic")
+	msg.Payload = body
+	if v := query.Get("qos"); v != "" {
+		qos, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, mqtt.ErrInvalidQoS
+		}
+		msg.QoS = uint8(qos)
+	}
+	if v := query.Get("retain"); v != "" {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errInvalidBody
+		}
+		msg.Retain = retain
+	}
+	return msg, nil
+}
+
+// Occurs when the history of the topics matching a filter is requested, optionally
+// starting at a time or a sequence and limited to the last messages.
+func (s *Service) onAPIHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := query.Get("topic")
+	if !validFilter(filter) {
+		writeError(w, http.StatusBadRequest, "invalid topic filter")
+		return
+	}
+	if !s.acl.Allowed(username, filter, aclRead) {
+		writeError(w, http.StatusForbidden, errUnauthorized.Error())
+		return
+	}
+
+	q, _, err := parseReplay(query.Get("since"), query.Get("from"), query.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages := s.history.Replay(filter, q)
+	result := make([]historyMessage, 0, len(messages))
+	for _, m := range messages {
+		result = append(result, historyMessage{
+			ID:      m.ID,
+			Seq:     m.Seq,
+			Topic:   m.Topic,
+			Payload: m.Payload,
+			QoS:     m.QoS,
+			Time:    m.Time,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+	"github.com/spf13/viper"
+)
+
+// Authenticator verifies the credentials presented by the clients, be it in an MQTT
+// CONNECT packet or in an HTTP request.
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+// staticAuth authenticates the clients against the credentials from the configuration.
+type staticAuth struct {
+	username  string // The configured username.
+	password  string // The configured password.
+	anonymous bool   // Whether the clients without any username are accepted.
+}
+
+// newStaticAuth creates an authenticator from the "auth" section of the configuration.
+func newStaticAuth(cfg *viper.Viper) *staticAuth {
+	cfg.SetDefault("auth.allow_anonymous", true)
+	return &staticAuth{
+		username:  cfg.GetString("auth.username"),
+		password:  cfg.GetString("auth.password"),
+		anonymous: cfg.GetBool("auth.allow_anonymous"),
+	}
+}
+
+// Authenticate checks the credentials against the configured ones.
+func (a *staticAuth) Authenticate(username, password string) bool {
+	if username == "" {
+		return a.anonymous
+	}
+
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+	return userOk && passOk
+}
+
+// ------------------------------------------------------------------------------------
+
+// streamAuth authorizes the publishers and the players of the live streams, by the
+// signature of their URL and by the webhooks from the configuration.
+//
+// A signed URL carries "expire", the Unix time until which it is valid, and "sign", the
+// hexadecimal HMAC-SHA256 of "<action>:<app>/<stream>:<expire>" keyed by the secret,
+// the action being either "publish" or "play", so a play URL never allows publishing.
+type streamAuth struct {
+	secret    []byte // The key of the signatures, nil if the URLs are not signed.
+	signPlay  bool   // Whether the players also need a signed URL, not only the publishers.
+	onPublish string // The webhook authorizing the publishers, if any.
+	onPlay    string // The webhook authorizing the players, on every request of HLS and DASH.
+	onDone    string // The webhook notified once a publisher left, if any.
+}
+
+// streamEvent represents the event posted to the webhooks of the live streams.
+type streamEvent struct {
+	Action string     `json:"action"` // Either "publish", "play" or "done".
+	Key    string     `json:"key"`
+	Remote string     `json:"remote"`
+	Params url.Values `json:"params,omitempty"`
+}
+
+// newStreamAuth creates the authorization of the live streams from the "streams.auth"
+// section of the configuration, nil if neither signed URLs nor webhooks are configured.
+func newStreamAuth(cfg *viper.Viper) *streamAuth {
+	cfg.SetDefault("streams.auth.sign_play", false)
+	a := &streamAuth{
+		signPlay:  cfg.GetBool("streams.auth.sign_play"),
+		onPublish: cfg.GetString("streams.auth.on_publish"),
+		onPlay:    cfg.GetString("streams.auth.on_play"),
+		onDone:    cfg.GetString("streams.auth.on_done"),
+	}
+	if secret := cfg.GetString("streams.auth.secret"); secret != "" {
+		a.secret = []byte(secret)
+	}
+	if a.secret == nil && a.onPublish == "" && a.onPlay == "" && a.onDone == "" {
+		return nil
+	}
+	return a
+}
+
+// OnPublish checks the signature of the URL of a publisher, then asks the webhook.
+func (a *streamAuth) OnPublish(key string, c media.Client) error {
+	if a.secret != nil {
+		if err := a.verify("publish", key, c.Params); err != nil {
+			return err
+		}
+	}
+	if a.onPublish != "" {
+		return postWebhook(a.onPublish, streamEvent{Action: "publish", Key: key, Remote: c.Remote, Params: c.Params})
+	}
+	return nil
+}
+
+// OnPlay checks the signature of the URL of a player, if required, then asks the webhook.
+func (a *streamAuth) OnPlay(key string, c media.Client) error {
+	if a.secret != nil && a.signPlay {
+		if err := a.verify("play", key, c.Params); err != nil {
+			return err
+		}
+	}
+	if a.onPlay != "" {
+		return postWebhook(a.onPlay, streamEvent{Action: "play", Key: key, Remote: c.Remote, Params: c.Params})
+	}
+	return nil
+}
+
+// OnDone notifies the webhook that a publisher left, without waiting for it.
+func (a *streamAuth) OnDone(key string, c media.Client) {
+	if a.onDone == "" {
+		return
+	}
+	go func() {
+		if err := postWebhook(a.onDone, streamEvent{Action: "done", Key: key, Remote: c.Remote, Params: c.Params}); err != nil {
+			logging.Error("streams: unable to notify the end of", key, err)
+		}
+	}()
+}
+
+// verify checks the signature of a URL for an action, and that it has not expired.
+func (a *streamAuth) verify(action, key string, params url.Values) error {
+	expire, err := strconv.ParseInt(params.Get("expire"), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid expiry")
+	}
+	if time.Now().Unix() > expire {
+		return errors.New("signature expired")
+	}
+
+	sign, err := hex.DecodeString(params.Get("sign"))
+	if err != nil || !hmac.Equal(sign, signStream(a.secret, action, key, expire)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// signStream returns the signature of the URLs of an action on a stream, valid until a
+// Unix time.
+func signStream(secret []byte, action, key string, expire int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(action + ":" + key + ":" + strconv.FormatInt(expire, 10)))
+	return mac.Sum(nil)
+}
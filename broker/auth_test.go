@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/numb3r3/live-go/media"
+)
+
+// signedParams returns the parameters of a URL signed for an action on a stream.
+func signedParams(secret, action, key string, expire time.Time) url.Values {
+	return url.Values{
+		"expire": {strconv.FormatInt(expire.Unix(), 10)},
+		"sign":   {hex.EncodeToString(signStream([]byte(secret), action, key, expire.Unix()))},
+	}
+}
+
+func TestStreamAuthSignature(t *testing.T) {
+	a := &streamAuth{secret: []byte("secret"), signPlay: true}
+	later := time.Now().Add(time.Minute)
+
+	// Flip a bit of the signature, so it differs whatever its value
+	badSign := signedParams("secret", "publish", "live/a", later)
+	sign, _ := hex.DecodeString(badSign.Get("sign"))
+	sign[0] ^= 1
+	badSign.Set("sign", hex.EncodeToString(sign))
+
+	tests := []struct {
+		name    string
+		publish bool
+		params  url.Values
+		ok      bool
+	}{
+		{"publish", true, signedParams("secret", "publish", "live/a", later), true},
+		{"play", false, signedParams("secret", "play", "live/a", later), true},
+		{"play URL to publish", true, signedParams("secret", "play", "live/a", later), false},
+		{"publish URL to play", false, signedParams("secret", "publish", "live/a", later), false},
+		{"expired", true, signedParams("secret", "publish", "live/a", time.Now().Add(-time.Second)), false},
+		{"other stream", true, signedParams("secret", "publish", "live/b", later), false},
+		{"other secret", true, signedParams("other", "publish", "live/a", later), false},
+		{"bad signature", true, badSign, false},
+		{"not hexadecimal", true, url.Values{"expire": badSign["expire"], "sign": {"zz"}}, false},
+		{"missing", true, url.Values{}, false},
+	}
+	for _, tc := range tests {
+		c := media.Client{Remote: "127.0.0.1:1000", Params: tc.params}
+		var err error
+		if tc.publish {
+			err = a.OnPublish("live/a", c)
+		} else {
+			err = a.OnPlay("live/a", c)
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestStreamAuthUnsignedPlay(t *testing.T) {
+	a := &streamAuth{secret: []byte("secret")}
+	if err := a.OnPlay("live/a", media.Client{}); err != nil {
+		t.Fatalf("play refused without sign_play: %v", err)
+	}
+	if err := a.OnPublish("live/a", media.Client{}); err == nil {
+		t.Fatal("unsigned publish accepted")
+	}
+}
+
+func TestStreamAuthWebhook(t *testing.T) {
+	events := make(chan streamEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e streamEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		events <- e
+		if e.Params.Get("token") != "valid" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	a := &streamAuth{onPublish: hook.URL, onPlay: hook.URL, onDone: hook.URL}
+	valid := media.Client{Remote: "127.0.0.1:1000", Params: url.Values{"token": {"valid"}}}
+	invalid := media.Client{Remote: "127.0.0.1:1000", Params: url.Values{"token": {"stolen"}}}
+
+	if err := a.OnPublish("live/a", valid); err != nil {
+		t.Errorf("publish refused: %v", err)
+	}
+	if e := <-events; e.Action != "publish" || e.Key != "live/a" || e.Remote != "127.0.0.1:1000" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if err := a.OnPublish("live/a", invalid); err == nil {
+		t.Error("publish accepted despite the webhook")
+	}
+	<-events
+	if err := a.OnPlay("live/a", invalid); err == nil {
+		t.Error("play accepted despite the webhook")
+	}
+	if e := <-events; e.Action != "play" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	a.OnDone("live/a", valid)
+	select {
+	case e := <-events:
+		if e.Action != "done" || e.Key != "live/a" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("done not notified")
+	}
+}
+
+func TestStreamAuthRegistry(t *testing.T) {
+	opts := media.DefaultOptions()
+	opts.Hook = &streamAuth{secret: []byte("secret"), signPlay: true}
+	streams := media.NewStreamRegistry(opts)
+	later := time.Now().Add(time.Minute)
+
+	if _, err := streams.Publish("live/a", media.Client{Params: signedParams("secret", "play", "live/a", later)}); err != media.ErrUnauthorized {
+		t.Fatalf("publish with a play URL: got %v", err)
+	}
+	publisher, err := streams.Publish("live/a", media.Client{Params: signedParams("secret", "publish", "live/a", later)})
+	if err != nil {
+		t.Fatalf("signed publish refused: %v", err)
+	}
+	defer publisher.Close()
+
+	if err := streams.Authorize("live/a", media.Client{}); err != media.ErrUnauthorized {
+		t.Errorf("unsigned play: got %v", err)
+	}
+	if err := streams.Authorize("live/a", media.Client{Params: signedParams("secret", "play", "live/a", later)}); err != nil {
+		t.Errorf("signed play refused: %v", err)
+	}
+}
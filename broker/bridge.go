@@ -0,0 +1,619 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/network/mqtt"
+	"github.com/numb3r3/live-go/network/websocket"
+	"github.com/spf13/viper"
+)
+
+// The directions a topic is bridged in.
+const (
+	bridgeIn   = "in"   // From the remote broker to this one.
+	bridgeOut  = "out"  // From this broker to the remote one.
+	bridgeBoth = "both" // Both ways.
+)
+
+// Errors reported by the bridges.
+var (
+	errBridgeDown    = errors.New("remote broker not connected")
+	errBridgeRefused = errors.New("connection refused by the remote broker")
+	errBridgeScheme  = errors.New("unsupported bridge address scheme")
+)
+
+// bridgeRule represents the topics bridged in a direction, with their topic prefix on
+// either side and the highest QoS they are bridged with.
+type bridgeRule struct {
+	Pattern      string `mapstructure:"pattern"`       // The topic filter, without the prefixes.
+	Direction    string `mapstructure:"direction"`     // Either "in", "out" or "both".
+	LocalPrefix  string `mapstructure:"local_prefix"`  // The prefix of the topics on this broker.
+	RemotePrefix string `mapstructure:"remote_prefix"` // The prefix of the topics on the remote broker.
+	QoS          uint8  `mapstructure:"qos"`           // The QoS the messages are downgraded to.
+}
+
+// bridgeTLS represents the TLS configuration of a bridge.
+type bridgeTLS struct {
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// bridgeConfig represents the configuration of a bridge to a remote broker.
+type bridgeConfig struct {
+	Name         string        `mapstructure:"name"`
+	Address      string        `mapstructure:"address"` // tcp://, tls://, ws:// or wss:// URL.
+	ClientID     string        `mapstructure:"client_id"`
+	Username     string        `mapstructure:"username"`
+	Password     string        `mapstructure:"password"`
+	CleanSession bool          `mapstructure:"clean_session"`
+	KeepAlive    time.Duration `mapstructure:"keepalive"`
+	TLS          bridgeTLS     `mapstructure:"tls"`
+	BufferSize   int           `mapstructure:"buffer_size"`   // The messages buffered while disconnected.
+	ReconnectMin time.Duration `mapstructure:"reconnect_min"` // The first reconnection delay.
+	ReconnectMax time.Duration `mapstructure:"reconnect_max"` // The delay the backoff is capped to.
+	Topics       []bridgeRule  `mapstructure:"topics"`
+}
+
+// bridge represents a connection to a remote MQTT 5 broker as a client, which mirrors
+// topics between the remote broker and this one. The outgoing messages are buffered
+// while the remote broker is down, and the unacknowledged ones are sent again once
+// reconnected. A message is never bridged back to where it came from: the messages
+// bridged in are not bridged out again, and the topics are subscribed with No Local so
+// the remote broker does not echo the messages bridged out.
+type bridge struct {
+	sync.Mutex
+	config     bridgeConfig
+	service    *Service
+	tls        *tls.Config
+	pending    []*mqtt.Publish          // The messages waiting to be sent.
+	inflight   map[uint16]*mqtt.Publish // The messages given an identifier, until acknowledged.
+	released   map[uint16]struct{}      // The QoS 2 messages sent and received, until completed.
+	received   map[uint16]struct{}      // The QoS 2 messages received but not released.
+	lastID     uint16
+	connected  bool
+	generation uint64 // The number of connections, so a previous one stops sending.
+	writer     sync.Mutex
+	wake       chan struct{}
+	closing    chan struct{}
+	closeOnce  sync.Once
+}
+
+// newBridges creates the bridges from the "bridges" section of the configuration.
+func newBridges(cfg *viper.Viper, s *Service) (bridges []*bridge, err error) {
+	var configs []bridgeConfig
+	if err := cfg.UnmarshalKey("bridges", &configs); err != nil {
+		return nil, err
+	}
+
+	for _, c := range configs {
+		b, err := newBridge(c, s)
+		if err != nil {
+			return nil, fmt.Errorf("bridge %s: %v", c.Name, err)
+		}
+		bridges = append(bridges, b)
+	}
+	return
+}
+
+// newBridge validates the configuration of a bridge and creates it.
+func newBridge(c bridgeConfig, s *Service) (*bridge, error) {
+	if c.Name == "" || c.Address == "" {
+		return nil, errors.New("name and address are required")
+	}
+	for _, rule := range c.Topics {
+		switch {
+		case !validFilter(rule.Pattern):
+			return nil, fmt.Errorf("invalid pattern %q", rule.Pattern)
+		case rule.Direction != bridgeIn && rule.Direction != bridgeOut && rule.Direction != bridgeBoth:
+			return nil, fmt.Errorf("invalid direction %q", rule.Direction)
+		case rule.QoS > 2:
+			return nil, fmt.Errorf("invalid qos %d", rule.QoS)
+		}
+	}
+
+	if c.ClientID == "" {
+		c.ClientID = "live-go-bridge-" + s.nodeName()
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = 30 * time.Second
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = 1000
+	}
+	if c.ReconnectMin <= 0 {
+		c.ReconnectMin = time.Second
+	}
+	if c.ReconnectMax < c.ReconnectMin {
+		c.ReconnectMax = 30 * c.ReconnectMin
+	}
+
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return &bridge{
+		config:   c,
+		service:  s,
+		tls:      tlsConfig,
+		inflight: make(map[uint16]*mqtt.Publish),
+		released: make(map[uint16]struct{}),
+		received: make(map[uint16]struct{}),
+		wake:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+	}, nil
+}
+
+// config returns the TLS configuration of the client.
+func (t *bridgeTLS) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// start subscribes to the topics bridged out and connects to the remote broker.
+func (b *bridge) start() {
+	for _, rule := range b.config.Topics {
+		if rule.Direction != bridgeIn {
+			b.service.subscriptions.Subscribe(rule.LocalPrefix+rule.Pattern, b, rule.QoS)
+		}
+	}
+
+	b.service.AddComponent("bridge "+b.config.Name, false, func() error {
+		b.Lock()
+		defer b.Unlock()
+		if !b.connected {
+			return errBridgeDown
+		}
+		return nil
+	})
+	go b.run()
+}
+
+// close disconnects from the remote broker for good.
+func (b *bridge) close() {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+	})
+}
+
+// ID returns the unique identifier of the subscriber.
+func (b *bridge) ID() string {
+	return "bridge/" + b.config.Name
+}
+
+// Send bridges a local message out to the remote broker, unless it was bridged in by
+// this bridge or forwarded by another node, whose own bridge sends it. When the buffer
+// is full, the oldest message is dropped.
+func (b *bridge) Send(m *Message) error {
+	if m.Bridge == b.config.Name || m.Origin != "" {
+		return nil
+	}
+
+	for _, rule := range b.config.Topics {
+		if rule.Direction == bridgeIn || !matchTopic(rule.LocalPrefix+rule.Pattern, m.Topic) {
+			continue
+		}
+
+		topic := rule.RemotePrefix + strings.TrimPrefix(m.Topic, rule.LocalPrefix)
+		packet := &mqtt.Publish{
+			Header:  mqtt.Header{QOS: minQoS(m.QoS, rule.QoS), Retain: m.Retain},
+			Version: mqtt.Version5,
+			Topic:   []byte(topic),
+			Payload: m.Payload,
+		}
+
+		b.Lock()
+		if len(b.pending) >= b.config.BufferSize {
+			b.pending[0] = nil
+			b.pending = b.pending[1:]
+		}
+		b.pending = append(b.pending, packet)
+		b.Unlock()
+
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return nil
+}
+
+// run keeps the bridge connected, reconnecting with an exponential backoff, until the
+// bridge is closed.
+func (b *bridge) run() {
+	backoff := b.config.ReconnectMin
+	for {
+		established, err := b.connect()
+		select {
+		case <-b.closing:
+			return
+		default:
+		}
+
+		if established {
+			backoff = b.config.ReconnectMin
+		}
+		logging.Error("bridge", b.config.Name, "disconnected, retrying in", backoff, err)
+
+		select {
+		case <-b.closing:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > b.config.ReconnectMax {
+			backoff = b.config.ReconnectMax
+		}
+	}
+}
+
+// dial opens the transport to the remote broker.
+func (b *bridge) dial() (net.Conn, error) {
+	u, err := url.Parse(b.config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", u.Host)
+	case "tls", "ssl", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", u.Host, b.tls)
+	case "ws", "wss":
+		return websocket.Dial(b.config.Address, b.tls)
+	default:
+		return nil, errBridgeScheme
+	}
+}
+
+// connect connects to the remote broker and serves the connection until it breaks. It
+// returns whether the connection was established.
+func (b *bridge) connect() (bool, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Stop serving as soon as the bridge is closed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.closing:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	connect := &mqtt.Connect{
+		ProtoName:     []byte("MQTT"),
+		Version:       mqtt.Version5,
+		CleanSeshFlag: b.config.CleanSession,
+		KeepAlive:     uint16(b.config.KeepAlive / time.Second),
+		ClientID:      []byte(b.config.ClientID),
+	}
+	if b.config.Username != "" {
+		connect.UsernameFlag, connect.Username = true, []byte(b.config.Username)
+		connect.PasswordFlag, connect.Password = true, []byte(b.config.Password)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := b.send(conn, connect); err != nil {
+		return false, err
+	}
+	msg, err := mqtt.DecodePacket(reader, 0, mqtt.Version5)
+	if err != nil {
+		return false, err
+	}
+	if connack, ok := msg.(*mqtt.Connack); !ok || connack.ReturnCode != mqtt.Accepted {
+		return false, errBridgeRefused
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Subscribe to the topics bridged in, without getting back the messages bridged out
+	subscribe := &mqtt.Subscribe{Version: mqtt.Version5, MessageID: b.nextID()}
+	for _, rule := range b.config.Topics {
+		if rule.Direction != bridgeOut {
+			subscribe.Subscriptions = append(subscribe.Subscriptions,
+				mqtt.TopicQOSTuple{Topic: []byte(rule.RemotePrefix + rule.Pattern), Qos: rule.QoS, NoLocal: true})
+		}
+	}
+	if len(subscribe.Subscriptions) > 0 {
+		if err := b.send(conn, subscribe); err != nil {
+			return true, err
+		}
+	}
+
+	logging.Info("bridge", b.config.Name, "connected to", b.config.Address)
+	generation, releasing := b.setConnected(true)
+	defer b.setConnected(false)
+
+	// The messages received by the remote broker before the disconnection are released
+	// again rather than sent again
+	for _, id := range releasing {
+		if err := b.send(conn, &mqtt.Pubrel{Version: mqtt.Version5, MessageID: id}); err != nil {
+			return true, err
+		}
+	}
+
+	go b.write(conn, done, generation)
+	for {
+		conn.SetReadDeadline(time.Now().Add(b.config.KeepAlive * 3 / 2))
+		msg, err := mqtt.DecodePacket(reader, 0, mqtt.Version5)
+		if err != nil {
+			return true, err
+		}
+		if err := b.onReceive(conn, msg); err != nil {
+			return true, err
+		}
+	}
+}
+
+// setConnected sets whether the bridge is connected. Once connected, it returns the
+// generation of the connection and the identifiers of the QoS 2 messages to release.
+// Once disconnected, the messages left unacknowledged are queued again, ahead of the
+// others, except the QoS 2 messages already received by the remote broker, which are
+// released once reconnected. Unless the remote broker keeps the session, these are
+// dropped, and the QoS 2 messages received are forgotten.
+func (b *bridge) setConnected(connected bool) (generation uint64, releasing []uint16) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.connected = connected
+	if connected {
+		b.generation++
+		for id := range b.released {
+			releasing = append(releasing, id)
+		}
+		sort.Slice(releasing, func(i, j int) bool { return releasing[i] < releasing[j] })
+		return b.generation, releasing
+	}
+
+	if b.config.CleanSession {
+		b.received = make(map[uint16]struct{})
+		for id := range b.released {
+			delete(b.inflight, id)
+		}
+		b.released = make(map[uint16]struct{})
+	}
+	if len(b.inflight) == 0 {
+		return
+	}
+
+	// The messages sent again keep their identifier inflight, unless the session is
+	// clean, so they are queued only once
+	queued := make([]*mqtt.Publish, 0, len(b.pending))
+	for _, p := range b.pending {
+		if p.MessageID == 0 {
+			queued = append(queued, p)
+		}
+	}
+	unacked := make([]*mqtt.Publish, 0, len(b.inflight))
+	for id, p := range b.inflight {
+		if _, ok := b.released[id]; !ok {
+			p.DUP = true
+			unacked = append(unacked, p)
+		}
+	}
+	sort.Slice(unacked, func(i, j int) bool {
+		return unacked[i].MessageID < unacked[j].MessageID
+	})
+	if b.config.CleanSession {
+		for _, p := range unacked {
+			p.MessageID, p.DUP = 0, false
+		}
+		b.inflight = make(map[uint16]*mqtt.Publish)
+	}
+
+	b.pending = append(unacked, queued...)
+	return
+}
+
+// write sends the pending messages and the keep-alive pings until the connection is
+// done.
+func (b *bridge) write(conn net.Conn, done chan struct{}, generation uint64) {
+	ticker := time.NewTicker(b.config.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		for p := b.next(generation); p != nil; p = b.next(generation) {
+			if err := b.send(conn, p); err != nil {
+				conn.Close()
+				return
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-b.wake:
+		case <-ticker.C:
+			if err := b.send(conn, &mqtt.Pingreq{}); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// next pops the next pending message, which is kept inflight until acknowledged. Once
+// the connection of the generation is lost, the messages are left pending.
+func (b *bridge) next(generation uint64) *mqtt.Publish {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.connected || b.generation != generation || len(b.pending) == 0 {
+		return nil
+	}
+	p := b.pending[0]
+	b.pending[0] = nil
+	b.pending = b.pending[1:]
+
+	if p.QOS > 0 {
+		if p.MessageID == 0 {
+			p.MessageID = b.nextIDLocked()
+		}
+		b.inflight[p.MessageID] = p
+	}
+	return p
+}
+
+// onReceive handles a packet received from the remote broker.
+func (b *bridge) onReceive(conn net.Conn, msg mqtt.Message) error {
+	switch packet := msg.(type) {
+	case *mqtt.Publish:
+		switch packet.QOS {
+		case 0:
+			b.bridgeIn(packet)
+		case 1:
+			b.bridgeIn(packet)
+			return b.send(conn, &mqtt.Puback{Version: mqtt.Version5, MessageID: packet.MessageID})
+		case 2:
+			// A QoS 2 message is retransmitted until released, but published only once
+			b.Lock()
+			_, duplicate := b.received[packet.MessageID]
+			b.received[packet.MessageID] = struct{}{}
+			b.Unlock()
+			if !duplicate {
+				b.bridgeIn(packet)
+			}
+			return b.send(conn, &mqtt.Pubrec{Version: mqtt.Version5, MessageID: packet.MessageID})
+		}
+
+	case *mqtt.Pubrel:
+		b.Lock()
+		delete(b.received, packet.MessageID)
+		b.Unlock()
+		return b.send(conn, &mqtt.Pubcomp{Version: mqtt.Version5, MessageID: packet.MessageID})
+
+	case *mqtt.Pubrec:
+		// A refusal ends the exchange, otherwise the message is released from now on,
+		// even after a reconnection
+		if packet.ReasonCode >= mqtt.ReasonUnspecifiedError {
+			b.ack(packet.MessageID)
+			return nil
+		}
+		b.Lock()
+		if _, ok := b.inflight[packet.MessageID]; ok {
+			b.released[packet.MessageID] = struct{}{}
+		}
+		b.Unlock()
+		return b.send(conn, &mqtt.Pubrel{Version: mqtt.Version5, MessageID: packet.MessageID})
+
+	case *mqtt.Puback:
+		b.ack(packet.MessageID)
+
+	case *mqtt.Pubcomp:
+		b.ack(packet.MessageID)
+
+	case *mqtt.Suback:
+		for _, qos := range packet.Qos {
+			if qos == mqtt.SubackFailure {
+				logging.Error("bridge", b.config.Name, "subscription refused by the remote broker")
+			}
+		}
+	}
+	return nil
+}
+
+// bridgeIn publishes a message received from the remote broker.
+func (b *bridge) bridgeIn(p *mqtt.Publish) {
+	topic := string(p.Topic)
+	for _, rule := range b.config.Topics {
+		if rule.Direction == bridgeOut || !matchTopic(rule.RemotePrefix+rule.Pattern, topic) {
+			continue
+		}
+
+		local := rule.LocalPrefix + strings.TrimPrefix(topic, rule.RemotePrefix)
+		if !validTopic(local) || reservedTopic(local) {
+			return
+		}
+
+		b.service.publish(&Message{
+			Topic:   local,
+			Payload: p.Payload,
+			QoS:     minQoS(p.QOS, rule.QoS),
+			Retain:  p.Retain,
+			Bridge:  b.config.Name,
+		})
+		return
+	}
+}
+
+// ack removes an acknowledged message from the inflight ones.
+func (b *bridge) ack(id uint16) {
+	b.Lock()
+	delete(b.inflight, id)
+	delete(b.released, id)
+	b.Unlock()
+}
+
+// send writes a packet to the remote broker.
+func (b *bridge) send(conn net.Conn, msg mqtt.Message) error {
+	b.writer.Lock()
+	defer b.writer.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := msg.EncodeTo(conn)
+	return err
+}
+
+// nextID returns the next packet identifier.
+func (b *bridge) nextID() uint16 {
+	b.Lock()
+	defer b.Unlock()
+	return b.nextIDLocked()
+}
+
+func (b *bridge) nextIDLocked() uint16 {
+	for {
+		if b.lastID++; b.lastID == 0 {
+			continue
+		}
+		if _, ok := b.inflight[b.lastID]; !ok {
+			return b.lastID
+		}
+	}
+}
+
+// minQoS returns the lowest of two QoS.
+func minQoS(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,269 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/numb3r3/live-go/network/mqtt"
+	"github.com/spf13/viper"
+)
+
+// inbox is a subscriber collecting the messages it is sent.
+type inbox chan *Message
+
+func (i inbox) ID() string { return "inbox" }
+
+func (i inbox) Send(m *Message) error {
+	i <- m
+	return nil
+}
+
+// receive waits for the next message of the inbox.
+func (i inbox) receive(t *testing.T) *Message {
+	t.Helper()
+	select {
+	case m := <-i:
+		return m
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+// empty checks that no message is received for a while.
+func (i inbox) empty(t *testing.T) {
+	t.Helper()
+	select {
+	case m := <-i:
+		t.Fatalf("unexpected message on %s", m.Topic)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// newTestService creates a standalone service, with the live streams disabled.
+func newTestService(t *testing.T, cfg *viper.Viper) *Service {
+	cfg.Set("data_dir", t.TempDir())
+	cfg.Set("hls.enabled", false)
+	cfg.Set("dash.enabled", false)
+	s, err := NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newBridgedServices creates a remote service served over websocket, and a local one
+// bridged to it with a rule.
+func newBridgedServices(t *testing.T, rule map[string]interface{}) (local, remote *Service) {
+	remote = newTestService(t, viper.New())
+	server := httptest.NewServer(remote.http.Handler)
+	t.Cleanup(server.Close)
+
+	cfg := viper.New()
+	cfg.Set("bridges", []map[string]interface{}{{
+		"name":    "remote",
+		"address": "ws" + strings.TrimPrefix(server.URL, "http") + "/",
+		"topics":  []map[string]interface{}{rule},
+	}})
+	local = newTestService(t, cfg)
+
+	b := local.bridges[0]
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		b.Lock()
+		connected := b.connected
+		b.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bridge not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return local, remote
+}
+
+func TestBridgeOut(t *testing.T) {
+	local, remote := newBridgedServices(t, map[string]interface{}{
+		"pattern": "sensors/#", "direction": "out", "remote_prefix": "site/", "qos": 1,
+	})
+	received := make(inbox, 4)
+	remote.subscriptions.Subscribe("site/#", received, 1)
+
+	local.publish(&Message{Topic: "sensors/a", Payload: []byte("1"), QoS: 1, Retain: true})
+	m := received.receive(t)
+	if m.Topic != "site/sensors/a" || string(m.Payload) != "1" || m.QoS != 1 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if retained := remote.retained.Match("site/#"); len(retained) != 1 || string(retained[0].Payload) != "1" {
+		t.Fatalf("message not retained on the remote broker: %v", retained)
+	}
+
+	// The messages forwarded by another node of the cluster are bridged by that node
+	local.publish(&Message{Topic: "sensors/b", Payload: []byte("2"), Origin: "other"})
+	local.publish(&Message{Topic: "other/c", Payload: []byte("3")})
+	received.empty(t)
+}
+
+func TestBridgeIn(t *testing.T) {
+	local, remote := newBridgedServices(t, map[string]interface{}{
+		"pattern": "#", "direction": "both", "remote_prefix": "site/", "local_prefix": "local/", "qos": 2,
+	})
+	received := make(inbox, 4)
+	local.subscriptions.Subscribe("local/#", received, 2)
+	for deadline := time.Now().Add(3 * time.Second); len(remote.subscriptions.Lookup("site/a")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("bridge not subscribed to the remote broker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	remote.publish(&Message{Topic: "site/a", Payload: []byte("1"), QoS: 2})
+	m := received.receive(t)
+	if m.Topic != "local/a" || string(m.Payload) != "1" || m.Bridge != "remote" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	// Neither bridged back out nor bridged in again, once echoed by the remote broker
+	received.empty(t)
+	if n := len(remote.retained.Match("#")); n != 0 {
+		t.Fatalf("%d messages retained on the remote broker", n)
+	}
+}
+
+func TestBridgeInQoS2Retransmit(t *testing.T) {
+	local := newTestService(t, viper.New())
+	b, err := newBridge(bridgeConfig{
+		Name:    "remote",
+		Address: "tcp://127.0.0.1:1",
+		Topics:  []bridgeRule{{Pattern: "#", Direction: bridgeIn, QoS: 2}},
+	}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(inbox, 4)
+	local.subscriptions.Subscribe("#", received, 2)
+
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	publish := &mqtt.Publish{Header: mqtt.Header{QOS: 2}, Topic: []byte("a"), MessageID: 1, Payload: []byte("1")}
+	for i := 0; i < 2; i++ {
+		if err := b.onReceive(conn, publish); err != nil {
+			t.Fatal(err)
+		}
+		publish.DUP = true
+	}
+	received.receive(t)
+	received.empty(t)
+
+	// The identifier is reused once the message is released
+	if err := b.onReceive(conn, &mqtt.Pubrel{MessageID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.onReceive(conn, &mqtt.Publish{Header: mqtt.Header{QOS: 2}, Topic: []byte("a"), MessageID: 1, Payload: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if m := received.receive(t); string(m.Payload) != "2" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestBridgeNoEcho(t *testing.T) {
+	local, remote := newBridgedServices(t, map[string]interface{}{
+		"pattern": "#", "direction": "both", "remote_prefix": "site/", "qos": 1,
+	})
+	received := make(inbox, 4)
+	local.subscriptions.Subscribe("a", received, 1)
+	for deadline := time.Now().Add(3 * time.Second); len(remote.subscriptions.Lookup("site/a")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("bridge not subscribed to the remote broker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The remote broker does not echo the message back to the bridge
+	local.publish(&Message{Topic: "a", Payload: []byte("1"), QoS: 1})
+	received.receive(t)
+	received.empty(t)
+
+	// An identical message published on the remote broker is still bridged in
+	remote.publish(&Message{Topic: "site/a", Payload: []byte("1"), QoS: 1})
+	if m := received.receive(t); m.Bridge != "remote" || string(m.Payload) != "1" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	local := newTestService(t, viper.New())
+	b, err := newBridge(bridgeConfig{
+		Name:    "remote",
+		Address: "tcp://127.0.0.1:1",
+		Topics:  []bridgeRule{{Pattern: "#", Direction: bridgeOut, QoS: 2}},
+	}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	generation, _ := b.setConnected(true)
+	b.Send(&Message{Topic: "a", Payload: []byte("1"), QoS: 2})
+	b.Send(&Message{Topic: "b", Payload: []byte("2"), QoS: 2})
+	received, sent := b.next(generation), b.next(generation)
+	if err := b.onReceive(conn, &mqtt.Pubrec{MessageID: received.MessageID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once disconnected, the previous connection no longer pops the messages
+	b.Send(&Message{Topic: "c", Payload: []byte("3"), QoS: 2})
+	b.setConnected(false)
+	if p := b.next(generation); p != nil {
+		t.Fatalf("message %s popped once disconnected", p.Topic)
+	}
+
+	// The message received is released again, the other one is sent again
+	next, releasing := b.setConnected(true)
+	if len(releasing) != 1 || releasing[0] != received.MessageID {
+		t.Fatalf("releasing %v, expected %d", releasing, received.MessageID)
+	}
+	if p := b.next(generation); p != nil {
+		t.Fatalf("message %s popped by the previous connection", p.Topic)
+	}
+	if p := b.next(next); p != sent || !p.DUP {
+		t.Fatalf("unexpected message %+v", p)
+	}
+	if p := b.next(next); p == nil || string(p.Topic) != "c" || p.DUP {
+		t.Fatalf("unexpected message %+v", p)
+	}
+
+	// The messages waiting to be sent again are queued only once
+	for i := 0; i < 2; i++ {
+		b.setConnected(false)
+		b.setConnected(true)
+	}
+	b.Lock()
+	n := len(b.pending)
+	b.Unlock()
+	if n != 2 {
+		t.Fatalf("%d messages pending", n)
+	}
+
+	if err := b.onReceive(conn, &mqtt.Pubcomp{MessageID: received.MessageID}); err != nil {
+		t.Fatal(err)
+	}
+	b.setConnected(false)
+	if _, releasing := b.setConnected(true); len(releasing) != 0 {
+		t.Fatalf("completed messages released again: %v", releasing)
+	}
+}
@@ -0,0 +1,278 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/network/cluster"
+	"github.com/spf13/viper"
+)
+
+// The frames exchanged by the brokers of the cluster.
+const (
+	frameInterest    = "interest"    // The full set of the filters subscribed on a node.
+	frameSubscribe   = "subscribe"   // A filter gained its first subscriber on a node.
+	frameUnsubscribe = "unsubscribe" // A filter lost its last subscriber on a node.
+	framePublish     = "publish"     // A message forwarded to a node.
+)
+
+// errNoPeers is reported by the cluster component while none of the seeds is reachable.
+var errNoPeers = errors.New("no peer connected")
+
+// peerSubscriber represents the subscriptions of another node, to which the messages
+// published on this node are forwarded.
+type peerSubscriber struct {
+	node    string
+	cluster *clusterNode
+}
+
+// ID returns the unique identifier of the subscriber.
+func (p *peerSubscriber) ID() string {
+	return "node/" + p.node
+}
+
+// Node returns the name of the node the subscriber stands for.
+func (p *peerSubscriber) Node() string {
+	return p.node
+}
+
+// Send forwards a message to the node.
+func (p *peerSubscriber) Send(m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return p.cluster.peers.Send(p.node, &cluster.Frame{Type: framePublish, Data: data})
+}
+
+// ------------------------------------------------------------------------------------
+
+// clusterNode represents the broker as a node of a cluster. The nodes exchange their
+// subscription interest, which every node keeps in its subscription trie as a peer
+// subscriber per node, so a message is only forwarded to the nodes with matching
+// subscribers. A forwarded message is routed to the local subscribers only.
+type clusterNode struct {
+	sync.Mutex
+	peers       *cluster.Cluster
+	service     *Service
+	interest    map[string]map[string]bool       // The filters subscribed on every peer.
+	pending     map[uint64]chan *sessionTransfer // The replies awaited by the takeovers.
+	released    map[string]*releasedSession      // The sessions released to the peers, until acknowledged.
+	lastRequest uint64                           // The identifier of the last takeover.
+}
+
+// newClusterNode creates the cluster node from the "cluster" section of the
+// configuration, or nil if clustering is disabled.
+func newClusterNode(cfg *viper.Viper, s *Service) *clusterNode {
+	if !cfg.GetBool("cluster.enabled") {
+		return nil
+	}
+
+	opts := cluster.DefaultOptions()
+	cfg.SetDefault("cluster.name", s.nodeName())
+	cfg.SetDefault("cluster.bind", opts.Bind)
+	cfg.SetDefault("cluster.gossip_interval", opts.GossipInterval)
+	cfg.SetDefault("cluster.dead_timeout", opts.DeadTimeout)
+	cfg.SetDefault("cluster.takeover_timeout", "2s")
+	opts.Name = cfg.GetString("cluster.name")
+	opts.Bind = cfg.GetString("cluster.bind")
+	opts.Advertise = cfg.GetString("cluster.advertise")
+	opts.Seeds = cfg.GetStringSlice("cluster.seeds")
+	opts.Secret = cfg.GetString("cluster.secret")
+	opts.GossipInterval = cfg.GetDuration("cluster.gossip_interval")
+	opts.DeadTimeout = cfg.GetDuration("cluster.dead_timeout")
+
+	n := &clusterNode{
+		service:  s,
+		interest: make(map[string]map[string]bool),
+		pending:  make(map[uint64]chan *sessionTransfer),
+		released: make(map[string]*releasedSession),
+	}
+	n.peers = cluster.New(opts, n)
+	return n
+}
+
+// join starts the cluster node and tells the peers about the changes of the interest
+// of this node.
+func (n *clusterNode) join() error {
+	n.service.subscriptions.Lock()
+	n.service.subscriptions.onInterest = n.onInterest
+	n.service.subscriptions.Unlock()
+
+	if err := n.peers.Start(); err != nil {
+		return err
+	}
+
+	seeds := len(n.service.Config.GetStringSlice("cluster.seeds")) > 0
+	n.service.AddComponent("cluster", false, func() error {
+		if seeds && len(n.peers.Members()) == 0 {
+			return errNoPeers
+		}
+		return nil
+	})
+	return nil
+}
+
+// onInterest broadcasts a change of the interest of this node.
+func (n *clusterNode) onInterest(filter string, interested bool) {
+	f := &cluster.Frame{Type: frameUnsubscribe, Filters: []string{filter}}
+	if interested {
+		f.Type = frameSubscribe
+	}
+	n.peers.Broadcast(f)
+}
+
+// OnJoin sends the interest of this node to a peer which just joined.
+func (n *clusterNode) OnJoin(node string) {
+	n.service.subscriptions.Interest(func(filters []string) {
+		if err := n.peers.Send(node, &cluster.Frame{Type: frameInterest, Filters: filters}); err != nil {
+			logging.Error("cluster: unable to send the interest to", node, err)
+		}
+	})
+}
+
+// OnLeave removes the subscriptions of a peer which left.
+func (n *clusterNode) OnLeave(node string) {
+	n.setInterest(node, nil)
+}
+
+// OnFrame handles a frame sent by a peer.
+func (n *clusterNode) OnFrame(node string, f *cluster.Frame) {
+	switch f.Type {
+	case frameInterest:
+		n.setInterest(node, f.Filters)
+	case frameSubscribe, frameUnsubscribe:
+		n.updateInterest(node, f.Filters, f.Type == frameSubscribe)
+	case framePublish:
+		var m Message
+		if err := json.Unmarshal(f.Data, &m); err != nil || !validTopic(m.Topic) {
+			logging.Error("cluster: invalid message from", node)
+			return
+		}
+		m.Origin = node
+		n.service.route(&m)
+	case frameTakeover:
+		n.onTakeover(node, f.Data)
+	case frameSession:
+		n.onSession(node, f.Data)
+	case frameImported:
+		n.onImported(node, f.Data)
+	}
+}
+
+// setInterest replaces the filters subscribed on a peer.
+func (n *clusterNode) setInterest(node string, filters []string) {
+	n.Lock()
+	defer n.Unlock()
+
+	sub := &peerSubscriber{node: node, cluster: n}
+	current := make(map[string]bool, len(filters))
+	for _, filter := range filters {
+		if validFilter(filter) {
+			current[filter] = true
+			n.service.subscriptions.Subscribe(filter, sub, 2)
+		}
+	}
+	for filter := range n.interest[node] {
+		if !current[filter] {
+			n.service.subscriptions.Unsubscribe(filter, sub)
+		}
+	}
+
+	if len(current) == 0 {
+		delete(n.interest, node)
+		return
+	}
+	n.interest[node] = current
+}
+
+// updateInterest adds or removes filters subscribed on a peer.
+func (n *clusterNode) updateInterest(node string, filters []string, interested bool) {
+	n.Lock()
+	defer n.Unlock()
+
+	sub := &peerSubscriber{node: node, cluster: n}
+	current, ok := n.interest[node]
+	if !ok {
+		current = make(map[string]bool)
+		n.interest[node] = current
+	}
+
+	for _, filter := range filters {
+		switch {
+		case !validFilter(filter):
+		case interested:
+			current[filter] = true
+			n.service.subscriptions.Subscribe(filter, sub, 2)
+		default:
+			delete(current, filter)
+			n.service.subscriptions.Unsubscribe(filter, sub)
+		}
+	}
+}
+
+// forward sends a message published on this node to the peers with matching
+// subscribers. A retained message is sent to all of the peers, so they all keep it.
+// The '$' topics are specific to every node and never forwarded.
+func (n *clusterNode) forward(m *Message, subs []subscription) {
+	if m.Origin != "" || strings.HasPrefix(m.Topic, "$") {
+		return
+	}
+
+	sent := make(map[string]bool)
+	for _, sub := range subs {
+		if peer, ok := sub.subscriber.(*peerSubscriber); ok {
+			sent[peer.node] = true
+			if err := peer.Send(m); err != nil {
+				logging.Info("unable to forward to", peer.node, err)
+			}
+		}
+	}
+
+	if m.Retain {
+		for _, member := range n.peers.Members() {
+			if !sent[member.Name] {
+				(&peerSubscriber{node: member.Name, cluster: n}).Send(m)
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// clusterMember represents a peer node along with its subscription interest.
+type clusterMember struct {
+	cluster.Member
+	Filters int `json:"filters"` // The number of topic filters subscribed on the node.
+}
+
+// clusterStatus represents the state of the cluster, as seen from this node.
+type clusterStatus struct {
+	Node    string          `json:"node"`
+	Members []clusterMember `json:"members"`
+}
+
+// status returns the state of the cluster.
+func (n *clusterNode) status() *clusterStatus {
+	n.Lock()
+	defer n.Unlock()
+
+	status := &clusterStatus{Node: n.peers.Name(), Members: []clusterMember{}}
+	for _, m := range n.peers.Members() {
+		status.Members = append(status.Members, clusterMember{Member: m, Filters: len(n.interest[m.Name])})
+	}
+	return status
+}
+
+// onAdminCluster shows the state of the cluster.
+func (s *Service) onAdminCluster(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		writeError(w, http.StatusNotFound, "clustering disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cluster.status())
+}
@@ -1,64 +1,635 @@
 package broker
 
 import (
-	// "io"
-	// "bufio"
+	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/network/mqtt"
+	"github.com/pborman/uuid"
 )
 
+// Protocol errors which terminate a connection.
+var (
+	errNotConnected     = errors.New("the first packet must be a connect")
+	errAlreadyConnected = errors.New("duplicate connect packet")
+	errUnexpectedPacket = errors.New("unexpected packet")
+	errDisconnected     = errors.New("client disconnected")
+)
+
+// transport is implemented by the sockets which are able to tell the name of the
+// transport they are carried over.
+type transport interface {
+	Transport() string
+}
+
 // Conn represents an incoming connection.
 type Conn struct {
 	sync.Mutex
-	tracked  uint32
-	socket   net.Conn
-	username string
-	service  *Service // The service for this connection.
-	guid     string
+	tracked     uint32
+	socket      net.Conn
+	username    string
+	service     *Service // The service for this connection.
+	guid        string
+	clientID    string              // The client id presented in the connect packet.
+	transport   string              // The name of the transport of the socket.
+	connectedAt time.Time           // The time the connection was accepted.
+	subs        map[string]uint8    // The subscribed topic filters with their QoS.
+	noLocal     map[string]bool     // The filters subscribed with the No Local option of MQTT 5.
+	messageID   uint32              // The last message id used for the outgoing messages.
+	persistent  bool                // Whether the session outlives the connection.
+	version     uint8               // The protocol version of the client.
+	metadata    map[string]string   // The user properties presented in the connect packet.
+	inflight    map[uint16]*Message // The outgoing messages not acknowledged yet.
+	maxInflight int                 // The number of outgoing messages allowed inflight.
+	pending     []*Message          // The outgoing messages waiting for room inflight.
+	received    map[uint16]uint8    // The incoming QoS 2 messages not released yet, with their reason.
+	writer      sync.Mutex          // Serializes the writes on the socket.
 }
 
 // NewConn creates a new connection.
 func (s *Service) newConn(t net.Conn) *Conn {
 	c := &Conn{
-		tracked: 0,
-		service: s,
-		socket:  t,
+		tracked:     0,
+		service:     s,
+		socket:      t,
+		guid:        uuid.NewRandom().String(),
+		transport:   t.RemoteAddr().Network(),
+		connectedAt: time.Now().UTC(),
+		subs:        make(map[string]uint8),
+		noLocal:     make(map[string]bool),
+		inflight:    make(map[uint16]*Message),
+		maxInflight: s.maxInflight(),
+		received:    make(map[uint16]uint8),
 	}
 
-	// TODO: generate a global unique id
+	if t, ok := t.(transport); ok {
+		c.transport = t.Transport()
+	}
 
 	logging.Info("net connection created.")
 
-	// Increment the connection counter
-	atomic.AddInt64(&s.connections, 1)
+	// Track the connection
+	atomic.StoreUint32(&c.tracked, 1)
+	s.conns.Add(c)
 	return c
 }
 
+// ID returns the unique identifier of the connection.
+func (c *Conn) ID() string {
+	return c.guid
+}
+
+// ClientID returns the client id of the connection, empty until connected.
+func (c *Conn) ClientID() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.clientID
+}
+
+// Username returns the username the client has authenticated with.
+func (c *Conn) Username() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.username
+}
+
+// Metadata returns the custom metadata the client has presented when connecting.
+func (c *Conn) Metadata() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	return c.metadata
+}
+
+// Subscriptions returns the topic filters the connection is subscribed to.
+func (c *Conn) Subscriptions() map[string]uint8 {
+	c.Lock()
+	defer c.Unlock()
+
+	subs := make(map[string]uint8, len(c.subs))
+	for filter, qos := range c.subs {
+		subs[filter] = qos
+	}
+	return subs
+}
+
 // Process processes the messages.
 func (c *Conn) Process() error {
 	defer c.Close()
-	// reader := bufio.NewReaderSize(c.socket, 65536)
+	reader := bufio.NewReaderSize(c.socket, 65536)
 
 	for {
 		// Set read/write deadlines so we can close dangling connections
 		c.socket.SetDeadline(time.Now().Add(time.Second * 120))
 
 		// Decode an incoming package
+		msg, err := mqtt.DecodePacket(reader, mqtt.MaxMessageSize, c.protocolVersion())
+		if err != nil {
+			return err
+		}
+
+		if err := c.onReceive(msg); err != nil {
+			logging.Info("closing", c.guid, err)
+			return err
+		}
+	}
+}
+
+// onReceive handles a decoded incoming packet.
+func (c *Conn) onReceive(msg mqtt.Message) error {
+	connected := c.ClientID() != ""
+	if !connected && msg.Type() != mqtt.TypeOfConnect {
+		return errNotConnected
+	}
+
+	switch packet := msg.(type) {
+	case *mqtt.Connect:
+		if connected {
+			return errAlreadyConnected
+		}
+		return c.onConnect(packet)
+
+	case *mqtt.Subscribe:
+		// A subscriber may request the history of the topics through user properties
+		replay, replaying, err := parseReplay(
+			userProperty(packet.Properties, "replay-since"),
+			userProperty(packet.Properties, "replay-from"),
+			userProperty(packet.Properties, "replay-limit"))
+		if err != nil {
+			logging.Info("ignoring the replay request of", c.guid, err)
+		}
+
+		// A resubscribing client may also tell the last sequences it has seen, to get
+		// the gaps filled
+		filters := make([]string, 0, len(packet.Subscriptions))
+		for _, sub := range packet.Subscriptions {
+			filters = append(filters, string(sub.Topic))
+		}
+		lastSeqs, err := parseLastSeqs(packet.Properties.Users("last-seq"), filters)
+		if err != nil {
+			logging.Info("ignoring the last sequences of", c.guid, err)
+		}
+
+		ack := &mqtt.Suback{Version: packet.Version, MessageID: packet.MessageID, Qos: make([]uint8, 0, len(packet.Subscriptions))}
+		for _, sub := range packet.Subscriptions {
+			ack.Qos = append(ack.Qos, c.onSubscribe(string(sub.Topic), sub.Qos, sub.NoLocal))
+		}
+		c.saveSession()
+		if err := c.send(ack); err != nil {
+			return err
+		}
+
+		// Fill the gaps, or send the requested history or the retained messages, once
+		// the subscriptions are acknowledged
+		for i, sub := range packet.Subscriptions {
+			switch {
+			case ack.Qos[i] == mqtt.SubackFailure:
+			case c.fillGaps(string(sub.Topic), ack.Qos[i], lastSeqs):
+			case replaying:
+				c.service.sendHistory(string(sub.Topic), c, ack.Qos[i], replay)
+			default:
+				c.service.sendRetained(string(sub.Topic), c, ack.Qos[i])
+			}
+		}
+		return nil
+
+	case *mqtt.Unsubscribe:
+		ack := &mqtt.Unsuback{Version: packet.Version, MessageID: packet.MessageID}
+		for _, topic := range packet.Topics {
+			ack.ReasonCodes = append(ack.ReasonCodes, c.onUnsubscribe(string(topic)))
+		}
+		c.saveSession()
+		return c.send(ack)
+
+	case *mqtt.Publish:
+		if !validTopic(string(packet.Topic)) {
+			return errUnexpectedPacket
+		}
+
+		// A QoS 2 message is retransmitted until released, but routed only once
+		if packet.QOS == 2 {
+			c.Lock()
+			reason, duplicate := c.received[packet.MessageID]
+			c.Unlock()
+			if duplicate {
+				return c.send(&mqtt.Pubrec{Version: packet.Version, MessageID: packet.MessageID, ReasonCode: reason})
+			}
+		}
+
+		// Refused messages are acknowledged but dropped, as MQTT 3.1.1 has no way to
+		// reject them, while MQTT 5 acknowledges them with the reason
+		var reason uint8
+		if _, err := c.service.onPublish(c, c.Username(), &Message{
+			Topic:   string(packet.Topic),
+			Payload: packet.Payload,
+			QoS:     packet.QOS,
+			Retain:  packet.Retain,
+			Client:  c.ClientID(),
+		}); err != nil {
+			logging.Info("publish of", c.guid, "on", string(packet.Topic), "dropped:", err)
+			reason = publishReason(err)
+		}
+
+		switch packet.QOS {
+		case 1:
+			return c.send(&mqtt.Puback{Version: packet.Version, MessageID: packet.MessageID, ReasonCode: reason})
+		case 2:
+			// A refusal ends the exchange in MQTT 5, no release follows it
+			if reason < mqtt.ReasonUnspecifiedError {
+				c.Lock()
+				c.received[packet.MessageID] = reason
+				c.Unlock()
+			}
+			return c.send(&mqtt.Pubrec{Version: packet.Version, MessageID: packet.MessageID, ReasonCode: reason})
+		}
+		return nil
+
+	case *mqtt.Pubrel:
+		c.Lock()
+		delete(c.received, packet.MessageID)
+		c.Unlock()
+		return c.send(&mqtt.Pubcomp{Version: packet.Version, MessageID: packet.MessageID})
+
+	case *mqtt.Puback:
+		return c.acked(packet.MessageID)
+
+	case *mqtt.Pubrec:
+		if packet.ReasonCode >= mqtt.ReasonUnspecifiedError {
+			return c.acked(packet.MessageID)
+		}
+		return c.send(&mqtt.Pubrel{Version: packet.Version, MessageID: packet.MessageID})
+
+	case *mqtt.Pubcomp:
+		return c.acked(packet.MessageID)
+
+	case *mqtt.Pingreq:
+		return c.send(&mqtt.Pingresp{})
+
+	case *mqtt.Disconnect:
+		return errDisconnected
+	}
+
+	return errUnexpectedPacket
+}
+
+// onConnect handles the connect packet, authenticating the client.
+func (c *Conn) onConnect(packet *mqtt.Connect) error {
+	version := packet.Version
+	refuse := func(code uint8) {
+		c.send(&mqtt.Connack{Version: version, ReturnCode: connackCode(version, code)})
+	}
+
+	username, password := string(packet.Username), string(packet.Password)
+	if !c.service.auth.Authenticate(username, password) {
+		refuse(mqtt.ErrRefusedBadUsernameOrPassword)
+		return fmt.Errorf("authentication failed for user '%s'", username)
+	}
+
+	clientID := string(packet.ClientID)
+	if clientID == "" {
+		if !packet.CleanSeshFlag {
+			refuse(mqtt.ErrRefusedIDRejected)
+			return errors.New("empty client id requires a clean session")
+		}
+		clientID = c.guid
+	}
+
+	var metadata map[string]string
+	for _, prop := range packet.Properties {
+		if prop.ID == mqtt.PropUserProperty {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[string(prop.Name)] = string(prop.Data)
+		}
+	}
+
+	c.Lock()
+	if max, ok := packet.Properties.Get(mqtt.PropReceiveMaximum); ok && max.Value > 0 && int(max.Value) < c.maxInflight {
+		c.maxInflight = int(max.Value)
+	}
+	c.version = version
+	c.metadata = metadata
+	c.clientID = clientID
+	c.username = username
+	c.persistent = !packet.CleanSeshFlag
+	c.Unlock()
+
+	if err := c.service.hooks.onConnect(c); err != nil {
+		c.Lock()
+		c.clientID = ""
+		c.Unlock()
+		refuse(mqtt.ErrRefusedNotAuthorised)
+		return err
+	}
+
+	// Only one connection per client id is allowed, take over the previous one
+	if prev := c.service.conns.Bind(c, clientID); prev != nil && prev != c {
+		logging.Info("client", clientID, "taken over by", c.guid)
+		prev.Disconnect()
+	}
+
+	// The client may have been connected to another node of the cluster, which is
+	// waited for up to the takeover timeout before acknowledging the connection
+	if c.service.cluster != nil {
+		c.service.cluster.takeover(clientID, packet.CleanSeshFlag)
+	}
+
+	session, err := c.resumeSession(clientID, packet.CleanSeshFlag)
+	if err != nil {
+		refuse(mqtt.ErrRefusedServerUnavailable)
+		return err
+	}
+
+	if err := c.send(&mqtt.Connack{
+		Version:        version,
+		SessionPresent: session != nil,
+		ReturnCode:     mqtt.Accepted,
+	}); err != nil {
+		return err
+	}
+
+	c.service.publishClientEvent(c, "connected")
+
+	// Deliver the messages queued while the client was offline
+	if session != nil {
+		queued, err := c.service.store.Dequeue(clientID)
+		for _, m := range queued {
+			if err := c.Send(m); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			logging.Error("unable to dequeue the messages of", clientID, err)
+		}
+	}
+	return nil
+}
+
+// resumeSession restores the stored session of the client, unless a clean session is
+// requested in which case the stored one is discarded. The restored session is
+// returned, nil if there was none.
+func (c *Conn) resumeSession(clientID string, clean bool) (*Session, error) {
+	store := c.service.store
+	session, err := store.GetSession(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if clean {
+		if session != nil {
+			c.service.goOnline(clientID, session.Subscriptions)
+			return nil, store.DeleteSession(clientID)
+		}
+		return nil, nil
+	}
+
+	if session == nil {
+		c.saveSession()
+		return nil, nil
+	}
+
+	c.Lock()
+	for filter, qos := range session.Subscriptions {
+		c.subs[filter] = qos
+	}
+	c.Unlock()
+
+	// Subscribe before removing the offline subscriber, so no message is missed
+	for filter, qos := range session.Subscriptions {
+		c.service.subscriptions.Subscribe(filter, c, qos)
+		c.service.join(c, filter)
+	}
+	c.service.goOnline(clientID, session.Subscriptions)
+	return session, nil
+}
+
+// saveSession persists the session state of the connection, if it outlives it.
+func (c *Conn) saveSession() {
+	c.Lock()
+	persistent := c.persistent
+	c.Unlock()
+
+	if persistent {
+		c.service.saveSession(c)
+	}
+}
+
+// onSubscribe subscribes the connection to a topic filter and returns the granted QoS.
+// With No Local, the messages published by the client are not sent back to it.
+func (c *Conn) onSubscribe(filter string, qos uint8, noLocal bool) uint8 {
+	if !validFilter(filter) || !c.service.acl.Allowed(c.Username(), filter, aclRead) {
+		return mqtt.SubackFailure
+	}
 
-		// b := make([]byte, 1)
-		// if _, err := io.ReadFull(reader, b); err != nil {
-		// 	return nil, 0, 0, err
-		// }
+	// QoS 2 is not supported for the outgoing messages, grant the QoS 1 instead
+	if qos > 1 {
+		qos = 1
+	}
+	if err := c.service.hooks.onSubscribe(c, filter, qos); err != nil {
+		logging.Info("subscription of", c.guid, "to", filter, "refused:", err)
+		return mqtt.SubackFailure
+	}
+
+	c.Lock()
+	c.subs[filter] = qos
+	if noLocal {
+		c.noLocal[filter] = true
+	} else {
+		delete(c.noLocal, filter)
+	}
+	c.Unlock()
+
+	c.service.subscriptions.Subscribe(filter, c, qos)
+	c.service.join(c, filter)
+	return qos
+}
+
+// onUnsubscribe unsubscribes the connection from a topic filter and returns the reason
+// code of MQTT 5.
+func (c *Conn) onUnsubscribe(filter string) uint8 {
+	c.Lock()
+	delete(c.subs, filter)
+	delete(c.noLocal, filter)
+	c.Unlock()
+
+	c.service.leave(c, filter)
+	if !c.service.subscriptions.Unsubscribe(filter, c) {
+		return 0x11 // No subscription existed
+	}
+	return 0
+}
+
+// Send forwards a message published on one of the subscribed topics. The messages with
+// a QoS above 0 are kept inflight until acknowledged, up to the receive maximum of the
+// client or the configured limit, and the next ones wait in order for some room, up to
+// the limit of the offline queues.
+func (c *Conn) Send(m *Message) error {
+	if c.ownMessage(m) {
+		return nil
+	}
+
+	c.writer.Lock()
+	defer c.writer.Unlock()
+
+	if m.QoS > 0 {
+		c.Lock()
+		if len(c.pending) > 0 || len(c.inflight) >= c.maxInflight {
+			defer c.Unlock()
+			if len(c.pending) >= c.service.maxQueued() {
+				return errQueueFull
+			}
+			c.pending = append(c.pending, m)
+			return nil
+		}
+		c.Unlock()
+	}
+	return c.publish(m)
+}
+
+// ownMessage returns whether a message was published by the client itself and only
+// matches filters subscribed with No Local, so it is not sent back.
+func (c *Conn) ownMessage(m *Message) bool {
+	c.Lock()
+	defer c.Unlock()
+	if m.Client == "" || m.Client != c.clientID || len(c.noLocal) == 0 {
+		return false
+	}
+
+	for filter := range c.subs {
+		if !c.noLocal[filter] && matchTopic(filter, m.Topic) {
+			return false
+		}
+	}
+	return true
+}
 
+// publish writes a message, kept inflight until acknowledged when its QoS is above 0.
+// The writer must be locked.
+func (c *Conn) publish(m *Message) error {
+	packet := &mqtt.Publish{
+		Header:  mqtt.Header{QOS: m.QoS, Retain: m.Retain},
+		Version: c.protocolVersion(),
+		Topic:   []byte(m.Topic),
+		Payload: m.Payload,
+	}
+
+	// Stamp the message with its sequence and timestamp, as user properties or in an
+	// envelope for the clients without properties when configured
+	if m.Seq > 0 {
+		switch {
+		case packet.Version == mqtt.Version5:
+			packet.Properties.AddUser("seq", strconv.FormatUint(m.Seq, 10))
+			packet.Properties.AddUser("ts", strconv.FormatInt(unixMillis(m.Time), 10))
+			packet.Properties.AddUser("epoch", strconv.FormatInt(c.service.sequences.epoch, 10))
+		case c.service.envelope:
+			packet.Payload = c.service.wrap(m)
+		}
+	}
+
+	if m.QoS > 0 {
+		packet.MessageID = c.nextMessageID()
+
+		// Keep the message until acknowledged, so it can be queued again if the
+		// client disconnects in between
+		c.Lock()
+		c.inflight[packet.MessageID] = m
+		c.Unlock()
+	}
+	_, err := packet.EncodeTo(c.socket)
+	return err
+}
+
+// acked removes an acknowledged message from the inflight ones, then sends the
+// messages waiting for the room it leaves.
+func (c *Conn) acked(id uint16) error {
+	c.Lock()
+	m, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.Unlock()
+	if ok {
+		c.service.hooks.onAcked(c, m)
+	}
+
+	c.writer.Lock()
+	defer c.writer.Unlock()
+	for {
+		c.Lock()
+		if len(c.pending) == 0 || len(c.inflight) >= c.maxInflight {
+			c.Unlock()
+			return nil
+		}
+		next := c.pending[0]
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		c.Unlock()
+
+		if err := c.publish(next); err != nil {
+			return err
+		}
+	}
+}
+
+// fillGaps sends the messages missed on the topics matching the filter, or a notice
+// on the gap topic when they can not be filled. It returns whether the last sequence of
+// any of the topics was known.
+func (c *Conn) fillGaps(filter string, qos uint8, lastSeqs map[string]uint64) (known bool) {
+	for topic, lastSeq := range lastSeqs {
+		if !matchTopic(filter, topic) {
+			continue
+		}
+
+		known = true
+		missed, notice := c.service.fillGap(topic, lastSeq)
+		if notice != nil {
+			c.Send(notice.message())
+			continue
+		}
+		for _, m := range missed {
+			msg := *m
+			if qos < msg.QoS {
+				msg.QoS = qos
+			}
+			if c.Send(&msg) == nil {
+				c.service.delivered(c, &msg)
+			}
+		}
+	}
+	return
+}
+
+// nextMessageID returns the next non-zero message id for the outgoing messages.
+func (c *Conn) nextMessageID() uint16 {
+	for {
+		if id := uint16(atomic.AddUint32(&c.messageID, 1)); id != 0 {
+			return id
+		}
 	}
 }
 
+// send encodes and writes a packet to the socket.
+func (c *Conn) send(msg mqtt.Message) error {
+	c.writer.Lock()
+	defer c.writer.Unlock()
+
+	_, err := msg.EncodeTo(c.socket)
+	return err
+}
+
+// Disconnect forcibly terminates the connection. The processing loop is interrupted
+// and cleans up the connection.
+func (c *Conn) Disconnect() error {
+	return c.socket.Close()
+}
+
 // Close terminates the connection.
 func (c *Conn) Close() error {
 	logging.Info("connection closed.")
@@ -68,7 +639,146 @@ func (c *Conn) Close() error {
 		logging.Info("closing", fmt.Sprintf("pancic recovered: %s \n %s", r, debug.Stack()))
 	}
 
-	// Close the transport and decrement the connection counter
-	atomic.AddInt64(&c.service.connections, -1)
+	// Untrack the connection and remove all of its subscriptions
+	if atomic.CompareAndSwapUint32(&c.tracked, 1, 0) {
+		subs := c.Subscriptions()
+		for filter := range subs {
+			c.service.subscriptions.Unsubscribe(filter, c)
+			c.service.leave(c, filter)
+		}
+
+		// A persistent session goes offline, unless it was taken over by a new connection
+		if c.service.conns.Remove(c) && c.isPersistent() {
+			c.service.goOffline(c.ClientID(), subs)
+			c.requeueInflight()
+			c.service.saveSession(c)
+		}
+		if c.ClientID() != "" {
+			c.service.publishClientEvent(c, "disconnected")
+			c.service.hooks.onDisconnect(c)
+		}
+	}
+
 	return c.socket.Close()
 }
+
+// protocolVersion returns the protocol version of the client, 3.1.1 until connected.
+func (c *Conn) protocolVersion() uint8 {
+	c.Lock()
+	defer c.Unlock()
+	if c.version == 0 {
+		return mqtt.Version311
+	}
+	return c.version
+}
+
+// connackCode returns the return code of a refused connection, translated to the
+// reason code of MQTT 5 for the clients of this version.
+func connackCode(version, code uint8) uint8 {
+	if version != mqtt.Version5 {
+		return code
+	}
+
+	switch code {
+	case mqtt.ErrRefusedBadProtocolVersion:
+		return mqtt.ReasonUnsupportedProtocolVersion
+	case mqtt.ErrRefusedIDRejected:
+		return mqtt.ReasonClientIDNotValid
+	case mqtt.ErrRefusedServerUnavailable:
+		return mqtt.ReasonServerUnavailable
+	case mqtt.ErrRefusedBadUsernameOrPassword:
+		return mqtt.ReasonBadUsernameOrPassword
+	case mqtt.ErrRefusedNotAuthorised:
+		return mqtt.ReasonNotAuthorized
+	}
+	return code
+}
+
+// publishReason returns the MQTT 5 reason code of a refused publish.
+func publishReason(err error) uint8 {
+	if e, ok := err.(*hookError); ok && e.err == errPayloadTooLarge {
+		return mqtt.ReasonQuotaExceeded
+	}
+	return mqtt.ReasonNotAuthorized
+}
+
+// userProperty returns the value of a user property, empty if missing.
+func userProperty(props mqtt.Properties, name string) string {
+	value, _ := props.User(name)
+	return value
+}
+
+// isPersistent returns whether the session outlives the connection.
+func (c *Conn) isPersistent() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.persistent
+}
+
+// requeueInflight queues the unacknowledged messages again for the offline session,
+// in their order of routing, followed by the ones waiting for room inflight.
+func (c *Conn) requeueInflight() {
+	c.Lock()
+	messages := make([]*Message, 0, len(c.inflight)+len(c.pending))
+	for _, m := range c.inflight {
+		messages = append(messages, m)
+	}
+	pending := c.pending
+	c.pending = nil
+	c.Unlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	messages = append(messages, pending...)
+	for _, m := range messages {
+		if err := c.service.store.Enqueue(c.ClientID(), m); err != nil {
+			logging.Error("unable to requeue the message of", c.ClientID(), err)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// subscriptionInfo represents a subscription of a connection.
+type subscriptionInfo struct {
+	Topic string `json:"topic"`
+	QoS   uint8  `json:"qos"`
+}
+
+// connInfo represents the publicly visible state of a connection.
+type connInfo struct {
+	ID            string             `json:"id"`
+	ClientID      string             `json:"client_id"`
+	Username      string             `json:"username"`
+	RemoteAddr    string             `json:"remote_addr"`
+	Transport     string             `json:"transport"`
+	ConnectedAt   time.Time          `json:"connected_at"`
+	Subscriptions []subscriptionInfo `json:"subscriptions"`
+}
+
+// info returns a snapshot of the state of the connection.
+func (c *Conn) info() connInfo {
+	info := connInfo{
+		ID:            c.guid,
+		Transport:     c.transport,
+		ConnectedAt:   c.connectedAt,
+		Subscriptions: []subscriptionInfo{},
+	}
+	if addr := c.socket.RemoteAddr(); addr != nil {
+		info.RemoteAddr = addr.String()
+	}
+
+	c.Lock()
+	info.ClientID = c.clientID
+	info.Username = c.username
+	for filter, qos := range c.subs {
+		info.Subscriptions = append(info.Subscriptions, subscriptionInfo{Topic: filter, QoS: qos})
+	}
+	c.Unlock()
+
+	sort.Slice(info.Subscriptions, func(i, j int) bool {
+		return info.Subscriptions[i].Topic < info.Subscriptions[j].Topic
+	})
+	return info
+}
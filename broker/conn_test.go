@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/numb3r3/live-go/network/mqtt"
+	"github.com/spf13/viper"
+)
+
+// testClient represents an MQTT 5 client connected to a service over a pipe.
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// connect connects a client to the service with the properties of its connect packet.
+func connect(t *testing.T, s *Service, props mqtt.Properties) *testClient {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	s.onAcceptConn(server)
+
+	c := &testClient{conn: client, reader: bufio.NewReader(client)}
+	c.write(t, &mqtt.Connect{Version: mqtt.Version5, ClientID: []byte("c"), CleanSeshFlag: true, KeepAlive: 60, Properties: props})
+	if connack, ok := c.read(t).(*mqtt.Connack); !ok || connack.ReturnCode != mqtt.Accepted {
+		t.Fatal("connection refused")
+	}
+	return c
+}
+
+func (c *testClient) write(t *testing.T, msg mqtt.Message) {
+	t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	if _, err := msg.EncodeTo(c.conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) read(t *testing.T) mqtt.Message {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	msg, err := mqtt.DecodePacket(c.reader, 0, mqtt.Version5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// silent checks that nothing is received for a while.
+func (c *testClient) silent(t *testing.T) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if msg, err := mqtt.DecodePacket(c.reader, 0, mqtt.Version5); err == nil {
+		t.Fatalf("unexpected %s", msg.String())
+	}
+}
+
+func TestConnQoS2RoutedOnce(t *testing.T) {
+	s := newTestService(t, viper.New())
+	received := make(inbox, 4)
+	s.subscriptions.Subscribe("a", received, 2)
+	c := connect(t, s, nil)
+
+	publish := &mqtt.Publish{Version: mqtt.Version5, Header: mqtt.Header{QOS: 2}, Topic: []byte("a"), MessageID: 1, Payload: []byte("1")}
+	for i := 0; i < 2; i++ {
+		c.write(t, publish)
+		if _, ok := c.read(t).(*mqtt.Pubrec); !ok {
+			t.Fatal("publish not acknowledged")
+		}
+		publish.DUP = true
+	}
+	received.receive(t)
+	received.empty(t)
+
+	// The identifier is reused once the message is released
+	c.write(t, &mqtt.Pubrel{Version: mqtt.Version5, MessageID: 1})
+	if _, ok := c.read(t).(*mqtt.Pubcomp); !ok {
+		t.Fatal("release not completed")
+	}
+	publish.DUP, publish.Payload = false, []byte("2")
+	c.write(t, publish)
+	c.read(t)
+	if m := received.receive(t); string(m.Payload) != "2" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestConnReceiveMaximum(t *testing.T) {
+	s := newTestService(t, viper.New())
+	c := connect(t, s, mqtt.Properties{{ID: mqtt.PropReceiveMaximum, Value: 1}})
+	c.write(t, &mqtt.Subscribe{Version: mqtt.Version5, MessageID: 1, Subscriptions: []mqtt.TopicQOSTuple{{Topic: []byte("a"), Qos: 1}}})
+	if _, ok := c.read(t).(*mqtt.Suback); !ok {
+		t.Fatal("subscription not acknowledged")
+	}
+
+	go func() {
+		for _, payload := range []string{"1", "2", "3"} {
+			s.publish(&Message{Topic: "a", Payload: []byte(payload), QoS: 1})
+		}
+	}()
+
+	// A single message is sent at a time, each acknowledgement makes room for the next
+	for _, payload := range []string{"1", "2", "3"} {
+		p, ok := c.read(t).(*mqtt.Publish)
+		if !ok || string(p.Payload) != payload {
+			t.Fatalf("expected message %s", payload)
+		}
+		c.silent(t)
+		c.write(t, &mqtt.Puback{Version: mqtt.Version5, MessageID: p.MessageID})
+	}
+}
+
+func TestClientEventTopicEscaped(t *testing.T) {
+	s := newTestService(t, viper.New())
+	events := make(inbox, 4)
+	s.subscriptions.Subscribe("$SYS/brokers/+/clients/+/connected", events, 0)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	s.onAcceptConn(server)
+	c := &testClient{conn: client, reader: bufio.NewReader(client)}
+	c.write(t, &mqtt.Connect{Version: mqtt.Version5, ClientID: []byte("a/+/#%"), CleanSeshFlag: true, KeepAlive: 60})
+	c.read(t)
+
+	if m := events.receive(t); !strings.HasSuffix(m.Topic, "/clients/a%2F%2B%2F%23%25/connected") {
+		t.Fatalf("unexpected topic %s", m.Topic)
+	}
+}
@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/flv"
+	"github.com/numb3r3/live-go/network/websocket"
+	"github.com/pborman/uuid"
+)
+
+// playerQueueSize is the default number of packets queued for a player.
+const playerQueueSize = 1024
+
+// mediaPlayer represents a viewer of a live stream, fed through its own bounded queue
+// so that a slow viewer only ever drops its own frames.
+type mediaPlayer struct {
+	id    string
+	queue *media.Queue
+}
+
+// newMediaPlayer creates a new player of a protocol.
+func newMediaPlayer(protocol string, queueSize int) *mediaPlayer {
+	return &mediaPlayer{
+		id:    protocol + "/" + uuid.NewRandom().String(),
+		queue: media.NewQueue(queueSize),
+	}
+}
+
+// ID returns the unique identifier of the player.
+func (p *mediaPlayer) ID() string {
+	return p.id
+}
+
+// WritePacket queues a packet for the player.
+func (p *mediaPlayer) WritePacket(packet *media.Packet) error {
+	return p.queue.Push(packet)
+}
+
+// Close stops the player.
+func (p *mediaPlayer) Close() error {
+	return p.queue.Close()
+}
+
+// playStream attaches a new player to a stream, once the client of the request is
+// authorized, and returns it along with the stream.
+func (s *Service) playStream(r *http.Request, key, protocol string) (*mediaPlayer, *media.Stream, error) {
+	player := newMediaPlayer(protocol, s.Config.GetInt("streams.queue_size"))
+	client := media.Client{Remote: r.RemoteAddr, Params: r.URL.Query()}
+	stream, err := s.streams.Play(key, player, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return player, stream, nil
+}
+
+// streamFLV muxes a stream as FLV until the player is closed or the writer fails. The
+// flush function, if any, is called after every batch of tags.
+func streamFLV(w io.Writer, flush func(), player *mediaPlayer) error {
+	fw := flv.NewWriter(w)
+	if err := fw.WriteHeader(true, true); err != nil {
+		return err
+	}
+
+	for {
+		if flush != nil {
+			flush()
+		}
+
+		packets, ok := player.queue.Pop()
+		if !ok {
+			return nil
+		}
+		for _, p := range packets {
+			if err := fw.WritePacket(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseStreamPath returns the key of a stream from the path of a request, such as
+// "<prefix><app>/<stream>.flv".
+func parseStreamPath(path, prefix, ext string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, ext) {
+		return "", false
+	}
+
+	key := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext)
+	if i := strings.IndexByte(key, '/'); i <= 0 || i == len(key)-1 {
+		return "", false
+	}
+	return key, true
+}
+
+// writePlayError replies to a player which was refused a stream.
+func writePlayError(w http.ResponseWriter, err error) {
+	status := http.StatusNotFound
+	if err == media.ErrUnauthorized {
+		status = http.StatusForbidden
+	}
+	writeError(w, status, err.Error())
+}
+
+// Occurs when a live stream is requested over HTTP-FLV, at "/live/<app>/<stream>.flv".
+// The tags are sent as a chunked response, until either the stream or the player ends.
+func (s *Service) onHTTPFLV(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	key, ok := parseStreamPath(r.URL.Path, "/live/", ".flv")
+	if !ok || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	player, stream, err := s.playStream(r, key, "http-flv")
+	if err != nil {
+		writePlayError(w, err)
+		return
+	}
+	defer stream.Detach(player)
+
+	// Stop the player once the viewer goes away
+	go func() {
+		<-r.Context().Done()
+		player.Close()
+	}()
+
+	// The players such as flv.js are usually served from another origin
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	streamFLV(w, flusher.Flush, player)
+}
+
+// Occurs when a live stream is requested over websocket, at "/ws/live/<app>/<stream>.flv".
+// The tags are sent as binary messages, until either the stream or the player ends.
+func (s *Service) onWSFLV(w http.ResponseWriter, r *http.Request) {
+	key, ok := parseStreamPath(r.URL.Path, "/ws/live/", ".flv")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !websocket.IsUpgrade(r) {
+		writeError(w, http.StatusUpgradeRequired, "websocket upgrade required")
+		return
+	}
+
+	player, stream, err := s.playStream(r, key, "ws-flv")
+	if err != nil {
+		writePlayError(w, err)
+		return
+	}
+	defer stream.Detach(player)
+
+	conn, err := websocket.UpgradeMedia(w, r)
+	if err != nil {
+		player.Close()
+		return
+	}
+	defer conn.Close()
+
+	// Stop the player once the viewer goes away, its messages are discarded
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		player.Close()
+	}()
+	streamFLV(conn, nil, player)
+}
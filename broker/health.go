@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// component represents a registered part of the service which is able to report
+// its own health, such as a listener, a storage backend or a cluster peer.
+type component struct {
+	name     string       // The name of the component.
+	critical bool         // Whether the service is unusable when the component is down.
+	check    func() error // The check to perform, returns nil when healthy.
+}
+
+// components represents the set of registered components.
+type components struct {
+	sync.RWMutex
+	list map[string]component
+}
+
+// componentStatus represents the reported state of a single component.
+type componentStatus struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthStatus represents the body of the health and readiness responses.
+type healthStatus struct {
+	Status      string            `json:"status"`
+	Uptime      float64           `json:"uptime"`
+	Connections int               `json:"connections"`
+	Components  []componentStatus `json:"components"`
+	Cluster     *clusterStatus    `json:"cluster,omitempty"`
+}
+
+// AddComponent registers a component whose health is reported on the /health and /ready
+// endpoints. A critical component being down makes both endpoints fail. Registering
+// a component with the same name replaces the previous one.
+func (s *Service) AddComponent(name string, critical bool, check func() error) {
+	s.components.Lock()
+	defer s.components.Unlock()
+	s.components.list[name] = component{name: name, critical: critical, check: check}
+}
+
+// RemoveComponent unregisters a previously registered component.
+func (s *Service) RemoveComponent(name string) {
+	s.components.Lock()
+	defer s.components.Unlock()
+	delete(s.components.list, name)
+}
+
+// checkComponents runs all of the registered checks and returns their statuses, sorted
+// by name, along with whether all of the critical components are up.
+func (s *Service) checkComponents() (statuses []componentStatus, ok bool) {
+	s.components.RLock()
+	list := make([]component, 0, len(s.components.list))
+	for _, c := range s.components.list {
+		list = append(list, c)
+	}
+	s.components.RUnlock()
+
+	ok = true
+	statuses = make([]componentStatus, 0, len(list))
+	for _, c := range list {
+		status := componentStatus{Name: c.name, Critical: c.critical, Status: "up"}
+		if err := c.check(); err != nil {
+			status.Status = "down"
+			status.Error = err.Error()
+			if c.critical {
+				ok = false
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return
+}
+
+// IsDraining returns whether the service is shutting down.
+func (s *Service) IsDraining() bool {
+	return atomic.LoadUint32(&s.draining) == 1
+}
+
+// uptime returns the duration since the service has started listening.
+func (s *Service) uptime() time.Duration {
+	if s.startTime.IsZero() {
+		return 0
+	}
+	return time.Since(s.startTime)
+}
+
+// writeHealth writes the health status of the service. The readiness check additionally
+// requires the service to have started listening.
+func (s *Service) writeHealth(w http.ResponseWriter, readiness bool) {
+	statuses, ok := s.checkComponents()
+	status := healthStatus{
+		Status:      "ok",
+		Uptime:      s.uptime().Seconds(),
+		Connections: s.conns.Count(),
+		Components:  statuses,
+	}
+	if s.cluster != nil {
+		status.Cluster = s.cluster.status()
+	}
+
+	code := http.StatusOK
+	switch {
+	case s.IsDraining():
+		status.Status = "draining"
+	case !ok:
+		status.Status = "unavailable"
+	case readiness && s.startTime.IsZero():
+		status.Status = "starting"
+	}
+
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, status)
+}
+
+// Occurs when a new HTTP health check is received.
+func (s *Service) onHealth(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, false)
+}
+
+// Occurs when a new HTTP readiness check is received.
+func (s *Service) onReady(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, true)
+}
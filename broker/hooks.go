@@ -0,0 +1,301 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/spf13/viper"
+)
+
+// errPayloadTooLarge is returned by the payload limit hook.
+var errPayloadTooLarge = errors.New("payload too large")
+
+// Hook represents custom logic run along the lifecycle of the clients and of their
+// messages. The hooks are called in their order of registration, and the first error
+// returned rejects the operation. The connection is nil for the messages published
+// over HTTP. A hook only interested in some of the events embeds HookBase.
+type Hook interface {
+	// ID returns the name of the hook, as reported in the logs.
+	ID() string
+
+	// OnConnect is called once a client is authenticated, an error refuses it.
+	OnConnect(c *Conn) error
+
+	// OnDisconnect is called once a connected client is gone.
+	OnDisconnect(c *Conn)
+
+	// OnSubscribe is called before a subscription is granted, an error refuses it.
+	OnSubscribe(c *Conn, filter string, qos uint8) error
+
+	// OnPublish is called before a message is routed. It returns the message to route,
+	// which may be modified or replaced, or nil to drop it. An error rejects it.
+	OnPublish(c *Conn, m *Message) (*Message, error)
+
+	// OnDelivered is called once a message is sent to a subscriber.
+	OnDelivered(sub Subscriber, m *Message)
+
+	// OnAcked is called once a client acknowledged a message sent with a QoS above 0.
+	OnAcked(c *Conn, m *Message)
+}
+
+// HookBase implements all of the methods of a hook as no-ops.
+type HookBase struct{}
+
+// ID returns the name of the hook.
+func (HookBase) ID() string { return "base" }
+
+// OnConnect accepts the client.
+func (HookBase) OnConnect(c *Conn) error { return nil }
+
+// OnDisconnect does nothing.
+func (HookBase) OnDisconnect(c *Conn) {}
+
+// OnSubscribe accepts the subscription.
+func (HookBase) OnSubscribe(c *Conn, filter string, qos uint8) error { return nil }
+
+// OnPublish routes the message unchanged.
+func (HookBase) OnPublish(c *Conn, m *Message) (*Message, error) { return m, nil }
+
+// OnDelivered does nothing.
+func (HookBase) OnDelivered(sub Subscriber, m *Message) {}
+
+// OnAcked does nothing.
+func (HookBase) OnAcked(c *Conn, m *Message) {}
+
+// hookError represents the error of a hook which rejected an operation.
+type hookError struct {
+	hook string
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return e.hook + ": " + e.err.Error()
+}
+
+// ------------------------------------------------------------------------------------
+
+// hooks represents the registered hooks, in their order of registration.
+type hooks struct {
+	sync.RWMutex
+	list []Hook
+}
+
+// AddHook registers a hook, called after the ones registered before it.
+func (s *Service) AddHook(h Hook) {
+	s.hooks.Lock()
+	defer s.hooks.Unlock()
+	s.hooks.list = append(s.hooks.list, h)
+}
+
+// all returns the registered hooks.
+func (h *hooks) all() []Hook {
+	h.RLock()
+	defer h.RUnlock()
+	return h.list
+}
+
+func (h *hooks) onConnect(c *Conn) error {
+	for _, hook := range h.all() {
+		if err := hook.OnConnect(c); err != nil {
+			return fmt.Errorf("%s: %v", hook.ID(), err)
+		}
+	}
+	return nil
+}
+
+func (h *hooks) onDisconnect(c *Conn) {
+	for _, hook := range h.all() {
+		hook.OnDisconnect(c)
+	}
+}
+
+func (h *hooks) onSubscribe(c *Conn, filter string, qos uint8) error {
+	for _, hook := range h.all() {
+		if err := hook.OnSubscribe(c, filter, qos); err != nil {
+			return fmt.Errorf("%s: %v", hook.ID(), err)
+		}
+	}
+	return nil
+}
+
+// onPublish passes the message through the hooks, and returns nil if one dropped it.
+func (h *hooks) onPublish(c *Conn, m *Message) (*Message, error) {
+	for _, hook := range h.all() {
+		var err error
+		if m, err = hook.OnPublish(c, m); err != nil {
+			return nil, &hookError{hook: hook.ID(), err: err}
+		}
+		if m == nil {
+			return nil, nil
+		}
+	}
+	return m, nil
+}
+
+func (h *hooks) onDelivered(sub Subscriber, m *Message) {
+	for _, hook := range h.all() {
+		hook.OnDelivered(sub, m)
+	}
+}
+
+func (h *hooks) onAcked(c *Conn, m *Message) {
+	for _, hook := range h.all() {
+		hook.OnAcked(c, m)
+	}
+}
+
+// addConfiguredHooks registers the built-in hooks enabled in the "hooks" section of the
+// configuration, the payload limit before the audit log.
+func (s *Service) addConfiguredHooks(cfg *viper.Viper) error {
+	if cfg.IsSet("hooks.payload_limit") {
+		limit := &PayloadLimitHook{MaxSize: cfg.GetInt("hooks.payload_limit.max_size")}
+		if err := cfg.UnmarshalKey("hooks.payload_limit.topics", &limit.Topics); err != nil {
+			return err
+		}
+		s.AddHook(limit)
+	}
+
+	if cfg.GetBool("hooks.audit.enabled") {
+		w := io.Writer(os.Stdout)
+		if path := cfg.GetString("hooks.audit.file"); path != "" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			w = f
+		}
+		s.AddHook(NewAuditHook(w, cfg.GetBool("hooks.audit.deliveries")))
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// auditEvent represents an entry of the audit log.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ClientID string    `json:"client_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Topic    string    `json:"topic,omitempty"`
+	QoS      uint8     `json:"qos"`
+	Size     int       `json:"size,omitempty"`
+}
+
+// AuditHook writes the lifecycle of the clients to an audit log, as a JSON object per
+// line. The deliveries, being as many as the subscribers, are only logged on demand.
+type AuditHook struct {
+	HookBase
+	sync.Mutex
+	w          io.Writer
+	deliveries bool
+}
+
+// NewAuditHook creates an audit hook writing to the writer.
+func NewAuditHook(w io.Writer, deliveries bool) *AuditHook {
+	return &AuditHook{w: w, deliveries: deliveries}
+}
+
+// ID returns the name of the hook.
+func (h *AuditHook) ID() string { return "audit" }
+
+// OnConnect logs the connection.
+func (h *AuditHook) OnConnect(c *Conn) error {
+	h.write(c, auditEvent{Event: "connect"})
+	return nil
+}
+
+// OnDisconnect logs the disconnection.
+func (h *AuditHook) OnDisconnect(c *Conn) {
+	h.write(c, auditEvent{Event: "disconnect"})
+}
+
+// OnSubscribe logs the subscription.
+func (h *AuditHook) OnSubscribe(c *Conn, filter string, qos uint8) error {
+	h.write(c, auditEvent{Event: "subscribe", Topic: filter, QoS: qos})
+	return nil
+}
+
+// OnPublish logs the message.
+func (h *AuditHook) OnPublish(c *Conn, m *Message) (*Message, error) {
+	h.write(c, auditEvent{Event: "publish", Topic: m.Topic, QoS: m.QoS, Size: len(m.Payload)})
+	return m, nil
+}
+
+// OnDelivered logs the delivery, if enabled.
+func (h *AuditHook) OnDelivered(sub Subscriber, m *Message) {
+	if c, ok := sub.(*Conn); ok && h.deliveries {
+		h.write(c, auditEvent{Event: "delivered", Topic: m.Topic, QoS: m.QoS, Size: len(m.Payload)})
+	}
+}
+
+// OnAcked logs the acknowledgement, if the deliveries are logged.
+func (h *AuditHook) OnAcked(c *Conn, m *Message) {
+	if h.deliveries {
+		h.write(c, auditEvent{Event: "acked", Topic: m.Topic, QoS: m.QoS})
+	}
+}
+
+// write appends an entry to the log.
+func (h *AuditHook) write(c *Conn, e auditEvent) {
+	e.Time = time.Now().UTC()
+	if c != nil {
+		e.ClientID, e.Username = c.ClientID(), c.Username()
+		if addr := c.socket.RemoteAddr(); addr != nil {
+			e.Remote = addr.String()
+		}
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if _, err := h.w.Write(append(line, '\n')); err != nil {
+		logging.Error("unable to write the audit log", err)
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// PayloadLimit represents the payload size limit of the topics matching a pattern.
+type PayloadLimit struct {
+	Pattern string `mapstructure:"pattern"`
+	MaxSize int    `mapstructure:"max_size"`
+}
+
+// PayloadLimitHook rejects the messages whose payload exceeds the limit of their topic,
+// the first matching one or the default one otherwise. A zero limit is unlimited.
+type PayloadLimitHook struct {
+	HookBase
+	MaxSize int            // The default limit, in bytes.
+	Topics  []PayloadLimit // The limits of the topics, checked in order.
+}
+
+// ID returns the name of the hook.
+func (h *PayloadLimitHook) ID() string { return "payload_limit" }
+
+// OnPublish rejects the message if its payload is too large.
+func (h *PayloadLimitHook) OnPublish(c *Conn, m *Message) (*Message, error) {
+	limit := h.MaxSize
+	for _, t := range h.Topics {
+		if matchTopic(t.Pattern, m.Topic) {
+			limit = t.MaxSize
+			break
+		}
+	}
+
+	if limit > 0 && len(m.Payload) > limit {
+		return nil, errPayloadTooLarge
+	}
+	return m, nil
+}
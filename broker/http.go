@@ -0,0 +1,36 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorResponse represents the body of a failed HTTP API request.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error as the JSON body of the response.
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorResponse{Error: message})
+}
+
+// authenticate checks the basic authentication credentials of the request, replying
+// with an authentication challenge when they are missing or invalid.
+func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) (username string, ok bool) {
+	username, password, _ := r.BasicAuth()
+	if username == "" || !s.auth.Authenticate(username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="live-go"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return "", false
+	}
+	return username, true
+}
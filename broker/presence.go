@@ -0,0 +1,231 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/spf13/viper"
+)
+
+// presenceSuffix is the level appended to a topic for its presence events.
+const presenceSuffix = "/$presence"
+
+// member represents a client present on a topic.
+type member struct {
+	ConnID   string            `json:"-"`
+	ClientID string            `json:"client_id"`
+	Username string            `json:"username"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	JoinedAt time.Time         `json:"joined_at"`
+}
+
+// presence represents the members of the presence-enabled topics. A client joins a
+// topic when it subscribes to it, and leaves it when it unsubscribes or its connection
+// closes, for whatever reason. The members are tracked per connection, so a client
+// taking over its previous connection is not removed by the late leave of the latter.
+type presence struct {
+	sync.Mutex
+	patterns []string
+	topics   map[string]map[string]*member
+}
+
+// newPresence creates the presence tracking from the "presence" section of the
+// configuration.
+func newPresence(cfg *viper.Viper) *presence {
+	p := &presence{topics: make(map[string]map[string]*member)}
+	for _, pattern := range cfg.GetStringSlice("presence.topics") {
+		if !validFilter(pattern) {
+			logging.Error("invalid presence topic", pattern)
+			continue
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p
+}
+
+// Enabled returns whether the presence is tracked on the subscribed topic filter. Only
+// the filters without wildcards designate a topic to be present on.
+func (p *presence) Enabled(filter string) bool {
+	if strings.ContainsAny(filter, "+#") || strings.HasSuffix(filter, presenceSuffix) {
+		return false
+	}
+	return matchAny(p.patterns, filter)
+}
+
+// Join adds a member to the topic and returns the number of members, or false if the
+// member was already present.
+func (p *presence) Join(topic string, m *member) (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	members, ok := p.topics[topic]
+	if !ok {
+		members = make(map[string]*member)
+		p.topics[topic] = members
+	}
+	if _, ok := members[m.ConnID]; ok {
+		return len(members), false
+	}
+
+	members[m.ConnID] = m
+	return len(members), true
+}
+
+// Leave removes the member of a connection from the topic and returns it along with the
+// number of remaining members, nil if it was not present.
+func (p *presence) Leave(topic, connID string) (*member, int) {
+	p.Lock()
+	defer p.Unlock()
+
+	members := p.topics[topic]
+	m, ok := members[connID]
+	if !ok {
+		return nil, len(members)
+	}
+
+	delete(members, connID)
+	if len(members) == 0 {
+		delete(p.topics, topic)
+	}
+	return m, len(members)
+}
+
+// Members returns the members of the topic, in their order of joining.
+func (p *presence) Members(topic string) []member {
+	p.Lock()
+	result := make([]member, 0, len(p.topics[topic]))
+	for _, m := range p.topics[topic] {
+		result = append(result, *m)
+	}
+	p.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].JoinedAt.Before(result[j].JoinedAt)
+	})
+	return result
+}
+
+// Counts returns the number of members of every topic with members.
+func (p *presence) Counts() map[string]int {
+	p.Lock()
+	defer p.Unlock()
+
+	counts := make(map[string]int, len(p.topics))
+	for topic, members := range p.topics {
+		counts[topic] = len(members)
+	}
+	return counts
+}
+
+// ------------------------------------------------------------------------------------
+
+// presenceEvent represents a join or a leave, as published on the presence topic.
+type presenceEvent struct {
+	Event    string            `json:"event"`
+	Topic    string            `json:"topic"`
+	ClientID string            `json:"client_id"`
+	Username string            `json:"username"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Count    int               `json:"count"`
+	Ts       int64             `json:"ts"`
+}
+
+// join makes the connection a member of the topic, if presence-enabled.
+func (s *Service) join(c *Conn, topic string) {
+	if !s.presence.Enabled(topic) {
+		return
+	}
+
+	m := &member{
+		ConnID:   c.guid,
+		ClientID: c.ClientID(),
+		Username: c.Username(),
+		Metadata: c.Metadata(),
+		JoinedAt: time.Now().UTC(),
+	}
+	if count, ok := s.presence.Join(topic, m); ok {
+		s.publishPresence("join", topic, m, count)
+	}
+}
+
+// leave removes the connection from the members of the topic, if it was present.
+func (s *Service) leave(c *Conn, topic string) {
+	if m, count := s.presence.Leave(topic, c.guid); m != nil {
+		s.publishPresence("leave", topic, m, count)
+	}
+}
+
+// publishPresence publishes a presence event on the presence topic of the topic.
+func (s *Service) publishPresence(event, topic string, m *member, count int) {
+	payload, err := json.Marshal(presenceEvent{
+		Event:    event,
+		Topic:    topic,
+		ClientID: m.ClientID,
+		Username: m.Username,
+		Metadata: m.Metadata,
+		Count:    count,
+		Ts:       unixMillis(time.Now()),
+	})
+	if err != nil {
+		return
+	}
+
+	s.route(&Message{Topic: topic + presenceSuffix, Payload: payload})
+}
+
+// ------------------------------------------------------------------------------------
+
+// presenceInfo represents the members of a topic, as returned by the presence API.
+type presenceInfo struct {
+	Topic   string   `json:"topic"`
+	Count   int      `json:"count"`
+	Members []member `json:"members,omitempty"`
+}
+
+// Occurs when the presence is requested. With a topic, the members of the topic are
+// returned, otherwise the member counts of all of the topics.
+func (s *Service) onAPIPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		counts := s.presence.Counts()
+		infos := make([]presenceInfo, 0, len(counts))
+		for topic, count := range counts {
+			if s.acl.Allowed(username, topic, aclRead) {
+				infos = append(infos, presenceInfo{Topic: topic, Count: count})
+			}
+		}
+
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Topic < infos[j].Topic
+		})
+		writeJSON(w, http.StatusOK, infos)
+		return
+	}
+
+	if !validTopic(topic) {
+		writeError(w, http.StatusBadRequest, errInvalidTopic.Error())
+		return
+	}
+	if !s.acl.Allowed(username, topic, aclRead) {
+		writeError(w, http.StatusForbidden, errUnauthorized.Error())
+		return
+	}
+
+	members := s.presence.Members(topic)
+	writeJSON(w, http.StatusOK, presenceInfo{Topic: topic, Count: len(members), Members: members})
+}
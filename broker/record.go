@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media/record"
+	"github.com/spf13/viper"
+)
+
+// newRecorder creates the recorder of the live streams from the "record" section of the
+// configuration. The recordings may be configured per app, under "record.apps", and a
+// webhook notified of the finished files, at "record.on_finish".
+func newRecorder(cfg *viper.Viper) *record.Recorder {
+	opts := record.DefaultOptions()
+	cfg.SetDefault("record.enabled", opts.Enabled)
+	cfg.SetDefault("record.format", opts.Format)
+	cfg.SetDefault("record.directory", opts.Directory)
+	cfg.SetDefault("record.filename", opts.Filename)
+	cfg.SetDefault("record.split_duration", opts.SplitDuration)
+	cfg.SetDefault("record.split_size", opts.SplitSize)
+
+	opts = recordOptions(cfg, "record", opts)
+	apps := make(map[string]record.Options)
+	for app := range cfg.GetStringMap("record.apps") {
+		apps[app] = recordOptions(cfg, "record.apps."+app, opts)
+	}
+
+	onFinish := cfg.GetString("record.on_finish")
+	return record.NewRecorder(opts, apps, func(f record.File) {
+		if onFinish == "" {
+			return
+		}
+		go func() {
+			if err := postWebhook(onFinish, f); err != nil {
+				logging.Error("record: unable to notify the recording of", f.Path, err)
+			}
+		}()
+	})
+}
+
+// recordOptions reads the options of the recordings, the missing ones being inherited.
+func recordOptions(cfg *viper.Viper, prefix string, inherited record.Options) record.Options {
+	opts := inherited
+	if cfg.IsSet(prefix + ".enabled") {
+		opts.Enabled = cfg.GetBool(prefix + ".enabled")
+	}
+	if cfg.IsSet(prefix + ".format") {
+		opts.Format = cfg.GetString(prefix + ".format")
+	}
+	if cfg.IsSet(prefix + ".directory") {
+		opts.Directory = cfg.GetString(prefix + ".directory")
+	}
+	if cfg.IsSet(prefix + ".filename") {
+		opts.Filename = cfg.GetString(prefix + ".filename")
+	}
+	if cfg.IsSet(prefix + ".split_duration") {
+		opts.SplitDuration = cfg.GetDuration(prefix + ".split_duration")
+	}
+	if cfg.IsSet(prefix + ".split_size") {
+		opts.SplitSize = cfg.GetInt64(prefix + ".split_size")
+	}
+	return opts
+}
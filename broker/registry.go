@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry represents the set of live connections of the service.
+type registry struct {
+	sync.RWMutex
+	conns   map[string]*Conn // The connections by their unique id.
+	clients map[string]*Conn // The connected clients by their client id.
+}
+
+// newRegistry creates a new empty registry.
+func newRegistry() *registry {
+	return &registry{
+		conns:   make(map[string]*Conn),
+		clients: make(map[string]*Conn),
+	}
+}
+
+// Add tracks a newly accepted connection.
+func (r *registry) Add(c *Conn) {
+	r.Lock()
+	defer r.Unlock()
+	r.conns[c.guid] = c
+}
+
+// Bind associates a connection with its client id once connected and returns the
+// connection previously bound to the same client id, if any.
+func (r *registry) Bind(c *Conn, clientID string) (prev *Conn) {
+	r.Lock()
+	defer r.Unlock()
+
+	prev = r.clients[clientID]
+	r.clients[clientID] = c
+	return
+}
+
+// Remove stops tracking the connection and returns whether it was still bound to its
+// client id, which is not the case once taken over.
+func (r *registry) Remove(c *Conn) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.conns, c.guid)
+	if clientID := c.ClientID(); clientID != "" && r.clients[clientID] == c {
+		delete(r.clients, clientID)
+		return true
+	}
+	return false
+}
+
+// Get returns a connection by its client id, or by its unique id.
+func (r *registry) Get(id string) (*Conn, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if c, ok := r.clients[id]; ok {
+		return c, true
+	}
+	c, ok := r.conns[id]
+	return c, ok
+}
+
+// All returns all of the connections, ordered by their connection time.
+func (r *registry) All() []*Conn {
+	r.RLock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].connectedAt.Before(conns[j].connectedAt)
+	})
+	return conns
+}
+
+// Count returns the number of live connections.
+func (r *registry) Count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.conns)
+}
+
+// Clients returns the number of connections bound to a client id, which excludes the
+// connections not past their handshake yet and the ones taken over.
+func (r *registry) Clients() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.clients)
+}
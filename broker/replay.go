@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/spf13/viper"
+)
+
+// historyRule represents the history kept for the topics matching a pattern.
+type historyRule struct {
+	Pattern string        `mapstructure:"pattern"` // The topic filter the rule applies to.
+	Count   int           `mapstructure:"count"`   // The maximum number of messages per topic.
+	Bytes   int           `mapstructure:"bytes"`   // The maximum size of the payloads per topic.
+	Age     time.Duration `mapstructure:"age"`     // The maximum age of the messages.
+}
+
+// topicLog represents the history of a single topic, oldest first.
+type topicLog struct {
+	rule     *historyRule
+	messages []*Message
+	size     int
+}
+
+// topicHistory represents the opt-in history of the topics, so a subscriber joining
+// late can replay the last messages. Only the topics matching a configured pattern are
+// recorded, each in its own ring limited by count, bytes and age.
+type topicHistory struct {
+	sync.RWMutex
+	rules  []historyRule
+	topics map[string]*topicLog
+}
+
+// newTopicHistory creates the topic history from the "history" section of the
+// configuration.
+func newTopicHistory(cfg *viper.Viper) *topicHistory {
+	h := &topicHistory{topics: make(map[string]*topicLog)}
+	if err := cfg.UnmarshalKey("history.topics", &h.rules); err != nil {
+		logging.Error("invalid history rules", err)
+	}
+	return h
+}
+
+// rule returns the first rule matching the topic, if any.
+func (h *topicHistory) rule(topic string) *historyRule {
+	for i := range h.rules {
+		if matchTopic(h.rules[i].Pattern, topic) {
+			return &h.rules[i]
+		}
+	}
+	return nil
+}
+
+// Append records a message, if its topic has a history.
+func (h *topicHistory) Append(m *Message) {
+	if len(h.rules) == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	tl, ok := h.topics[m.Topic]
+	if !ok {
+		rule := h.rule(m.Topic)
+		if rule == nil {
+			return
+		}
+		tl = &topicLog{rule: rule}
+		h.topics[m.Topic] = tl
+	}
+
+	tl.messages = append(tl.messages, m)
+	tl.size += len(m.Payload)
+	tl.trim(m.Time)
+}
+
+// trim drops the oldest messages exceeding the limits of the rule.
+func (l *topicLog) trim(now time.Time) {
+	drop := 0
+	for drop < len(l.messages) {
+		m, rest := l.messages[drop], len(l.messages)-drop
+		if (l.rule.Count <= 0 || rest <= l.rule.Count) &&
+			(l.rule.Bytes <= 0 || l.size <= l.rule.Bytes) &&
+			(l.rule.Age <= 0 || now.Sub(m.Time) <= l.rule.Age) {
+			break
+		}
+		l.size -= len(m.Payload)
+		l.messages[drop] = nil
+		drop++
+	}
+	l.messages = l.messages[drop:]
+}
+
+// Has returns whether a topic has recorded messages.
+func (h *topicHistory) Has(topic string) bool {
+	h.RLock()
+	defer h.RUnlock()
+	tl, ok := h.topics[topic]
+	return ok && len(tl.messages) > 0
+}
+
+// Replay returns the recorded messages of the topics matching the filter, published
+// at or after the time or with a sequence at or after the given one, in their order
+// of publication.
+func (h *topicHistory) Replay(filter string, q replayQuery) []*Message {
+	h.RLock()
+	defer h.RUnlock()
+
+	now := time.Now()
+	var result []*Message
+	for topic, tl := range h.topics {
+		if !matchTopic(filter, topic) {
+			continue
+		}
+
+		for _, m := range tl.messages {
+			if tl.rule.Age > 0 && now.Sub(m.Time) > tl.rule.Age {
+				continue
+			}
+			if q.matches(m) {
+				result = append(result, m)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+// ------------------------------------------------------------------------------------
+
+// replayQuery represents a request to replay the history of the topics.
+type replayQuery struct {
+	Since time.Time // Replays the messages published at or after the time.
+	From  uint64    // Replays the messages with a sequence of their topic at or after this one.
+	Limit int       // Replays at most the last messages.
+}
+
+// matches returns whether the message is requested by the query.
+func (q *replayQuery) matches(m *Message) bool {
+	return !m.Time.Before(q.Since) && m.Seq >= q.From
+}
+
+// parseReplay parses the replay request of a subscriber, from the "since" timestamp,
+// either RFC 3339 or in unix milliseconds, the "from" sequence and the "limit" on the
+// number of messages. It returns false when no replay is requested.
+func parseReplay(since, from, limit string) (q replayQuery, ok bool, err error) {
+	if since != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			ms, perr := strconv.ParseInt(since, 10, 64)
+			if perr != nil {
+				return q, false, errInvalidReplay
+			}
+			q.Since, err = time.Unix(0, ms*int64(time.Millisecond)), nil
+		}
+		ok = true
+	}
+
+	if from != "" {
+		if q.From, err = strconv.ParseUint(from, 10, 64); err != nil {
+			return q, false, errInvalidReplay
+		}
+		ok = true
+	}
+
+	if limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return q, false, errInvalidReplay
+		}
+		ok = true
+	}
+	return
+}
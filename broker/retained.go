@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+)
+
+// retained represents the last retained message of every topic.
+type retained struct {
+	sync.RWMutex
+	messages map[string]*Message
+}
+
+// newRetained creates a new empty set of retained messages.
+func newRetained() *retained {
+	return &retained{messages: make(map[string]*Message)}
+}
+
+// Store retains the message for its topic, an empty payload clears the topic.
+func (r *retained) Store(m *Message) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(m.Payload) == 0 {
+		delete(r.messages, m.Topic)
+		return
+	}
+	r.messages[m.Topic] = m
+}
+
+// Match returns the retained messages whose topic matches the filter.
+func (r *retained) Match(filter string) []*Message {
+	r.RLock()
+	defer r.RUnlock()
+
+	var matched []*Message
+	for topic, m := range r.messages {
+		if matchTopic(filter, topic) {
+			matched = append(matched, m)
+		}
+	}
+	return matched
+}
+
+// Count returns the number of retained messages.
+func (r *retained) Count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.messages)
+}
+
+// matchTopic returns whether the topic matches the filter. Wildcards at the first
+// level do not match the topics starting with '$'.
+func matchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filters, levels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range filters {
+		switch {
+		case f == "#":
+			return true
+		case i >= len(levels):
+			return false
+		case f != "+" && f != levels[i]:
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
@@ -0,0 +1,247 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// gapTopicPrefix is the prefix of the topics the gap notices are sent on.
+const gapTopicPrefix = "$gap/"
+
+// sequencePruneInterval is the interval between two prunings of the sequences.
+const sequencePruneInterval = time.Minute
+
+// sequences represents the per-topic sequence numbers stamped on the routed messages,
+// so the subscribers can tell the messages they missed. The sequences restart along
+// with the broker, which the epoch tells. Within an epoch a sequence number is never
+// reused: the sequence of a topic pruned then published on again starts above all of
+// the pruned ones.
+type sequences struct {
+	sync.Mutex
+	epoch  int64
+	topics map[string]uint64
+	active map[string]bool       // The topics published on since the last pruning.
+	floor  uint64                // The highest sequence of the pruned topics.
+	locks  map[string]*topicLock // The locks of the topics being routed.
+}
+
+// topicLock represents the lock of a topic, held while one of its messages is numbered
+// and delivered.
+type topicLock struct {
+	sync.Mutex
+	refs int
+}
+
+// newSequences creates the sequences of a new epoch.
+func newSequences() *sequences {
+	return &sequences{
+		epoch:  time.Now().UnixNano() / int64(time.Millisecond),
+		topics: make(map[string]uint64),
+		active: make(map[string]bool),
+		locks:  make(map[string]*topicLock),
+	}
+}
+
+// LockTopic locks the topic until the returned function is called, so its messages are
+// numbered and delivered one at a time, in the order of their sequence.
+func (s *sequences) LockTopic(topic string) (unlock func()) {
+	s.Lock()
+	l, ok := s.locks[topic]
+	if !ok {
+		l = new(topicLock)
+		s.locks[topic] = l
+	}
+	l.refs++
+	s.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, topic)
+		}
+		s.Unlock()
+	}
+}
+
+// Next returns the next sequence number of the topic.
+func (s *sequences) Next(topic string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.topics[topic]; !ok {
+		s.topics[topic] = s.floor
+	}
+	s.topics[topic]++
+	s.active[topic] = true
+	return s.topics[topic]
+}
+
+// Observe follows a sequence number of the topic assigned by another node, so the
+// next ones assigned here follow it.
+func (s *sequences) Observe(topic string, seq uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if seq > s.topics[topic] {
+		s.topics[topic] = seq
+	}
+	s.active[topic] = true
+}
+
+// Prune forgets the sequences of the topics idle since the last pruning, unless kept.
+func (s *sequences) Prune(keep func(topic string) bool) int {
+	s.Lock()
+	idle := make([]string, 0, len(s.topics)-len(s.active))
+	for topic := range s.topics {
+		if !s.active[topic] {
+			idle = append(idle, topic)
+		}
+	}
+	s.active = make(map[string]bool)
+	s.Unlock()
+
+	pruned := 0
+	for _, topic := range idle {
+		if keep(topic) {
+			continue
+		}
+
+		s.Lock()
+		if !s.active[topic] {
+			if s.topics[topic] > s.floor {
+				s.floor = s.topics[topic]
+			}
+			delete(s.topics, topic)
+			pruned++
+		}
+		s.Unlock()
+	}
+	return pruned
+}
+
+// Current returns the last sequence number of the topic.
+func (s *sequences) Current(topic string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.topics[topic]
+}
+
+// pruneSequences periodically forgets the sequences of the idle topics which have
+// neither a history nor a subscriber, as nobody can tell a gap in them anymore.
+func (s *Service) pruneSequences(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.Closing:
+			return
+		case <-ticker.C:
+			s.sequences.Prune(func(topic string) bool {
+				return s.history.Has(topic) || len(s.subscriptions.Lookup(topic)) > 0
+			})
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// gapNotice represents the signal sent to a subscriber whose missed messages can not be
+// filled from the history.
+type gapNotice struct {
+	Topic    string `json:"topic"`
+	LastSeq  uint64 `json:"last_seq"`  // The last sequence seen by the subscriber.
+	FirstSeq uint64 `json:"first_seq"` // The first sequence held by the history, 0 if none.
+	Seq      uint64 `json:"seq"`       // The current sequence of the topic.
+	Epoch    int64  `json:"epoch"`
+}
+
+// message returns the notice as a message on the gap topic of its topic.
+func (n *gapNotice) message() *Message {
+	payload, _ := json.Marshal(n)
+	return &Message{Topic: gapTopicPrefix + n.Topic, Payload: payload, Time: time.Now().UTC()}
+}
+
+// fillGap returns the messages of the topic published after the last sequence seen by
+// a subscriber, or a gap notice when the history does not hold all of them. A last
+// sequence ahead of the topic was not assigned by this epoch, or its topic was pruned
+// since, so it is noticed as a gap as well.
+func (s *Service) fillGap(topic string, lastSeq uint64) ([]*Message, *gapNotice) {
+	current := s.sequences.Current(topic)
+	switch {
+	case lastSeq == current:
+		return nil, nil
+	case lastSeq > current:
+		return nil, &gapNotice{Topic: topic, LastSeq: lastSeq, Seq: current, Epoch: s.sequences.epoch}
+	}
+
+	missed := s.history.Replay(topic, replayQuery{})
+	i := 0
+	for i < len(missed) && missed[i].Seq <= lastSeq {
+		i++
+	}
+	missed = missed[i:]
+
+	if len(missed) == 0 || missed[0].Seq > lastSeq+1 {
+		notice := &gapNotice{Topic: topic, LastSeq: lastSeq, Seq: current, Epoch: s.sequences.epoch}
+		if len(missed) > 0 {
+			notice.FirstSeq = missed[0].Seq
+		}
+		return nil, notice
+	}
+	return missed, nil
+}
+
+// parseLastSeqs parses the last sequences seen by a subscriber, each either as
+// "<topic>:<seq>", or as a bare sequence for a filter without wildcards.
+func parseLastSeqs(values []string, filters []string) (map[string]uint64, error) {
+	seqs := make(map[string]uint64)
+	for _, v := range values {
+		topic, seq := "", v
+		if i := strings.LastIndexByte(v, ':'); i >= 0 {
+			topic, seq = v[:i], v[i+1:]
+		} else if len(filters) == 1 && !strings.ContainsAny(filters[0], "+#") {
+			topic = filters[0]
+		}
+
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil || !validTopic(topic) {
+			return nil, errInvalidReplay
+		}
+		seqs[topic] = n
+	}
+	return seqs, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// envelope represents a message wrapped along with its sequence and timestamp, for the
+// clients which have no other way to receive them.
+type envelope struct {
+	Seq      uint64 `json:"seq"`
+	Ts       int64  `json:"ts"`
+	Epoch    int64  `json:"epoch"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// wrap returns the payload of the message wrapped in a JSON envelope, the binary
+// payloads are base64 encoded.
+func (s *Service) wrap(m *Message) []byte {
+	env := envelope{Seq: m.Seq, Ts: unixMillis(m.Time), Epoch: s.sequences.epoch, Payload: string(m.Payload)}
+	if !utf8.Valid(m.Payload) {
+		env.Payload, env.Encoding = base64.StdEncoding.EncodeToString(m.Payload), "base64"
+	}
+
+	payload, _ := json.Marshal(env)
+	return payload
+}
+
+// unixMillis returns the time in milliseconds since the unix epoch.
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
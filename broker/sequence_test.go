@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSequencesNotReusedOncePruned(t *testing.T) {
+	s := newSequences()
+	for i := 0; i < 57; i++ {
+		s.Next("a")
+	}
+	s.Next("b")
+
+	// Prune both topics, idle since the first pruning
+	s.Prune(func(string) bool { return false })
+	if n := s.Prune(func(string) bool { return false }); n != 2 {
+		t.Fatalf("pruned %d topics", n)
+	}
+	if seq := s.Next("a"); seq != 58 {
+		t.Fatalf("sequence restarted at %d once pruned", seq)
+	}
+	if seq := s.Next("c"); seq != 58 {
+		t.Fatalf("new topic started at %d", seq)
+	}
+}
+
+func TestFillGapAhead(t *testing.T) {
+	s := newTestService(t, viper.New())
+	s.publish(&Message{Topic: "a", Payload: []byte("1")})
+
+	if missed, notice := s.fillGap("a", 1); missed != nil || notice != nil {
+		t.Fatalf("gap reported when up to date: %v, %+v", missed, notice)
+	}
+	missed, notice := s.fillGap("a", 57)
+	if missed != nil || notice == nil || notice.LastSeq != 57 || notice.Seq != 1 {
+		t.Fatalf("no gap reported for a sequence ahead: %v, %+v", missed, notice)
+	}
+}
+
+func TestRouteInSequenceOrder(t *testing.T) {
+	s := newTestService(t, viper.New())
+	const publishers, messages = 8, 200
+	received := make(inbox, publishers*messages)
+	s.subscriptions.Subscribe("a", received, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				s.publish(&Message{Topic: "a"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for seq := uint64(1); seq <= publishers*messages; seq++ {
+		if m := received.receive(t); m.Seq != seq {
+			t.Fatalf("received sequence %d, expected %d", m.Seq, seq)
+		}
+	}
+}
@@ -1,39 +1,162 @@
 package broker
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/dash"
+	"github.com/numb3r3/live-go/media/hls"
+	"github.com/numb3r3/live-go/media/record"
 	"github.com/numb3r3/live-go/network/listener"
+	"github.com/numb3r3/live-go/network/longpoll"
+	"github.com/numb3r3/live-go/network/rtmp"
 	"github.com/numb3r3/live-go/network/websocket"
 	"github.com/spf13/viper"
 )
 
 // Service represents the main structure.
 type Service struct {
-	Closing     chan bool    // The channel for closing signal.
-	Config      *viper.Viper // The configuration for the service.
-	http        *http.Server // The underlying HTTP server.
-	startTime   time.Time    // The start time of the service.
-	connections int64        // The number of currently open connections.
+	Closing       chan bool             // The channel for closing signal.
+	Config        *viper.Viper          // The configuration for the service.
+	http          *http.Server          // The underlying HTTP server.
+	startTime     time.Time             // The start time of the service.
+	draining      uint32                // Whether the service is shutting down.
+	closeOnce     sync.Once             // Ensures the service is closed only once.
+	components    components            // The registered components which report their health.
+	conns         *registry             // The currently open connections.
+	subscriptions *subscriptions        // The subscriptions of the connections.
+	retained      *retained             // The retained messages, cached from the store.
+	store         Store                 // The storage of the state which outlives the connections.
+	queuing       sync.Mutex            // Serializes the bounded queuing of the offline messages.
+	auth          Authenticator         // The authenticator of the clients.
+	acl           *acl                  // The access control list of the topics.
+	stats         stats                 // The message counters.
+	events        *history              // The last routed messages, for resuming the event streams.
+	history       *topicHistory         // The opt-in history of the topics, for replaying.
+	sequences     *sequences            // The sequence numbers of the topics.
+	envelope      bool                  // Whether the messages are wrapped for the clients without properties.
+	presence      *presence             // The members of the presence-enabled topics.
+	cluster       *clusterNode          // The cluster this node belongs to, nil if standalone.
+	bridges       []*bridge             // The bridges to the remote brokers.
+	hooks         hooks                 // The hooks run along the lifecycle of the clients.
+	streams       *media.StreamRegistry // The live media streams, by their key.
+	rtmp          *rtmp.Server          // The RTMP server ingesting the live streams.
+	hls           *hls.Server           // The HLS output of the live streams, nil if disabled.
+	dash          *dash.Server          // The DASH output of the live streams, nil if disabled.
+	recorder      *record.Recorder      // The recording of the live streams to files.
+	lastID        uint64                // The identifier of the last routed message.
+	longpoll      *longpoll.Server      // The long-polling transport.
 }
 
+// Errors reported by the service.
+var (
+	errListenerStopped = errors.New("listener stopped")
+	errUnauthorized    = errors.New("not authorized")
+	errInvalidTopic    = errors.New("invalid topic")
+	errInvalidBody     = errors.New("invalid request body")
+	errInvalidReplay   = errors.New("invalid replay request")
+)
+
 // NewService creates a new service.
 func NewService(cfg *viper.Viper) (s *Service, err error) {
 	s = &Service{
-		Closing: make(chan bool),
-		Config:  cfg,
-		http:    new(http.Server),
+		Closing:       make(chan bool),
+		Config:        cfg,
+		http:          new(http.Server),
+		components:    components{list: make(map[string]component)},
+		conns:         newRegistry(),
+		subscriptions: newSubscriptions(),
+		retained:      newRetained(),
+		auth:          newStaticAuth(cfg),
+		acl:           newACL(cfg),
+		history:       newTopicHistory(cfg),
+		sequences:     newSequences(),
+		envelope:      cfg.GetBool("sequence.envelope"),
+		presence:      newPresence(cfg),
+	}
+
+	// Register the built-in hooks, before any client can connect
+	if err = s.addConfiguredHooks(cfg); err != nil {
+		return nil, err
+	}
+
+	// Open the store and restore the state it holds
+	if s.store, err = newStore(cfg); err != nil {
+		return nil, err
+	}
+	if err = s.restoreRetained(); err != nil {
+		return nil, err
+	}
+	if err = s.restoreSessions(); err != nil {
+		return nil, err
+	}
+	s.AddComponent("store", true, s.store.Check)
+
+	// Join the cluster, if any
+	if s.cluster = newClusterNode(cfg, s); s.cluster != nil {
+		if err = s.cluster.join(); err != nil {
+			return nil, err
+		}
 	}
 
+	// Bridge the topics to and from the remote brokers
+	if s.bridges, err = newBridges(cfg, s); err != nil {
+		return nil, err
+	}
+	for _, b := range s.bridges {
+		b.start()
+	}
+
+	cfg.SetDefault("session.expiry", defaultSessionExpiry)
+	cfg.SetDefault("session.expiry_interval", "1m")
+	cfg.SetDefault("rtmp.listen_addr", ":1935")
+	cfg.SetDefault("streams.queue_size", playerQueueSize)
+	cfg.SetDefault("sse.history_size", sseHistorySize)
+	s.events = newHistory(cfg.GetInt("sse.history_size"))
+
+	// Create the registry of the live streams, fed by the RTMP broadcasters
+	s.streams = newStreamRegistry(cfg)
+	s.rtmp = rtmp.NewServer(rtmp.HandlerFunc(s.onRTMPPublish))
+	s.hls = newHLS(cfg)
+	s.dash = newDASH(cfg)
+	s.recorder = newRecorder(cfg)
+
+	// Create the long-polling transport for the clients unable to use websocket
+	cfg.SetDefault("longpoll.poll_timeout", longpoll.DefaultPollTimeout)
+	cfg.SetDefault("longpoll.idle_timeout", longpoll.DefaultIdleTimeout)
+	s.longpoll = longpoll.NewServer(s.onAcceptConn,
+		cfg.GetDuration("longpoll.poll_timeout"),
+		cfg.GetDuration("longpoll.idle_timeout"))
+
 	// Create a new HTTP request multiplexer
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.onHealth)
+	mux.HandleFunc("/ready", s.onReady)
+	mux.HandleFunc("/admin/api/", s.onAdmin)
+	mux.HandleFunc("/api/publish", s.onAPIPublish)
+	mux.HandleFunc("/api/publish/batch", s.onAPIPublishBatch)
+	mux.HandleFunc("/api/history", s.onAPIHistory)
+	mux.HandleFunc("/api/presence", s.onAPIPresence)
+	mux.HandleFunc("/sse", s.onSSE)
+	mux.Handle("/lp/", s.longpoll)
+	mux.HandleFunc("/live/", s.onHTTPFLV)
+	mux.HandleFunc("/ws/live/", s.onWSFLV)
+	if s.hls != nil {
+		mux.Handle("/hls/", s.authorizeSegments("/hls/", ".m3u8", s.hls))
+	}
+	if s.dash != nil {
+		mux.Handle("/dash/", s.authorizeSegments("/dash/", ".mpd", s.dash))
+	}
 	mux.HandleFunc("/", s.onRequest)
 
 	// Attach handlers
@@ -47,19 +170,33 @@ func (s *Service) Listen() (err error) {
 	defer s.Close()
 	s.hookSignals()
 
+	// Set the start time before serving, so the readiness check can see it
+	s.startTime = time.Now().UTC()
+
 	// Setup the listeners on both default and a secure addresses
-	s.listen(s.Config.GetString("listen_addr"))
+	s.listen(s.Config.GetString("listen_addr"), s.http.Serve)
 
-	// Set the start time and report status
-	s.startTime = time.Now().UTC()
+	// Ingest the live streams over RTMP, unless disabled with an empty address
+	if address := s.Config.GetString("rtmp.listen_addr"); address != "" {
+		s.listen(address, s.rtmp.Serve)
+	}
 	logging.Info("live-go service started")
 
+	// Publish the broker statistics
+	go s.publishSysStats(s.Config.GetDuration("sys_interval"))
+
+	// Forget the sequences of the topics nobody follows
+	go s.pruneSequences(sequencePruneInterval)
+
+	// Expire the persistent sessions left behind by their clients
+	go s.expireSessions(s.Config.GetDuration("session.expiry"), s.Config.GetDuration("session.expiry_interval"))
+
 	// Block
 	select {}
 }
 
-// listen configures an main listener on a specified address.
-func (s *Service) listen(address string) {
+// listen configures a listener on a specified address, served by a server.
+func (s *Service) listen(address string, serve func(net.Listener) error) {
 	logging.Info("starting the listener", address)
 
 	l, err := listener.NewListener(address)
@@ -70,10 +207,23 @@ func (s *Service) listen(address string) {
 	// Set the read timeout on our mux listener
 	l.SetReadTimeout(120 * time.Second)
 
-	l.ServeAsync(s.http.Serve)
+	l.ServeAsync(serve)
+
+	// Report the listener as down once it stops serving
+	var serving uint32 = 1
+	s.AddComponent("listener "+address, true, func() error {
+		if atomic.LoadUint32(&serving) == 0 {
+			return errListenerStopped
+		}
+		return nil
+	})
 
 	// l.ServeAsync(listener.MatchAny(), s.tcp.Serve)
-	go l.Serve()
+	go func() {
+		err := l.Serve()
+		atomic.StoreUint32(&serving, 0)
+		logging.Error("listener stopped", address, err)
+	}()
 }
 
 // Occurs when a new client connection is accepted.
@@ -82,19 +232,156 @@ func (s *Service) onAcceptConn(t net.Conn) {
 	go conn.Process()
 }
 
+// onPublish publishes a message on behalf of a user, once authorized by the access
+// control list and passed through the hooks. The clients are never allowed to publish
+// on the reserved topics. The connection is nil for the messages published over HTTP.
+func (s *Service) onPublish(c *Conn, username string, m *Message) (int, error) {
+	if reservedTopic(m.Topic) || !s.acl.Allowed(username, m.Topic, aclWrite) {
+		return 0, errUnauthorized
+	}
+
+	// A hook may replace the message, which must then be as allowed as the original
+	m, err := s.hooks.onPublish(c, m)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	if !validTopic(m.Topic) || reservedTopic(m.Topic) || !s.acl.Allowed(username, m.Topic, aclWrite) {
+		return 0, errUnauthorized
+	}
+	return s.publish(m), nil
+}
+
+// reservedTopic returns whether a topic is published by the broker only, as the '$'
+// topics and the presence events of the topics.
+func reservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, "$") || strings.HasSuffix(topic, presenceSuffix)
+}
+
+// publish publishes a message to the broker and returns the number of subscribers it
+// was sent to.
+func (s *Service) publish(m *Message) int {
+	s.stats.onReceived(m)
+	return s.route(m)
+}
+
+// route routes the message to all of the matching subscribers and returns the number
+// of subscribers it was sent to.
+func (s *Service) route(m *Message) int {
+	// The messages of a topic are numbered and delivered one at a time, so they are
+	// received in the order of their sequence
+	if !reservedTopic(m.Topic) {
+		defer s.sequences.LockTopic(m.Topic)()
+	}
+
+	m.ID = atomic.AddUint64(&s.lastID, 1)
+	switch {
+	case reservedTopic(m.Topic):
+	case m.Origin != "" && m.Seq > 0:
+		// The forwarded messages keep the sequence of their origin, the same on all nodes
+		s.sequences.Observe(m.Topic, m.Seq)
+	default:
+		m.Seq = s.sequences.Next(m.Topic)
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+	s.events.Append(m)
+	s.history.Append(m)
+	if m.Retain {
+		s.retained.Store(m)
+		if persistentTopic(m.Topic) {
+			if err := s.store.PutRetained(m); err != nil {
+				logging.Error("unable to store the retained message on", m.Topic, err)
+			}
+		}
+	}
+
+	// The retain flag is only kept for the messages sent on subscription and bridged
+	live := *m
+	live.Retain = false
+
+	subs := s.subscriptions.Lookup(m.Topic)
+	if s.cluster != nil {
+		s.cluster.forward(m, subs)
+	}
+	for _, sub := range subs {
+		if _, ok := sub.subscriber.(remote); ok {
+			continue
+		}
+
+		msg := &live
+		if _, ok := sub.subscriber.(*bridge); ok {
+			// The bridges mirror the retain flag on the remote broker
+			msg = m
+		}
+		if sub.qos < msg.QoS {
+			downgraded := *msg
+			downgraded.QoS = sub.qos
+			msg = &downgraded
+		}
+
+		if err := sub.subscriber.Send(msg); err != nil {
+			logging.Info("unable to send to", sub.subscriber.ID(), err)
+			continue
+		}
+		s.delivered(sub.subscriber, msg)
+	}
+	return len(subs)
+}
+
+// delivered accounts for a message sent to a subscriber.
+func (s *Service) delivered(sub Subscriber, m *Message) {
+	s.stats.onSent(m)
+	s.hooks.onDelivered(sub, m)
+}
+
+// sendRetained sends the retained messages matching the topic filter to a new subscriber.
+func (s *Service) sendRetained(filter string, sub Subscriber, qos uint8) {
+	for _, m := range s.retained.Match(filter) {
+		msg := *m
+		if qos < msg.QoS {
+			msg.QoS = qos
+		}
+		if sub.Send(&msg) == nil {
+			s.delivered(sub, &msg)
+		}
+	}
+}
+
+// sendHistory replays the history of the topics matching the filter to a new subscriber,
+// in place of the retained messages.
+func (s *Service) sendHistory(filter string, sub Subscriber, qos uint8, q replayQuery) {
+	for _, m := range s.history.Replay(filter, q) {
+		msg := *m
+		if qos < msg.QoS {
+			msg.QoS = qos
+		}
+		if sub.Send(&msg) == nil {
+			s.delivered(sub, &msg)
+		}
+	}
+}
+
 // Occurs when a new HTTP request is received.
 func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
+	// The clients unable to upgrade, typically behind a proxy, may fall back to the
+	// event stream
+	if !websocket.IsUpgrade(r) {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			s.onSSE(w, r)
+			return
+		}
+
+		http.Error(w, "websocket upgrade required, use /sse for an event stream", http.StatusUpgradeRequired)
+		return
+	}
+
 	if ws, ok := websocket.TryUpgrade(w, r); ok {
 		s.onAcceptConn(ws)
 		return
 	}
 }
 
-// Occurs when a new HTTP health check is received.
-func (s *Service) onHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(200)
-}
-
 // OnSignal will be called when a OS-level signal is received.
 func (s *Service) onSignal(sig os.Signal) {
 	switch sig {
@@ -120,7 +407,28 @@ func (s *Service) hookSignals() {
 
 // Close closes gracefully the service.,
 func (s *Service) Close() {
+	s.closeOnce.Do(func() {
+		// Mark as draining so the health checks start failing
+		atomic.StoreUint32(&s.draining, 1)
+		s.longpoll.Close()
+		s.rtmp.Close()
+		s.recorder.Close()
+		if s.cluster != nil {
+			s.cluster.peers.Close()
+		}
+		for _, b := range s.bridges {
+			b.close()
+		}
+
+		// Take the persistent sessions offline before the store is closed
+		for _, c := range s.conns.All() {
+			c.Close()
+		}
+		if err := s.store.Close(); err != nil {
+			logging.Error("unable to close the store", err)
+		}
 
-	// Notify we're closed
-	close(s.Closing)
+		// Notify we're closed
+		close(s.Closing)
+	})
 }
@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// errQueueFull is returned when the offline queue of a session is full.
+var errQueueFull = errors.New("offline queue full")
+
+// The default number of messages queued for an offline session.
+const defaultMaxQueued = 1000
+
+// The default time a persistent session is kept without its client connecting. A zero
+// expiry keeps the sessions forever.
+const defaultSessionExpiry = 7 * 24 * time.Hour
+
+// The default number of messages sent to a client and not acknowledged yet.
+const defaultMaxInflight = 100
+
+// offlineSubscriber represents the subscriptions of a persistent session while its
+// client is disconnected, queuing the messages in the store until it reconnects.
+type offlineSubscriber struct {
+	clientID string
+	service  *Service
+}
+
+// ID returns the unique identifier of the subscriber.
+func (s *offlineSubscriber) ID() string {
+	return "offline/" + s.clientID
+}
+
+// Send queues a message for the session. Only the messages with a QoS above 0 are
+// queued, as the others may be dropped. The queue is bounded by the messages held in
+// the store, so the bound holds across the reconnections and the restarts.
+func (s *offlineSubscriber) Send(m *Message) error {
+	if m.QoS == 0 {
+		return nil
+	}
+
+	s.service.queuing.Lock()
+	defer s.service.queuing.Unlock()
+	queued, err := s.service.store.Queued(s.clientID)
+	if err != nil {
+		return err
+	}
+	if queued >= s.service.maxQueued() {
+		return errQueueFull
+	}
+	return s.service.store.Enqueue(s.clientID, m)
+}
+
+// ------------------------------------------------------------------------------------
+
+// restoreSessions subscribes the stored sessions on behalf of their offline clients.
+func (s *Service) restoreSessions() error {
+	sessions, err := s.store.Sessions()
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		s.goOffline(session.ClientID, session.Subscriptions)
+	}
+	logging.Info("restored", len(sessions), "persistent sessions")
+	return nil
+}
+
+// restoreRetained loads the retained messages from the store.
+func (s *Service) restoreRetained() error {
+	messages, err := s.store.Retained()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		s.retained.Store(m)
+	}
+	return nil
+}
+
+// goOffline hands the subscriptions of a disconnected persistent session over to an
+// offline subscriber.
+func (s *Service) goOffline(clientID string, subs map[string]uint8) {
+	offline := &offlineSubscriber{clientID: clientID, service: s}
+	for filter, qos := range subs {
+		s.subscriptions.Subscribe(filter, offline, qos)
+	}
+}
+
+// goOnline removes the offline subscriber of a session, once its client reconnected or
+// the session expired.
+func (s *Service) goOnline(clientID string, subs map[string]uint8) {
+	offline := &offlineSubscriber{clientID: clientID, service: s}
+	for filter := range subs {
+		s.subscriptions.Unsubscribe(filter, offline)
+	}
+}
+
+// saveSession persists the session of a connection.
+func (s *Service) saveSession(c *Conn) {
+	session := &Session{
+		ClientID:      c.ClientID(),
+		Username:      c.Username(),
+		Subscriptions: c.Subscriptions(),
+		LastSeen:      time.Now().UTC(),
+	}
+
+	if err := s.store.PutSession(session); err != nil {
+		logging.Error("unable to save the session of", session.ClientID, err)
+	}
+}
+
+// maxQueued returns the configured number of messages queued for an offline session.
+func (s *Service) maxQueued() int {
+	if n := s.Config.GetInt("session.max_queued"); n > 0 {
+		return n
+	}
+	return defaultMaxQueued
+}
+
+// maxInflight returns the configured number of messages sent to a client and not
+// acknowledged yet, which the receive maximum of an MQTT 5 client may lower.
+func (s *Service) maxInflight() int {
+	if n := s.Config.GetInt("session.max_inflight"); n > 0 {
+		return n
+	}
+	return defaultMaxInflight
+}
+
+// expireSessions periodically deletes the persistent sessions whose clients have not
+// been seen for longer than the expiry, along with their offline queues.
+func (s *Service) expireSessions(expiry, interval time.Duration) {
+	if expiry <= 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.Closing:
+			return
+		case <-ticker.C:
+			sessions, err := s.store.Sessions()
+			if err != nil {
+				logging.Error("unable to list the sessions", err)
+				continue
+			}
+
+			for _, session := range sessions {
+				if _, online := s.conns.Get(session.ClientID); online || time.Since(session.LastSeen) < expiry {
+					continue
+				}
+
+				s.goOnline(session.ClientID, session.Subscriptions)
+				if err := s.store.DeleteSession(session.ClientID); err != nil {
+					logging.Error("unable to expire the session of", session.ClientID, err)
+					continue
+				}
+				logging.Info("session of", session.ClientID, "expired")
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestOfflineQueueBound(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("session.max_queued", 2)
+	s := newTestService(t, cfg)
+
+	// The bound holds for the subscribers created again on every disconnection
+	for i := 0; i < 3; i++ {
+		offline := &offlineSubscriber{clientID: "a", service: s}
+		err := offline.Send(&Message{Topic: "t", QoS: 1})
+		if i < 2 && err != nil {
+			t.Fatalf("message %d not queued: %v", i, err)
+		}
+		if i == 2 && err != errQueueFull {
+			t.Fatalf("message %d queued beyond the bound: %v", i, err)
+		}
+	}
+
+	if _, err := s.store.Dequeue("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&offlineSubscriber{clientID: "a", service: s}).Send(&Message{Topic: "t", QoS: 1}); err != nil {
+		t.Fatalf("message not queued once dequeued: %v", err)
+	}
+}
+
+func TestStoreSyncPolicy(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("data_dir", t.TempDir())
+	cfg.Set("store.type", "wal")
+	cfg.Set("store.sync", "sometimes")
+	if _, err := newStore(cfg); err == nil {
+		t.Fatal("unknown sync policy accepted")
+	}
+
+	cfg.Set("store.sync", "always")
+	store, err := newStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+}
+
+func TestStoreQueuedCount(t *testing.T) {
+	for _, kind := range []string{"memory", "wal", "bolt"} {
+		cfg := viper.New()
+		cfg.Set("data_dir", t.TempDir())
+		cfg.Set("store.type", kind)
+		store, err := newStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			store.Enqueue("a", &Message{Topic: "t"})
+			if n, _ := store.Queued("a"); n != i+1 {
+				t.Fatalf("%s: %d messages queued after %d", kind, n, i+1)
+			}
+		}
+		store.Enqueue("b", &Message{Topic: "t"})
+		if messages, _ := store.Dequeue("a"); len(messages) != 3 {
+			t.Fatalf("%s: dequeued %d messages", kind, len(messages))
+		}
+		if n, _ := store.Queued("a"); n != 0 {
+			t.Fatalf("%s: %d messages queued once dequeued", kind, n)
+		}
+		if n, _ := store.Queued("b"); n != 1 {
+			t.Fatalf("%s: %d messages queued for b", kind, n)
+		}
+		store.Close()
+	}
+}
+
+func TestTakeoverReplyNotBlocking(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("cluster.takeover_timeout", "1m")
+	n := &clusterNode{
+		service: newTestService(t, cfg),
+		pending: map[uint64]chan *sessionTransfer{1: make(chan *sessionTransfer)},
+	}
+	if timeout := n.takeoverTimeout(); timeout != maxTakeoverTimeout {
+		t.Fatalf("takeover timeout %v not capped", timeout)
+	}
+
+	// A reply nobody waits for anymore is dropped
+	done := make(chan struct{})
+	go func() {
+		n.onSession("b", []byte(`{"id":1}`))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reading of the peer blocked by the reply")
+	}
+}
+
+func TestBoltBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.PutSession(&Session{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if _, err := store.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "backup-*")); len(files) != 0 {
+		t.Fatalf("snapshots left behind: %v", files)
+	}
+
+	restored := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(restored, filepath.Base(store.db.Path())), backup.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := openBoltStore(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if session, err := snapshot.GetSession("a"); err != nil || session == nil {
+		t.Fatalf("session not backed up: %v", err)
+	}
+}
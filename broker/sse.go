@@ -0,0 +1,355 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/pborman/uuid"
+)
+
+// errSlowConsumer is returned when an event stream can not keep up with its messages.
+var errSlowConsumer = errors.New("slow consumer")
+
+// Defaults of the event streams.
+const (
+	sseQueueSize   = 256              // The number of messages queued for a stream.
+	sseRetry       = 3000             // The reconnection delay advised to the clients, in milliseconds.
+	sseHeartbeat   = 15 * time.Second // The default interval of the heartbeat comments.
+	sseHistorySize = 1024             // The default number of messages kept for resuming.
+)
+
+// history represents a ring buffer of the last routed messages, used for resuming the
+// event streams from their last event id.
+type history struct {
+	sync.RWMutex
+	messages []*Message
+	next     int
+	full     bool
+}
+
+// newHistory creates a new ring buffer of the given size.
+func newHistory(size int) *history {
+	return &history{messages: make([]*Message, size)}
+}
+
+// Append records a message.
+func (h *history) Append(m *Message) {
+	if len(h.messages) == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.messages[h.next] = m
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Since returns the recorded messages with an id greater than the given one, matching
+// any of the topic filters, in their order of publication.
+func (h *history) Since(id uint64, filters []string) []*Message {
+	h.RLock()
+	defer h.RUnlock()
+
+	var ordered []*Message
+	if h.full {
+		ordered = append(ordered, h.messages[h.next:]...)
+	}
+	ordered = append(ordered, h.messages[:h.next]...)
+
+	var result []*Message
+	for _, m := range ordered {
+		if m.ID > id && matchAny(filters, m.Topic) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// matchAny returns whether the topic matches any of the filters.
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if matchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------------------
+
+// sseSubscriber represents an event stream subscribed to a set of topic filters.
+type sseSubscriber struct {
+	id       string
+	messages chan *Message
+	overflow uint32
+}
+
+// ID returns the unique identifier of the subscriber.
+func (s *sseSubscriber) ID() string {
+	return s.id
+}
+
+// Send queues a message for the stream. A stream that falls behind is terminated, the
+// client resumes from its last event id once reconnected.
+func (s *sseSubscriber) Send(m *Message) error {
+	select {
+	case s.messages <- m:
+		return nil
+	default:
+		atomic.StoreUint32(&s.overflow, 1)
+		return errSlowConsumer
+	}
+}
+
+// sseEvent represents the data of a message event.
+type sseEvent struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding,omitempty"`
+	Retain   bool   `json:"retain,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Ts       int64  `json:"ts,omitempty"`
+}
+
+// writeEvent writes a message as an event, the binary payloads are base64 encoded.
+func writeEvent(w http.ResponseWriter, m *Message) error {
+	event := sseEvent{Topic: m.Topic, Payload: string(m.Payload), Retain: m.Retain, Seq: m.Seq}
+	if !m.Time.IsZero() {
+		event.Ts = unixMillis(m.Time)
+	}
+	if !utf8.Valid(m.Payload) {
+		event.Payload, event.Encoding = base64.StdEncoding.EncodeToString(m.Payload), "base64"
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if m.ID > 0 {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.ID, data)
+	} else {
+		_, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+	}
+	return err
+}
+
+// writeGap writes a gap notice as an event.
+func writeGap(w http.ResponseWriter, notice *gapNotice) error {
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: gap\ndata: %s\n\n", data)
+	return err
+}
+
+// Occurs when a new event stream is requested. The stream sends the messages matching
+// the topic filters, and resumes after the Last-Event-ID when provided. The credentials
+// are taken from the basic authentication, or else from the username and password query
+// parameters for the browsers, which then end up in the access logs of the proxies and
+// in the browser history.
+func (s *Service) onSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	// The browsers can not set headers on an EventSource, so the credentials may also
+	// be passed as query parameters
+	query := r.URL.Query()
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		username, password = query.Get("username"), query.Get("password")
+	}
+	if !s.auth.Authenticate(username, password) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	filters := query["topic"]
+	if len(filters) == 0 {
+		writeError(w, http.StatusBadRequest, "missing topic")
+		return
+	}
+	for _, filter := range filters {
+		if !validFilter(filter) {
+			writeError(w, http.StatusBadRequest, "invalid topic filter")
+			return
+		}
+		if !s.acl.Allowed(username, filter, aclRead) {
+			writeError(w, http.StatusForbidden, errUnauthorized.Error())
+			return
+		}
+	}
+
+	lastID, resume := uint64(0), false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if id, err := strconv.ParseUint(v, 10, 64); err == nil {
+			lastID, resume = id, true
+		}
+	}
+
+	// A fresh stream may request the history of the topics instead of the retained messages
+	replay, replaying, err := parseReplay(query.Get("since"), query.Get("from"), query.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Or tell the last sequences it has seen, to get the gaps filled
+	lastSeqs, err := parseLastSeqs(query["last_seq"], filters)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Subscribe before replaying, so no message is missed in between
+	sub := &sseSubscriber{id: uuid.NewRandom().String(), messages: make(chan *Message, sseQueueSize)}
+	for _, filter := range filters {
+		s.subscriptions.Subscribe(filter, sub, 0)
+	}
+	defer func() {
+		for _, filter := range filters {
+			s.subscriptions.Unsubscribe(filter, sub)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+
+	// Replay the missed messages, the requested history, or send the retained ones on
+	// a fresh stream, remembering the messages replayed so they are not sent twice
+	replayed := make(map[uint64]bool)
+	switch {
+	case len(lastSeqs) > 0:
+		var missed []*Message
+		for topic, lastSeq := range lastSeqs {
+			if !matchAny(filters, topic) {
+				continue
+			}
+
+			messages, notice := s.fillGap(topic, lastSeq)
+			if notice != nil {
+				if err := writeGap(w, notice); err != nil {
+					return
+				}
+			}
+			missed = append(missed, messages...)
+		}
+
+		sort.Slice(missed, func(i, j int) bool {
+			return missed[i].ID < missed[j].ID
+		})
+		for _, m := range missed {
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			replayed[m.ID] = true
+		}
+	case resume:
+		for _, m := range s.events.Since(lastID, filters) {
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			replayed[m.ID] = true
+		}
+	case replaying:
+		for _, m := range s.replayAll(filters, replay) {
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			replayed[m.ID] = true
+		}
+	default:
+		for _, filter := range filters {
+			for _, m := range s.retained.Match(filter) {
+				if err := writeEvent(w, m); err != nil {
+					return
+				}
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.sseHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.Closing:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case m := <-sub.messages:
+			// Skip the messages already replayed from the history
+			if replayed[m.ID] {
+				delete(replayed, m.ID)
+				continue
+			}
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			if atomic.LoadUint32(&sub.overflow) == 1 && len(sub.messages) == 0 {
+				logging.Info("event stream", sub.id, "terminated:", errSlowConsumer)
+				return
+			}
+		}
+	}
+}
+
+// replayAll returns the history of the topics matching any of the filters, each message
+// once and in their order of publication.
+func (s *Service) replayAll(filters []string, q replayQuery) []*Message {
+	seen := make(map[uint64]bool)
+	var result []*Message
+	for _, filter := range filters {
+		for _, m := range s.history.Replay(filter, q) {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				result = append(result, m)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+// sseHeartbeat returns the configured interval of the heartbeat comments.
+func (s *Service) sseHeartbeat() time.Duration {
+	if d := s.Config.GetDuration("sse.heartbeat"); d > 0 {
+		return d
+	}
+	return sseHeartbeat
+}
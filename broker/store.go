@@ -0,0 +1,339 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/numb3r3/live-go/storage/wal"
+	"github.com/spf13/viper"
+)
+
+// Store represents the storage of the state which outlives the connections: the
+// retained messages, the persistent sessions and their offline queues.
+type Store interface {
+	PutRetained(m *Message) error                 // Retains a message, an empty payload clears the topic.
+	Retained() ([]*Message, error)                // Returns all of the retained messages.
+	PutSession(s *Session) error                  // Saves a session.
+	GetSession(clientID string) (*Session, error) // Returns a session, nil if there is none.
+	DeleteSession(clientID string) error          // Deletes a session along with its offline queue.
+	Sessions() ([]*Session, error)                // Returns all of the sessions.
+	Enqueue(clientID string, m *Message) error    // Queues a message for an offline client.
+	Dequeue(clientID string) ([]*Message, error)  // Removes and returns the queued messages of a client.
+	Queued(clientID string) (int, error)          // Returns the number of messages queued for a client.
+	Check() error                                 // Returns an error when the store is unable to persist.
+	Close() error                                 // Closes the store.
+}
+
+// backuper is implemented by the stores able to write a consistent snapshot of their
+// state while serving.
+type backuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// Session represents the persistent session of a client.
+type Session struct {
+	ClientID      string           `json:"client_id"`
+	Username      string           `json:"username"`
+	Subscriptions map[string]uint8 `json:"subscriptions"`
+	LastSeen      time.Time        `json:"last_seen"`
+}
+
+// Buckets of the stores
+const (
+	bucketRetained = "retained"
+	bucketSessions = "sessions"
+	bucketQueue    = "queue/"
+)
+
+// newStore creates the store from the "store" section of the configuration.
+func newStore(cfg *viper.Viper) (Store, error) {
+	cfg.SetDefault("data_dir", "data")
+	cfg.SetDefault("store.type", "memory")
+	cfg.SetDefault("store.sync", string(wal.SyncInterval))
+	cfg.SetDefault("store.sync_interval", "1s")
+
+	switch kind := cfg.GetString("store.type"); kind {
+	case "memory":
+		return newKVStore(newMemoryKV()), nil
+
+	case "wal":
+		// An unknown sync policy is refused by the log, rather than never flushing
+		opts := wal.DefaultOptions()
+		opts.Sync = wal.SyncPolicy(cfg.GetString("store.sync"))
+		opts.SyncInterval = cfg.GetDuration("store.sync_interval")
+		if size := cfg.GetInt64("store.segment_size"); size > 0 {
+			opts.SegmentSize = size
+		}
+		if cfg.IsSet("store.compact_ratio") {
+			opts.CompactRatio = cfg.GetFloat64("store.compact_ratio")
+		}
+
+		log, err := wal.Open(filepath.Join(cfg.GetString("data_dir"), "wal"), opts)
+		if err != nil {
+			return nil, err
+		}
+		return newKVStore(log), nil
+
+	case "bolt":
+		return openBoltStore(cfg.GetString("data_dir"))
+
+	default:
+		return nil, fmt.Errorf("unknown store type '%s'", kind)
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// kv represents a bucketed key-value storage which a store is built upon.
+type kv interface {
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	Get(bucket, key string) ([]byte, bool)
+	ForEach(bucket string, fn func(key string, value []byte) bool)
+	Close() error
+}
+
+// kvStore represents a store encoding its state as JSON in a key-value storage.
+type kvStore struct {
+	kv
+	seq     uint64         // The sequence of the queued messages.
+	lastErr atomic.Value   // The last write error.
+	queues  sync.Mutex     // Serializes the changes of the offline queues.
+	queued  map[string]int // The number of messages queued per client, once counted.
+}
+
+// newKVStore creates a store on top of a key-value storage.
+func newKVStore(storage kv) *kvStore {
+	return &kvStore{
+		kv:     storage,
+		seq:    uint64(time.Now().UnixNano()),
+		queued: make(map[string]int),
+	}
+}
+
+// PutRetained retains a message, an empty payload clears the topic.
+func (s *kvStore) PutRetained(m *Message) error {
+	if len(m.Payload) == 0 {
+		return s.track(s.Delete(bucketRetained, m.Topic))
+	}
+	return s.putJSON(bucketRetained, m.Topic, m)
+}
+
+// Retained returns all of the retained messages.
+func (s *kvStore) Retained() (messages []*Message, err error) {
+	s.ForEach(bucketRetained, func(_ string, value []byte) bool {
+		m := new(Message)
+		if err = json.Unmarshal(value, m); err != nil {
+			return false
+		}
+		messages = append(messages, m)
+		return true
+	})
+	return
+}
+
+// PutSession saves a session.
+func (s *kvStore) PutSession(session *Session) error {
+	return s.putJSON(bucketSessions, session.ClientID, session)
+}
+
+// GetSession returns a session, nil if there is none.
+func (s *kvStore) GetSession(clientID string) (*Session, error) {
+	value, ok := s.Get(bucketSessions, clientID)
+	if !ok {
+		return nil, nil
+	}
+
+	session := new(Session)
+	if err := json.Unmarshal(value, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// DeleteSession deletes a session along with its offline queue.
+func (s *kvStore) DeleteSession(clientID string) error {
+	if _, err := s.Dequeue(clientID); err != nil {
+		return err
+	}
+	return s.track(s.Delete(bucketSessions, clientID))
+}
+
+// Sessions returns all of the sessions.
+func (s *kvStore) Sessions() (sessions []*Session, err error) {
+	s.ForEach(bucketSessions, func(_ string, value []byte) bool {
+		session := new(Session)
+		if err = json.Unmarshal(value, session); err != nil {
+			return false
+		}
+		sessions = append(sessions, session)
+		return true
+	})
+	return
+}
+
+// Enqueue queues a message for an offline client.
+func (s *kvStore) Enqueue(clientID string, m *Message) error {
+	s.queues.Lock()
+	defer s.queues.Unlock()
+
+	key := fmt.Sprintf("%020d", atomic.AddUint64(&s.seq, 1))
+	if err := s.putJSON(bucketQueue+clientID, key, m); err != nil {
+		return err
+	}
+	if n, ok := s.queued[clientID]; ok {
+		s.queued[clientID] = n + 1
+	}
+	return nil
+}
+
+// Dequeue removes and returns the queued messages of a client, in their queuing order.
+func (s *kvStore) Dequeue(clientID string) (messages []*Message, err error) {
+	s.queues.Lock()
+	defer s.queues.Unlock()
+	delete(s.queued, clientID)
+
+	var keys []string
+	bucket := bucketQueue + clientID
+	s.ForEach(bucket, func(key string, value []byte) bool {
+		m := new(Message)
+		if err = json.Unmarshal(value, m); err != nil {
+			return false
+		}
+		keys = append(keys, key)
+		messages = append(messages, m)
+		return true
+	})
+
+	for _, key := range keys {
+		if err := s.track(s.Delete(bucket, key)); err != nil {
+			return messages, err
+		}
+	}
+	return
+}
+
+// Queued returns the number of messages queued for a client, which are only counted
+// the first time, then kept up to date.
+func (s *kvStore) Queued(clientID string) (n int, err error) {
+	s.queues.Lock()
+	defer s.queues.Unlock()
+	if n, ok := s.queued[clientID]; ok {
+		return n, nil
+	}
+
+	s.ForEach(bucketQueue+clientID, func(string, []byte) bool {
+		n++
+		return true
+	})
+	s.queued[clientID] = n
+	return
+}
+
+// Check returns the last write error, if the store was unable to persist.
+func (s *kvStore) Check() error {
+	v, _ := s.lastErr.Load().(errorValue)
+	return v.error
+}
+
+// putJSON encodes and stores a value.
+func (s *kvStore) putJSON(bucket, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.track(s.Put(bucket, key, value))
+}
+
+// track records the outcome of the last write, so it can be reported by the checks.
+func (s *kvStore) track(err error) error {
+	s.lastErr.Store(errorValue{err})
+	return err
+}
+
+// errorValue wraps a possibly nil error, so it can be stored in an atomic value.
+type errorValue struct{ error }
+
+// ------------------------------------------------------------------------------------
+
+// memoryKV represents an in-memory key-value storage, nothing survives a restart.
+type memoryKV struct {
+	sync.RWMutex
+	data map[string]map[string][]byte
+}
+
+// newMemoryKV creates a new in-memory storage.
+func newMemoryKV() *memoryKV {
+	return &memoryKV{data: make(map[string]map[string][]byte)}
+}
+
+// Put sets the value of a key in a bucket.
+func (m *memoryKV) Put(bucket, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	values, ok := m.data[bucket]
+	if !ok {
+		values = make(map[string][]byte)
+		m.data[bucket] = values
+	}
+	values[key] = value
+	return nil
+}
+
+// Delete removes a key from a bucket.
+func (m *memoryKV) Delete(bucket, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.data[bucket], key)
+	if len(m.data[bucket]) == 0 {
+		delete(m.data, bucket)
+	}
+	return nil
+}
+
+// Get returns the value of a key in a bucket.
+func (m *memoryKV) Get(bucket, key string) ([]byte, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	value, ok := m.data[bucket][key]
+	return value, ok
+}
+
+// ForEach calls the function for every key of a bucket, in the order of the keys, until
+// it returns false.
+func (m *memoryKV) ForEach(bucket string, fn func(key string, value []byte) bool) {
+	m.RLock()
+	keys := make([]string, 0, len(m.data[bucket]))
+	for key := range m.data[bucket] {
+		keys = append(keys, key)
+	}
+	m.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := m.Get(bucket, key); ok && !fn(key, value) {
+			return
+		}
+	}
+}
+
+// Close closes the storage.
+func (m *memoryKV) Close() error {
+	return nil
+}
+
+// persistentTopic returns whether a retained message on the topic should be persisted,
+// the '$' topics are regenerated by the broker.
+func persistentTopic(topic string) bool {
+	return !strings.HasPrefix(topic, "$")
+}
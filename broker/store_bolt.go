@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The top-level buckets of the bolt store. The queues bucket holds a nested bucket per
+// client, keyed by a big-endian sequence so the messages are iterated in queuing order.
+var (
+	boltRetained = []byte("retained") // topic -> message
+	boltSessions = []byte("sessions") // client id -> session
+	boltQueues   = []byte("queues")   // client id -> sequence -> message
+)
+
+// boltStore represents a store on top of an embedded bolt database.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens or creates the bolt database in the data directory.
+func openBoltStore(dir string) (*boltStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "live-go.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRetained, boltSessions, boltQueues} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// PutRetained retains a message, an empty payload clears the topic.
+func (s *boltStore) PutRetained(m *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRetained)
+		if len(m.Payload) == 0 {
+			return b.Delete([]byte(m.Topic))
+		}
+		return boltPutJSON(b, []byte(m.Topic), m)
+	})
+}
+
+// Retained returns all of the retained messages.
+func (s *boltStore) Retained() (messages []*Message, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRetained).ForEach(func(_, value []byte) error {
+			m := new(Message)
+			if err := json.Unmarshal(value, m); err != nil {
+				return err
+			}
+			messages = append(messages, m)
+			return nil
+		})
+	})
+	return
+}
+
+// PutSession saves a session.
+func (s *boltStore) PutSession(session *Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutJSON(tx.Bucket(boltSessions), []byte(session.ClientID), session)
+	})
+}
+
+// GetSession returns a session, nil if there is none.
+func (s *boltStore) GetSession(clientID string) (session *Session, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltSessions).Get([]byte(clientID))
+		if value == nil {
+			return nil
+		}
+
+		session = new(Session)
+		return json.Unmarshal(value, session)
+	})
+	return
+}
+
+// DeleteSession deletes a session along with its offline queue.
+func (s *boltStore) DeleteSession(clientID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		queues := tx.Bucket(boltQueues)
+		if queues.Bucket([]byte(clientID)) != nil {
+			if err := queues.DeleteBucket([]byte(clientID)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(boltSessions).Delete([]byte(clientID))
+	})
+}
+
+// Sessions returns all of the sessions.
+func (s *boltStore) Sessions() (sessions []*Session, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).ForEach(func(_, value []byte) error {
+			session := new(Session)
+			if err := json.Unmarshal(value, session); err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+			return nil
+		})
+	})
+	return
+}
+
+// Enqueue queues a message for an offline client.
+func (s *boltStore) Enqueue(clientID string, m *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		queue, err := tx.Bucket(boltQueues).CreateBucketIfNotExists([]byte(clientID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return boltPutJSON(queue, key, m)
+	})
+}
+
+// Dequeue removes and returns the queued messages of a client, in their queuing order.
+func (s *boltStore) Dequeue(clientID string) (messages []*Message, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		queues := tx.Bucket(boltQueues)
+		queue := queues.Bucket([]byte(clientID))
+		if queue == nil {
+			return nil
+		}
+
+		if err := queue.ForEach(func(_, value []byte) error {
+			m := new(Message)
+			if err := json.Unmarshal(value, m); err != nil {
+				return err
+			}
+			messages = append(messages, m)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return queues.DeleteBucket([]byte(clientID))
+	})
+	return
+}
+
+// Queued returns the number of messages queued for a client.
+func (s *boltStore) Queued(clientID string) (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if queue := tx.Bucket(boltQueues).Bucket([]byte(clientID)); queue != nil {
+			n = queue.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// Check returns an error when the database can not be read.
+func (s *boltStore) Check() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Backup writes a consistent snapshot of the database while it keeps serving. The
+// snapshot is taken to a temporary file first, so a slow reader does not hold the read
+// transaction, which keeps the database from reusing its free pages.
+func (s *boltStore) Backup(w io.Writer) (int64, error) {
+	f, err := ioutil.TempFile(filepath.Dir(s.db.Path()), "backup-*.db")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
+}
+
+// Close closes the database.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltPutJSON encodes and stores a value in a bucket.
+func boltPutJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
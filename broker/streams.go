@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/dash"
+	"github.com/numb3r3/live-go/media/hls"
+	"github.com/numb3r3/live-go/network/rtmp"
+	"github.com/spf13/viper"
+)
+
+// newStreamRegistry creates the registry of the live streams from the "streams" section
+// of the configuration. The GOP cache may be configured per app, under "streams.apps",
+// and the clients authorized under "streams.auth".
+func newStreamRegistry(cfg *viper.Viper) *media.StreamRegistry {
+	opts := media.DefaultOptions()
+	cfg.SetDefault("streams.grace_period", opts.GracePeriod)
+	cfg.SetDefault("streams.gop_cache.enabled", opts.Cache.Enabled)
+	cfg.SetDefault("streams.gop_cache.max_frames", opts.Cache.MaxFrames)
+	cfg.SetDefault("streams.gop_cache.max_bytes", opts.Cache.MaxBytes)
+
+	opts.GracePeriod = cfg.GetDuration("streams.grace_period")
+	opts.Cache = cacheOptions(cfg, "streams.gop_cache", opts.Cache)
+	opts.AppCache = make(map[string]media.CacheOptions)
+	for app := range cfg.GetStringMap("streams.apps") {
+		opts.AppCache[app] = cacheOptions(cfg, "streams.apps."+app+".gop_cache", opts.Cache)
+	}
+	if auth := newStreamAuth(cfg); auth != nil {
+		opts.Hook = auth
+	}
+	return media.NewStreamRegistry(opts)
+}
+
+// cacheOptions reads the options of a GOP cache, the missing ones being inherited.
+func cacheOptions(cfg *viper.Viper, prefix string, inherited media.CacheOptions) media.CacheOptions {
+	opts := inherited
+	if cfg.IsSet(prefix + ".enabled") {
+		opts.Enabled = cfg.GetBool(prefix + ".enabled")
+	}
+	if cfg.IsSet(prefix + ".max_frames") {
+		opts.MaxFrames = cfg.GetInt(prefix + ".max_frames")
+	}
+	if cfg.IsSet(prefix + ".max_bytes") {
+		opts.MaxBytes = cfg.GetInt(prefix + ".max_bytes")
+	}
+	return opts
+}
+
+// onRTMPPublish registers a stream published over RTMP, as "<app>/<stream key>".
+func (s *Service) onRTMPPublish(req *rtmp.Request) (rtmp.Publisher, error) {
+	var remote string
+	if req.RemoteAddr != nil {
+		remote = req.RemoteAddr.String()
+	}
+
+	publisher, err := s.streams.Publish(req.Key(), media.Client{Remote: remote, Params: req.Query})
+	if err != nil {
+		return nil, err
+	}
+
+	// Segment the stream for the HLS players
+	if s.hls != nil {
+		if err := s.hls.Publish(publisher.Stream()); err != nil {
+			logging.Error("hls: unable to segment", req.Key(), err)
+		}
+	}
+
+	// Segment the stream for the DASH players
+	if s.dash != nil {
+		if err := s.dash.Publish(publisher.Stream()); err != nil {
+			logging.Error("dash: unable to segment", req.Key(), err)
+		}
+	}
+
+	// Record the stream, if its app is
+	if err := s.recorder.Publish(publisher.Stream()); err != nil {
+		logging.Error("record: unable to record", req.Key(), err)
+	}
+	return publisher, nil
+}
+
+// authorizeSegments authorizes the players of the HLS or DASH streams on each of their
+// requests, for the playlists at "<prefix><app>/<stream><ext>" as for the segments at
+// "<prefix><app>/<stream>/<name>". The servers carry the parameters of the playlists
+// over to the URIs of the segments, so the players present them on every request.
+func (s *Service) authorizeSegments(prefix, ext string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := parseStreamPath(r.URL.Path, prefix, ext)
+		if !ok {
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			if i := strings.LastIndexByte(path, '/'); i > 0 && strings.HasPrefix(r.URL.Path, prefix) {
+				key, ok = path[:i], media.ValidKey(path[:i])
+			}
+		}
+
+		if ok {
+			client := media.Client{Remote: r.RemoteAddr, Params: r.URL.Query()}
+			if err := s.streams.Authorize(key, client); err != nil {
+				writeError(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHLS creates the HLS output of the live streams from the "hls" section of the
+// configuration, nil if disabled.
+func newHLS(cfg *viper.Viper) *hls.Server {
+	opts := hls.DefaultOptions()
+	cfg.SetDefault("hls.enabled", true)
+	cfg.SetDefault("hls.target_duration", opts.TargetDuration)
+	cfg.SetDefault("hls.window_size", opts.WindowSize)
+	cfg.SetDefault("hls.directory", opts.Directory)
+	cfg.SetDefault("hls.cleanup", opts.Cleanup)
+	cfg.SetDefault("hls.part_duration", opts.PartDuration)
+	if !cfg.GetBool("hls.enabled") {
+		return nil
+	}
+
+	opts.TargetDuration = cfg.GetDuration("hls.target_duration")
+	opts.WindowSize = cfg.GetInt("hls.window_size")
+	opts.Directory = cfg.GetString("hls.directory")
+	opts.Cleanup = cfg.GetBool("hls.cleanup")
+	opts.PartDuration = cfg.GetDuration("hls.part_duration")
+	return hls.NewServer("/hls/", opts)
+}
+
+// newDASH creates the DASH output of the live streams from the "dash" section of the
+// configuration, nil if disabled.
+func newDASH(cfg *viper.Viper) *dash.Server {
+	opts := dash.DefaultOptions()
+	cfg.SetDefault("dash.enabled", true)
+	cfg.SetDefault("dash.target_duration", opts.TargetDuration)
+	cfg.SetDefault("dash.window_size", opts.WindowSize)
+	if !cfg.GetBool("dash.enabled") {
+		return nil
+	}
+
+	opts.TargetDuration = cfg.GetDuration("dash.target_duration")
+	opts.WindowSize = cfg.GetInt("dash.window_size")
+	return dash.NewServer("/dash/", opts)
+}
+
+// onAdminStreams lists the live streams.
+func (s *Service) onAdminStreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.streams.List())
+}
+
+// onAdminStream shows a single live stream, looked up by its key.
+func (s *Service) onAdminStream(w http.ResponseWriter, r *http.Request, key string) {
+	stream, ok := s.streams.Get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "stream not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, stream.Info())
+}
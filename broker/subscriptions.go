@@ -0,0 +1,254 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message represents a message routed through the broker.
+type Message struct {
+	ID      uint64    // The identifier assigned by the broker, in the order of routing.
+	Topic   string    // The topic the message was published to.
+	Payload []byte    // The payload of the message.
+	QoS     uint8     // The quality of service of the message.
+	Retain  bool      // Whether the message should be retained.
+	Time    time.Time // The time the message was routed.
+	Seq     uint64    // The sequence number of the message within its topic.
+	Origin  string    // The node the message was forwarded from, empty if published here.
+	Bridge  string    // The bridge the message was received from, if any.
+	Client  string    // The client which published the message, if any.
+}
+
+// Subscriber represents a receiver of the messages published on the topics it has
+// subscribed to.
+type Subscriber interface {
+	ID() string
+	Send(m *Message) error
+}
+
+// remote is implemented by the subscribers standing for another node of the cluster,
+// whose subscriptions are not part of the interest of this node.
+type remote interface {
+	Subscriber
+	Node() string
+}
+
+// subscription represents a subscriber along with its requested quality of service.
+type subscription struct {
+	subscriber Subscriber
+	qos        uint8
+}
+
+// subscriptions represents a trie of topic filters, matching the MQTT wildcards.
+type subscriptions struct {
+	sync.RWMutex
+	root       *subscriptionNode
+	count      int
+	onInterest func(filter string, interested bool) // Notified when the local interest changes.
+}
+
+// subscriptionNode represents a level of the trie.
+type subscriptionNode struct {
+	children map[string]*subscriptionNode
+	subs     map[string]subscription
+	local    int // The number of subscribers which are not remote.
+}
+
+// newSubscriptions creates a new empty subscription trie.
+func newSubscriptions() *subscriptions {
+	return &subscriptions{root: newSubscriptionNode()}
+}
+
+func newSubscriptionNode() *subscriptionNode {
+	return &subscriptionNode{
+		children: make(map[string]*subscriptionNode),
+		subs:     make(map[string]subscription),
+	}
+}
+
+// Subscribe adds a subscription for the filter, returns whether the subscription is new.
+func (t *subscriptions) Subscribe(filter string, s Subscriber, qos uint8) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newSubscriptionNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	_, exists := node.subs[s.ID()]
+	node.subs[s.ID()] = subscription{subscriber: s, qos: qos}
+	if !exists {
+		t.count++
+		if _, ok := s.(remote); !ok {
+			if node.local++; node.local == 1 && t.onInterest != nil {
+				t.onInterest(filter, true)
+			}
+		}
+	}
+	return !exists
+}
+
+// Unsubscribe removes a subscription for the filter, returns whether it existed.
+func (t *subscriptions) Unsubscribe(filter string, s Subscriber) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	levels := strings.Split(filter, "/")
+	path := make([]*subscriptionNode, 0, len(levels)+1)
+	node := t.root
+	for _, level := range levels {
+		path = append(path, node)
+		if node = node.children[level]; node == nil {
+			return false
+		}
+	}
+
+	if _, ok := node.subs[s.ID()]; !ok {
+		return false
+	}
+	delete(node.subs, s.ID())
+	t.count--
+	if _, ok := s.(remote); !ok {
+		if node.local--; node.local == 0 && t.onInterest != nil {
+			t.onInterest(filter, false)
+		}
+	}
+
+	// Prune the empty branches
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i].children[levels[i]]
+		if len(child.subs) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+	return true
+}
+
+// Lookup returns the subscriptions matching the topic. A subscriber matching through
+// several filters is returned once, with the highest of the requested QoS.
+func (t *subscriptions) Lookup(topic string) []subscription {
+	t.RLock()
+	defer t.RUnlock()
+
+	found := make(map[string]subscription)
+	levels := strings.Split(topic, "/")
+	t.root.match(levels, strings.HasPrefix(topic, "$"), found)
+
+	result := make([]subscription, 0, len(found))
+	for _, s := range found {
+		result = append(result, s)
+	}
+	return result
+}
+
+// match collects the subscriptions matching the remaining levels. Wildcards at the
+// first level do not match the topics starting with '$'.
+func (n *subscriptionNode) match(levels []string, system bool, found map[string]subscription) {
+	if len(levels) == 0 {
+		n.collect(found)
+
+		// A multi-level wildcard also matches its parent level
+		if child, ok := n.children["#"]; ok {
+			child.collect(found)
+		}
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, found)
+	}
+	if system {
+		return
+	}
+	if child, ok := n.children["+"]; ok {
+		child.match(levels[1:], false, found)
+	}
+	if child, ok := n.children["#"]; ok {
+		child.collect(found)
+	}
+}
+
+func (n *subscriptionNode) collect(found map[string]subscription) {
+	for id, s := range n.subs {
+		if prev, ok := found[id]; !ok || prev.qos < s.qos {
+			found[id] = s
+		}
+	}
+}
+
+// Topics returns the number of subscribers of every subscribed topic filter.
+func (t *subscriptions) Topics() map[string]int {
+	t.RLock()
+	defer t.RUnlock()
+
+	topics := make(map[string]int)
+	t.root.walk(nil, func(levels []string, n *subscriptionNode) {
+		if len(n.subs) > 0 {
+			topics[strings.Join(levels, "/")] = len(n.subs)
+		}
+	})
+	return topics
+}
+
+// Interest calls the function with the topic filters which have local subscribers. No
+// change of the interest is notified until the function returns.
+func (t *subscriptions) Interest(fn func(filters []string)) {
+	t.RLock()
+	defer t.RUnlock()
+
+	var filters []string
+	t.root.walk(nil, func(levels []string, n *subscriptionNode) {
+		if n.local > 0 {
+			filters = append(filters, strings.Join(levels, "/"))
+		}
+	})
+	fn(filters)
+}
+
+// Count returns the total number of subscriptions.
+func (t *subscriptions) Count() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.count
+}
+
+func (n *subscriptionNode) walk(levels []string, fn func([]string, *subscriptionNode)) {
+	for level, child := range n.children {
+		path := append(levels[:len(levels):len(levels)], level)
+		fn(path, child)
+		child.walk(path, fn)
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// validTopic returns whether the topic name can be published to.
+func validTopic(topic string) bool {
+	return topic != "" && len(topic) <= 65535 && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter returns whether the topic filter can be subscribed to.
+func validFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 || strings.ContainsRune(filter, 0) {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return false
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
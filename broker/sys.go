@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// sysPrefix is the prefix of the broker statistics topics.
+const sysPrefix = "$SYS/broker/"
+
+// stats represents the message counters of the service.
+type stats struct {
+	messagesReceived int64 // The number of messages published to the broker.
+	messagesSent     int64 // The number of messages sent to the subscribers.
+	bytesReceived    int64 // The payload bytes published to the broker.
+	bytesSent        int64 // The payload bytes sent to the subscribers.
+}
+
+// onReceived counts a message published to the broker.
+func (st *stats) onReceived(m *Message) {
+	atomic.AddInt64(&st.messagesReceived, 1)
+	atomic.AddInt64(&st.bytesReceived, int64(len(m.Payload)))
+}
+
+// onSent counts a message sent to a subscriber.
+func (st *stats) onSent(m *Message) {
+	atomic.AddInt64(&st.messagesSent, 1)
+	atomic.AddInt64(&st.bytesSent, int64(len(m.Payload)))
+}
+
+// snapshot returns a copy of the counters.
+func (st *stats) snapshot() stats {
+	return stats{
+		messagesReceived: atomic.LoadInt64(&st.messagesReceived),
+		messagesSent:     atomic.LoadInt64(&st.messagesSent),
+		bytesReceived:    atomic.LoadInt64(&st.bytesReceived),
+		bytesSent:        atomic.LoadInt64(&st.bytesSent),
+	}
+}
+
+// clientEvent represents the payload of a client connected or disconnected event.
+type clientEvent struct {
+	ClientID  string `json:"clientid"`
+	Username  string `json:"username"`
+	IPAddress string `json:"ipaddress"`
+	Timestamp int64  `json:"ts"`
+}
+
+// publishSysStats periodically publishes the broker statistics on the $SYS topics until
+// the service is closed. A zero interval disables the statistics.
+func (s *Service) publishSysStats(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, lastTime := s.stats.snapshot(), time.Now()
+	s.sysPublish("version", s.Config.GetString("version"))
+	for {
+		select {
+		case <-s.Closing:
+			return
+		case now := <-ticker.C:
+			current := s.stats.snapshot()
+			elapsed := now.Sub(lastTime).Seconds()
+			rate := func(current, last int64) string {
+				return strconv.FormatFloat(float64(current-last)/elapsed, 'f', 2, 64)
+			}
+
+			s.sysPublish("uptime", fmt.Sprintf("%d seconds", int64(s.uptime().Seconds())))
+			s.sysPublish("clients/connected", strconv.Itoa(s.conns.Clients()))
+			s.sysPublish("messages/received", strconv.FormatInt(current.messagesReceived, 10))
+			s.sysPublish("messages/sent", strconv.FormatInt(current.messagesSent, 10))
+			s.sysPublish("bytes/received", strconv.FormatInt(current.bytesReceived, 10))
+			s.sysPublish("bytes/sent", strconv.FormatInt(current.bytesSent, 10))
+			s.sysPublish("load/messages/received", rate(current.messagesReceived, last.messagesReceived))
+			s.sysPublish("load/messages/sent", rate(current.messagesSent, last.messagesSent))
+			s.sysPublish("load/bytes/received", rate(current.bytesReceived, last.bytesReceived))
+			s.sysPublish("load/bytes/sent", rate(current.bytesSent, last.bytesSent))
+			s.sysPublish("subscriptions/count", strconv.Itoa(s.subscriptions.Count()))
+			s.sysPublish("retained messages/count", strconv.Itoa(s.retained.Count()))
+			last, lastTime = current, now
+		}
+	}
+}
+
+// sysPublish publishes a retained statistic on a $SYS topic. The statistics themselves
+// are not counted as received messages.
+func (s *Service) sysPublish(name, value string) {
+	s.route(&Message{
+		Topic:   sysPrefix + name,
+		Payload: []byte(value),
+		Retain:  true,
+	})
+}
+
+// topicEscaper escapes the characters of a client ID which would otherwise be a level
+// separator or a wildcard, or be confused with an escape, in the topic of its events.
+var topicEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23")
+
+// publishClientEvent publishes a client connected or disconnected event, on a topic
+// with the escaped client ID, while the payload holds the ID as is.
+func (s *Service) publishClientEvent(c *Conn, event string) {
+	info := c.info()
+	payload, err := json.Marshal(clientEvent{
+		ClientID:  info.ClientID,
+		Username:  info.Username,
+		IPAddress: info.RemoteAddr,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		logging.Error("unable to encode client event", err)
+		return
+	}
+
+	s.route(&Message{
+		Topic:   fmt.Sprintf("$SYS/brokers/%s/clients/%s/%s", s.nodeName(), topicEscaper.Replace(info.ClientID), event),
+		Payload: payload,
+	})
+}
+
+// nodeName returns the name of this broker node, the host name by default.
+func (s *Service) nodeName() string {
+	if name := s.Config.GetString("hostname"); name != "" {
+		return name
+	}
+
+	name, _ := os.Hostname()
+	return name
+}
@@ -0,0 +1,267 @@
+package broker
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/network/cluster"
+)
+
+// The frames of the session ownership protocol.
+const (
+	frameTakeover = "takeover" // Asks the peers to release a client.
+	frameSession  = "session"  // The session released by a peer, if it had one.
+	frameImported = "imported" // Acknowledges a session released by a peer.
+)
+
+// takeoverRequest represents a client connecting to a node, which asks the others to
+// release it.
+type takeoverRequest struct {
+	ID       uint64 `json:"id"`
+	ClientID string `json:"client_id"`
+	Clean    bool   `json:"clean"`
+}
+
+// sessionTransfer represents the reply to a takeover request, carrying the persistent
+// session of the client along with its offline queue, which holds the inflight messages
+// of its last connection.
+type sessionTransfer struct {
+	ID       uint64     `json:"id"`
+	Session  *Session   `json:"session,omitempty"`
+	Messages []*Message `json:"messages,omitempty"`
+}
+
+// maxTakeoverTimeout caps the takeover timeout, as the connecting client waits for its
+// CONNACK meanwhile.
+const maxTakeoverTimeout = 5 * time.Second
+
+// releasedSession represents a session handed over to a peer. It stays in the store
+// until the peer acknowledges it, and is restored if the peer never does.
+type releasedSession struct {
+	transfer *sessionTransfer
+	timer    *time.Timer
+}
+
+// takeover makes this node the owner of a connecting client. Every peer disconnects its
+// connection of the client, if any, and hands its persistent session over, which is
+// imported in the local store so it is resumed as if it was stored here. With a clean
+// session the peers discard theirs instead. It blocks the CONNECT of the client until
+// every peer replies, or the takeover timeout.
+func (n *clusterNode) takeover(clientID string, clean bool) {
+	members := n.peers.Members()
+	if len(members) == 0 {
+		return
+	}
+
+	id := atomic.AddUint64(&n.lastRequest, 1)
+	replies := make(chan *sessionTransfer, len(members))
+	n.Lock()
+	n.pending[id] = replies
+	n.Unlock()
+	defer func() {
+		n.Lock()
+		delete(n.pending, id)
+		n.Unlock()
+	}()
+
+	data, _ := json.Marshal(takeoverRequest{ID: id, ClientID: clientID, Clean: clean})
+	asked := 0
+	for _, m := range members {
+		if n.peers.Send(m.Name, &cluster.Frame{Type: frameTakeover, Data: data}) == nil {
+			asked++
+		}
+	}
+
+	timeout := time.NewTimer(n.takeoverTimeout())
+	defer timeout.Stop()
+	for ; asked > 0; asked-- {
+		select {
+		case <-replies:
+		case <-timeout.C:
+			logging.Error("cluster: takeover of", clientID, "timed out")
+			return
+		}
+	}
+}
+
+// importSession stores a session released by a peer, unless the local one is more
+// recent, and queues its messages.
+func (n *clusterNode) importSession(session *Session, messages []*Message) error {
+	s := n.service
+	local, err := s.store.GetSession(session.ClientID)
+	if err != nil {
+		logging.Error("unable to import the session of", session.ClientID, err)
+		return err
+	}
+
+	if local == nil || session.LastSeen.After(local.LastSeen) {
+		if local != nil {
+			s.goOnline(local.ClientID, local.Subscriptions)
+		}
+		if err := s.store.PutSession(session); err != nil {
+			logging.Error("unable to import the session of", session.ClientID, err)
+			return err
+		}
+	}
+
+	for _, m := range messages {
+		if err := s.store.Enqueue(session.ClientID, m); err != nil {
+			logging.Error("unable to import the queue of", session.ClientID, err)
+			return err
+		}
+	}
+	logging.Info("cluster: imported the session of", session.ClientID, "with", len(messages), "queued messages")
+	return nil
+}
+
+// release disconnects a client taken over by a peer and hands its persistent session
+// over, unless the client requested a clean one. The session is only deleted once the
+// peer acknowledges it, and restored along with its queue if the peer does not in time.
+func (n *clusterNode) release(node string, req *takeoverRequest) *sessionTransfer {
+	s := n.service
+	t := &sessionTransfer{ID: req.ID}
+
+	// Closing the connection saves its session, inflight messages included
+	if c, ok := s.conns.Get(req.ClientID); ok {
+		logging.Info("client", req.ClientID, "taken over by another node")
+		c.Close()
+	}
+
+	session, err := s.store.GetSession(req.ClientID)
+	if err != nil || session == nil {
+		return t
+	}
+
+	s.goOnline(session.ClientID, session.Subscriptions)
+	if req.Clean {
+		if err := s.store.DeleteSession(session.ClientID); err != nil {
+			logging.Error("unable to release the session of", session.ClientID, err)
+		}
+		return t
+	}
+
+	t.Session = session
+	if t.Messages, err = s.store.Dequeue(session.ClientID); err != nil {
+		logging.Error("unable to dequeue the messages of", session.ClientID, err)
+	}
+
+	key := releaseKey(node, req.ID)
+	wait := 2 * n.takeoverTimeout()
+	n.Lock()
+	n.released[key] = &releasedSession{
+		transfer: t,
+		timer:    time.AfterFunc(wait, func() { n.restore(key) }),
+	}
+	n.Unlock()
+	return t
+}
+
+// takeoverTimeout returns how long a takeover waits for the peers, capped so the client
+// is not left waiting for its CONNACK.
+func (n *clusterNode) takeoverTimeout() time.Duration {
+	if timeout := n.service.Config.GetDuration("cluster.takeover_timeout"); timeout < maxTakeoverTimeout {
+		return timeout
+	}
+	return maxTakeoverTimeout
+}
+
+// releaseKey returns the key of a session released to a peer, by the request.
+func releaseKey(node string, id uint64) string {
+	return node + "/" + strconv.FormatUint(id, 10)
+}
+
+// restore brings back a released session which the peer did not acknowledge, so the
+// client resumes it wherever it connects next.
+func (n *clusterNode) restore(key string) {
+	n.Lock()
+	r, ok := n.released[key]
+	delete(n.released, key)
+	n.Unlock()
+	if !ok {
+		return
+	}
+
+	s, session := n.service, r.transfer.Session
+	for _, m := range r.transfer.Messages {
+		if err := s.store.Enqueue(session.ClientID, m); err != nil {
+			logging.Error("unable to restore the queue of", session.ClientID, err)
+			break
+		}
+	}
+	if local, err := s.store.GetSession(session.ClientID); err == nil && local != nil {
+		s.goOffline(local.ClientID, local.Subscriptions)
+	}
+	logging.Info("cluster: restored the session of", session.ClientID, "not acknowledged by its new owner")
+}
+
+// onTakeover handles a takeover request of a peer.
+func (n *clusterNode) onTakeover(node string, data []byte) {
+	var req takeoverRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.ClientID == "" {
+		logging.Error("cluster: invalid takeover request from", node)
+		return
+	}
+
+	reply, _ := json.Marshal(n.release(node, &req))
+	if err := n.peers.Send(node, &cluster.Frame{Type: frameSession, Data: reply}); err != nil {
+		logging.Error("cluster: unable to release", req.ClientID, "to", node, err)
+		n.restore(releaseKey(node, req.ID))
+	}
+}
+
+// onSession handles the reply of a peer to a takeover request. The session is imported
+// and acknowledged even if the takeover gave up waiting, so it is never lost.
+func (n *clusterNode) onSession(node string, data []byte) {
+	t := new(sessionTransfer)
+	if err := json.Unmarshal(data, t); err != nil {
+		logging.Error("cluster: invalid session from", node)
+		return
+	}
+
+	if t.Session != nil {
+		if err := n.importSession(t.Session, t.Messages); err != nil {
+			return
+		}
+		ack, _ := json.Marshal(sessionTransfer{ID: t.ID})
+		if err := n.peers.Send(node, &cluster.Frame{Type: frameImported, Data: ack}); err != nil {
+			logging.Error("cluster: unable to acknowledge the session of", t.Session.ClientID, "to", node, err)
+		}
+	}
+
+	// Never block the reading of the peer on a takeover which is not waiting anymore
+	n.Lock()
+	replies, ok := n.pending[t.ID]
+	n.Unlock()
+	if ok {
+		select {
+		case replies <- t:
+		default:
+		}
+	}
+}
+
+// onImported deletes a session released to a peer, once the peer imported it.
+func (n *clusterNode) onImported(node string, data []byte) {
+	var ack sessionTransfer
+	if err := json.Unmarshal(data, &ack); err != nil {
+		logging.Error("cluster: invalid acknowledgement from", node)
+		return
+	}
+
+	key := releaseKey(node, ack.ID)
+	n.Lock()
+	r, ok := n.released[key]
+	delete(n.released, key)
+	n.Unlock()
+	if !ok {
+		return
+	}
+
+	r.timer.Stop()
+	if err := n.service.store.DeleteSession(r.transfer.Session.ClientID); err != nil {
+		logging.Error("unable to release the session of", r.transfer.Session.ClientID, err)
+	}
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout is the time a webhook has to answer.
+const webhookTimeout = 5 * time.Second
+
+// webhookClient is the HTTP client calling the webhooks.
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// postWebhook posts an event as JSON to the URL of a webhook, which must answer with a
+// success status.
+func postWebhook(url string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s answered %s", url, resp.Status)
+	}
+	return nil
+}
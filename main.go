@@ -3,11 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 
 	"github.com/numb3r3/live-go/broker"
 	"github.com/numb3r3/live-go/config"
 	"github.com/numb3r3/live-go/log"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -16,6 +20,7 @@ var (
 	logLevel       = flag.String("loglevel", "info", "log level")
 	logFile        = flag.String("logfile", "console.log", "log file path")
 	argHelp        = flag.Bool("help", false, "Shows the help and usage instead of running the broker.")
+	argBackup      = flag.String("backup", "", "Writes a backup of the store of the running broker to a file.")
 )
 
 func init() {
@@ -34,8 +39,11 @@ func main() {
 	logging.Info("start live-go: ", version)
 
 	cfg, err := config.ReadConfig(*configFileName, map[string]interface{}{
-		"listen_addr": "0.0.0.0:9090",
-		"auth": map[string]string{
+		"listen_addr":  "0.0.0.0:9090",
+		"version":      version,
+		"sys_interval": "10s",
+		"data_dir":     "data",
+		"auth": map[string]interface{}{
 			"username": "numb3r3",
 			"password": "314159",
 		},
@@ -45,6 +53,15 @@ func main() {
 		panic(fmt.Errorf("Error when reading config: %v", err))
 	}
 
+	// Take an online backup instead of running the broker
+	if *argBackup != "" {
+		if err := backup(cfg, *argBackup); err != nil {
+			logging.Fatal(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Setup the new service
 	svc, err := broker.NewService(cfg)
 	if err != nil {
@@ -55,3 +72,42 @@ func main() {
 	svc.Listen()
 
 }
+
+// backup requests a snapshot of the store from the broker running with the same
+// configuration, through its admin API, and writes it to a file.
+func backup(cfg *viper.Viper, path string) error {
+	host, port, err := net.SplitHostPort(cfg.GetString("listen_addr"))
+	if err != nil {
+		return err
+	}
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(host, port)+"/admin/api/backup", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(cfg.GetString("auth.username"), cfg.GetString("auth.password"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup failed: %s", resp.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	logging.Infof("backup of %d bytes written to %s", n, path)
+	return f.Close()
+}
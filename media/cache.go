@@ -0,0 +1,52 @@
+package media
+
+// gopCache represents the cache of the latest group of pictures of a stream: the last
+// video keyframe and the audio and video frames which followed. A player attached to
+// the stream gets it first, so it can show a picture without waiting for the next
+// keyframe. A GOP growing beyond the limits is dropped, up to the next keyframe.
+type gopCache struct {
+	opts    CacheOptions
+	packets []*Packet
+	size    int
+}
+
+// newGOPCache creates a new empty cache.
+func newGOPCache(opts CacheOptions) *gopCache {
+	return &gopCache{opts: opts}
+}
+
+// Add caches a frame. The headers are not cached, as the stream keeps them.
+func (c *gopCache) Add(p *Packet) {
+	switch {
+	case !c.opts.Enabled || p.Type == PacketMetadata || p.IsSequenceHeader():
+		return
+	case p.IsKeyframe():
+		c.Reset()
+	case len(c.packets) == 0:
+		return // The frames are only cached from a keyframe on
+	}
+
+	if len(c.packets) >= c.opts.MaxFrames || c.size+len(p.Data) > c.opts.MaxBytes {
+		c.Reset()
+		return
+	}
+
+	c.packets = append(c.packets, p)
+	c.size += len(p.Data)
+}
+
+// Packets returns the cached frames.
+func (c *gopCache) Packets() []*Packet {
+	return c.packets
+}
+
+// Len returns the number of cached frames.
+func (c *gopCache) Len() int {
+	return len(c.packets)
+}
+
+// Reset empties the cache.
+func (c *gopCache) Reset() {
+	c.packets = nil
+	c.size = 0
+}
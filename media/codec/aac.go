@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"fmt"
+)
+
+// The audio object types.
+const (
+	AACMain = 1
+	AACLC   = 2
+	AACSBR  = 5  // The spectral band replication of HE-AAC.
+	AACPS   = 29 // The parametric stereo of HE-AACv2.
+)
+
+// AudioInfo represents the properties of an audio stream.
+type AudioInfo struct {
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+}
+
+// The sample rates, by index.
+var sampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AudioSpecificConfig represents the decoder configuration of an AAC stream.
+type AudioSpecificConfig struct {
+	ObjectType          uint8 // The object type of the core, such as AACLC.
+	SampleRate          int   // The sample rate of the core.
+	Channels            uint8 // The channel configuration.
+	ExtensionObjectType uint8 // AACSBR or AACPS if explicitly signaled, zero otherwise.
+	ExtensionSampleRate int   // The output sample rate of the extension.
+}
+
+// ParseAudioSpecificConfig parses an AudioSpecificConfig, along with the explicit
+// signaling of the HE-AAC extensions.
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	r := &bitReader{data: data}
+	c := &AudioSpecificConfig{ObjectType: readObjectType(r)}
+	c.SampleRate = readSampleRate(r)
+	c.Channels = uint8(r.bits(4))
+
+	if c.ObjectType == AACSBR || c.ObjectType == AACPS {
+		c.ExtensionObjectType = c.ObjectType
+		c.ExtensionSampleRate = readSampleRate(r)
+		c.ObjectType = readObjectType(r)
+	}
+	if r.err != nil || c.ObjectType == 0 || c.SampleRate == 0 {
+		return nil, ErrInvalidData
+	}
+	return c, nil
+}
+
+// readObjectType reads an audio object type, of 5 bits with an escape to 6 more.
+func readObjectType(r *bitReader) uint8 {
+	if t := uint8(r.bits(5)); t != 31 {
+		return t
+	}
+	return 32 + uint8(r.bits(6))
+}
+
+// readSampleRate reads a sample rate, as an index or explicitly on 24 bits.
+func readSampleRate(r *bitReader) int {
+	index := int(r.bits(4))
+	switch {
+	case index == 0x0f:
+		return int(r.bits(24))
+	case index < len(sampleRates):
+		return sampleRates[index]
+	}
+	return 0
+}
+
+// sampleRateIndex returns the index of a sample rate, 15 if it has none.
+func sampleRateIndex(rate int) uint8 {
+	for i, r := range sampleRates {
+		if r == rate {
+			return uint8(i)
+		}
+	}
+	return 0x0f
+}
+
+// Marshal encodes the configuration of the core, without its extension.
+func (c *AudioSpecificConfig) Marshal() []byte {
+	index := sampleRateIndex(c.SampleRate)
+	if index == 0x0f {
+		v := uint64(c.ObjectType)<<35 | 0x0f<<31 | uint64(c.SampleRate)<<7 | uint64(c.Channels)<<3
+		return []byte{byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	return []byte{c.ObjectType<<3 | index>>1, index<<7 | c.Channels<<3}
+}
+
+// Codecs returns the codecs parameter of the stream, as defined by RFC 6381.
+func (c *AudioSpecificConfig) Codecs() string {
+	if c.ExtensionObjectType != 0 {
+		return fmt.Sprintf("mp4a.40.%d", c.ExtensionObjectType)
+	}
+	return fmt.Sprintf("mp4a.40.%d", c.ObjectType)
+}
+
+// Info returns the properties of the stream.
+func (c *AudioSpecificConfig) Info() *AudioInfo {
+	info := &AudioInfo{Codec: "aac", SampleRate: c.SampleRate, Channels: int(c.Channels)}
+	switch {
+	case c.ExtensionObjectType == AACPS:
+		info.Profile, info.SampleRate = "HE-AACv2", c.ExtensionSampleRate
+	case c.ExtensionObjectType == AACSBR:
+		info.Profile, info.SampleRate = "HE-AAC", c.ExtensionSampleRate
+	case c.ObjectType == AACLC:
+		info.Profile = "LC"
+	case c.ObjectType == AACMain:
+		info.Profile = "Main"
+	}
+	if c.Channels == 7 { // The 7.1 configuration
+		info.Channels = 8
+	}
+	return info
+}
+
+// ADTSHeader returns the ADTS header of a raw frame of a size. The object types beyond
+// the 2 bits of its profile are signaled as AAC-LC, and the explicit sample rates are
+// not supported.
+func (c *AudioSpecificConfig) ADTSHeader(size int) []byte {
+	profile := c.ObjectType - 1
+	if profile > 3 {
+		profile = AACLC - 1
+	}
+
+	n := size + 7
+	index := sampleRateIndex(c.SampleRate)
+	return []byte{
+		0xff, 0xf1, // The sync word, MPEG-4 and no CRC
+		profile<<6 | index<<2 | c.Channels>>2,
+		(c.Channels&0x03)<<6 | byte(n>>11),
+		byte(n >> 3),
+		byte(n&0x07)<<5 | 0x1f, // The buffer fullness is variable
+		0xfc,
+	}
+}
+
+// ParseADTS parses the ADTS header at the start of data, returning the configuration
+// of the stream along with the raw frame following the header.
+func ParseADTS(data []byte) (*AudioSpecificConfig, []byte, error) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf6 != 0xf0 {
+		return nil, nil, ErrInvalidData
+	}
+
+	headerSize := 7
+	if data[1]&0x01 == 0 { // The CRC follows
+		headerSize = 9
+	}
+	index := int(data[2] >> 2 & 0x0f)
+	size := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	if index >= len(sampleRates) || size < headerSize || size > len(data) {
+		return nil, nil, ErrInvalidData
+	}
+
+	c := &AudioSpecificConfig{
+		ObjectType: data[2]>>6 + 1,
+		SampleRate: sampleRates[index],
+		Channels:   (data[2]&0x01)<<2 | data[3]>>6,
+	}
+	return c, data[headerSize:size], nil
+}
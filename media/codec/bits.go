@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"errors"
+)
+
+// ErrInvalidData is returned when a configuration or a header can not be parsed.
+var ErrInvalidData = errors.New("codec: invalid data")
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit, the 0x03 following
+// two zero bytes, to get its raw payload.
+func unescapeRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitReader reads the fields of a bitstream, most significant bit first. A read past
+// the end sets the error, and returns zeros.
+type bitReader struct {
+	data []byte
+	pos  int // The position, in bits.
+	err  error
+}
+
+// bits reads an unsigned integer of up to 32 bits.
+func (r *bitReader) bits(n int) uint32 {
+	if r.pos+n > len(r.data)*8 {
+		r.err = ErrInvalidData
+		r.pos = len(r.data) * 8
+		return 0
+	}
+
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.data[r.pos>>3]>>(7-uint(r.pos&7))&1)
+		r.pos++
+	}
+	return v
+}
+
+// flag reads a single bit.
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// skip skips a number of bits.
+func (r *bitReader) skip(n int) {
+	for ; n > 32; n -= 32 {
+		r.bits(32)
+	}
+	r.bits(n)
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if zeros++; zeros > 31 || r.err != nil {
+			r.err = ErrInvalidData
+			return 0
+		}
+	}
+	return (1<<uint(zeros) - 1) + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
@@ -0,0 +1,271 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+)
+
+// VideoInfo represents the properties of a video stream, as read from its parameter
+// sets.
+type VideoInfo struct {
+	Codec     string  `json:"codec"`
+	Profile   string  `json:"profile,omitempty"`
+	Level     string  `json:"level,omitempty"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frame_rate,omitempty"` // Zero if not signaled.
+}
+
+// AVCConfig represents the decoder configuration of an H.264 stream, as carried by an
+// AVCDecoderConfigurationRecord.
+type AVCConfig struct {
+	Profile       uint8
+	Compatibility uint8 // The constraint flags of the profile.
+	Level         uint8
+	LengthSize    int      // The size of the length prefixing the NAL units.
+	SPS           [][]byte // The sequence parameter sets.
+	PPS           [][]byte // The picture parameter sets.
+}
+
+// ParseAVCConfig parses an AVCDecoderConfigurationRecord.
+func ParseAVCConfig(record []byte) (*AVCConfig, error) {
+	if len(record) < 7 || record[0] != 1 {
+		return nil, ErrInvalidData
+	}
+
+	c := &AVCConfig{
+		Profile:       record[1],
+		Compatibility: record[2],
+		Level:         record[3],
+		LengthSize:    int(record[4]&0x03) + 1,
+	}
+	data := record[5:]
+	for i, sets := range []*[][]byte{&c.SPS, &c.PPS} {
+		if len(data) < 1 {
+			return nil, ErrInvalidData
+		}
+		count := int(data[0])
+		if i == 0 {
+			count &= 0x1f
+		}
+		data = data[1:]
+		for j := 0; j < count; j++ {
+			if len(data) < 2 {
+				return nil, ErrInvalidData
+			}
+			n := int(data[0])<<8 | int(data[1])
+			if len(data) < 2+n {
+				return nil, ErrInvalidData
+			}
+			*sets = append(*sets, data[2:2+n])
+			data = data[2+n:]
+		}
+	}
+	return c, nil
+}
+
+// NewAVCConfig creates the decoder configuration of the parameter sets of an H.264
+// stream, as found in its Annex-B keyframes.
+func NewAVCConfig(sps, pps [][]byte) (*AVCConfig, error) {
+	if len(sps) == 0 || len(sps[0]) < 4 || len(pps) == 0 {
+		return nil, ErrInvalidData
+	}
+	return &AVCConfig{
+		Profile:       sps[0][1],
+		Compatibility: sps[0][2],
+		Level:         sps[0][3],
+		LengthSize:    4,
+		SPS:           sps,
+		PPS:           pps,
+	}, nil
+}
+
+// Marshal encodes the configuration as an AVCDecoderConfigurationRecord.
+func (c *AVCConfig) Marshal() []byte {
+	b := []byte{1, c.Profile, c.Compatibility, c.Level, 0xfc | byte(c.LengthSize-1), 0xe0 | byte(len(c.SPS))}
+	for i, sets := range [][][]byte{c.SPS, c.PPS} {
+		if i == 1 {
+			b = append(b, byte(len(sets)))
+		}
+		for _, set := range sets {
+			b = append(append(b, byte(len(set)>>8), byte(len(set))), set...)
+		}
+	}
+	return b
+}
+
+// Codecs returns the codecs parameter of the stream, as defined by RFC 6381.
+func (c *AVCConfig) Codecs() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", c.Profile, c.Compatibility, c.Level)
+}
+
+// Info returns the properties of the stream, read from its first sequence parameter set.
+func (c *AVCConfig) Info() (*VideoInfo, error) {
+	if len(c.SPS) == 0 {
+		return nil, ErrInvalidData
+	}
+	return ParseAVCSPS(c.SPS[0])
+}
+
+// The names of the H.264 profiles.
+var avcProfiles = map[uint8]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+// ParseAVCSPS parses an H.264 sequence parameter set, with its NAL unit header, for
+// the dimensions of the pictures and the frame rate.
+func ParseAVCSPS(nalu []byte) (*VideoInfo, error) {
+	if AVCType(nalu) != AVCSPS || len(nalu) < 4 {
+		return nil, ErrInvalidData
+	}
+
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+	profile := uint8(r.bits(8))
+	r.skip(8) // The constraint flags
+	level := uint8(r.bits(8))
+	r.ue() // The identifier
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = r.ue(); chromaFormat == 3 {
+			separateColourPlane = r.flag()
+		}
+		r.ue()    // The bit depth of the luma
+		r.ue()    // The bit depth of the chroma
+		r.skip(1) // The transform bypass
+		if r.flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(r, size)
+			}
+		}
+	}
+
+	r.ue() // The maximum frame number
+	switch r.ue() {
+	case 0:
+		r.ue() // The maximum picture order count
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // The maximum number of reference frames
+	r.skip(1) // The gaps in the frame numbers
+
+	widthMbs := int(r.ue()) + 1
+	heightMaps := int(r.ue()) + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.skip(1) // The adaptive frame and field macroblocks
+	}
+	r.skip(1) // The direct 8x8 inference
+
+	// The cropping is in chroma samples, and in field pairs for the interlaced streams
+	field := 2
+	if frameMbsOnly {
+		field = 1
+	}
+	info := &VideoInfo{
+		Codec:   "h264",
+		Profile: avcProfiles[profile],
+		Level:   fmt.Sprintf("%d.%d", level/10, level%10),
+		Width:   widthMbs * 16,
+		Height:  heightMaps * 16 * field,
+	}
+	if r.flag() {
+		cropX, cropY := 1, field
+		if chromaFormat != 0 && !separateColourPlane {
+			if chromaFormat < 3 {
+				cropX = 2
+			}
+			if chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		info.Width -= cropX * int(left+right)
+		info.Height -= cropY * int(top+bottom)
+	}
+
+	if r.flag() {
+		info.FrameRate = parseAVCTiming(r)
+	}
+	if r.err != nil || info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrInvalidData
+	}
+	return info, nil
+}
+
+// skipScalingList skips a scaling list of a sequence parameter set.
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseAVCTiming parses the video usability information of a sequence parameter set up
+// to its timing, returning the frame rate, zero if not signaled.
+func parseAVCTiming(r *bitReader) float64 {
+	if r.flag() && r.bits(8) == 255 { // The extended sample aspect ratio
+		r.skip(32)
+	}
+	if r.flag() { // The overscan
+		r.skip(1)
+	}
+	if r.flag() { // The video signal type
+		r.skip(4)
+		if r.flag() {
+			r.skip(24)
+		}
+	}
+	if r.flag() { // The chroma sample location
+		r.ue()
+		r.ue()
+	}
+	if !r.flag() {
+		return 0
+	}
+
+	// A frame is two fields, each of them a tick
+	unitsInTick, timeScale := r.bits(32), r.bits(32)
+	if r.err != nil {
+		return 0
+	}
+	return frameRate(timeScale, 2*uint64(unitsInTick))
+}
+
+// frameRate returns the frame rate of a timing, rounded to the thousandth.
+func frameRate(timeScale uint32, unitsPerFrame uint64) float64 {
+	if unitsPerFrame == 0 {
+		return 0
+	}
+	return math.Round(float64(timeScale)/float64(unitsPerFrame)*1000) / 1000
+}
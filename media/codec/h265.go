@@ -0,0 +1,231 @@
+package codec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HEVCConfig represents the decoder configuration of an H.265 stream, as carried by an
+// HEVCDecoderConfigurationRecord.
+type HEVCConfig struct {
+	ProfileSpace  uint8
+	Tier          uint8
+	Profile       uint8
+	Compatibility uint32 // The profile compatibility flags.
+	Constraints   [6]byte
+	Level         uint8
+	LengthSize    int      // The size of the length prefixing the NAL units.
+	VPS           [][]byte // The video parameter sets.
+	SPS           [][]byte // The sequence parameter sets.
+	PPS           [][]byte // The picture parameter sets.
+}
+
+// ParseHEVCConfig parses an HEVCDecoderConfigurationRecord.
+func ParseHEVCConfig(record []byte) (*HEVCConfig, error) {
+	if len(record) < 23 || record[0] != 1 {
+		return nil, ErrInvalidData
+	}
+
+	c := &HEVCConfig{
+		ProfileSpace:  record[1] >> 6,
+		Tier:          record[1] >> 5 & 0x01,
+		Profile:       record[1] & 0x1f,
+		Compatibility: uint32(record[2])<<24 | uint32(record[3])<<16 | uint32(record[4])<<8 | uint32(record[5]),
+		Level:         record[12],
+		LengthSize:    int(record[21]&0x03) + 1,
+	}
+	copy(c.Constraints[:], record[6:12])
+
+	// The parameter sets are in arrays, by type
+	data := record[23:]
+	for i := 0; i < int(record[22]); i++ {
+		if len(data) < 3 {
+			return nil, ErrInvalidData
+		}
+		typ, count := data[0]&0x3f, int(data[1])<<8|int(data[2])
+		data = data[3:]
+		for j := 0; j < count; j++ {
+			if len(data) < 2 {
+				return nil, ErrInvalidData
+			}
+			n := int(data[0])<<8 | int(data[1])
+			if len(data) < 2+n {
+				return nil, ErrInvalidData
+			}
+			switch typ {
+			case HEVCVPS:
+				c.VPS = append(c.VPS, data[2:2+n])
+			case HEVCSPS:
+				c.SPS = append(c.SPS, data[2:2+n])
+			case HEVCPPS:
+				c.PPS = append(c.PPS, data[2:2+n])
+			}
+			data = data[2+n:]
+		}
+	}
+	return c, nil
+}
+
+// Codecs returns the codecs parameter of the stream, as defined by ISO/IEC 14496-15:
+// the profile space and profile, the reversed compatibility flags, the tier and level,
+// then the constraint flags up to the last non-zero byte.
+func (c *HEVCConfig) Codecs() string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if c.ProfileSpace > 0 {
+		b.WriteByte('A' + c.ProfileSpace - 1)
+	}
+
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | c.Compatibility>>uint(i)&1
+	}
+	tier := "L"
+	if c.Tier == 1 {
+		tier = "H"
+	}
+	fmt.Fprintf(&b, "%d.%x.%s%d", c.Profile, reversed, tier, c.Level)
+
+	constraints := c.Constraints[:]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, v := range constraints {
+		fmt.Fprintf(&b, ".%x", v)
+	}
+	return b.String()
+}
+
+// Info returns the properties of the stream, read from its first sequence parameter set,
+// and the frame rate from its first video parameter set.
+func (c *HEVCConfig) Info() (*VideoInfo, error) {
+	if len(c.SPS) == 0 {
+		return nil, ErrInvalidData
+	}
+
+	info, err := ParseHEVCSPS(c.SPS[0])
+	if err == nil && len(c.VPS) > 0 {
+		info.FrameRate = parseHEVCFrameRate(c.VPS[0])
+	}
+	return info, err
+}
+
+// The names of the H.265 profiles.
+var hevcProfiles = map[uint8]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Range Extensions",
+}
+
+// ParseHEVCSPS parses an H.265 sequence parameter set, with its NAL unit header, for
+// the dimensions of the pictures.
+func ParseHEVCSPS(nalu []byte) (*VideoInfo, error) {
+	if HEVCType(nalu) != HEVCSPS || len(nalu) < 3 {
+		return nil, ErrInvalidData
+	}
+
+	r := &bitReader{data: unescapeRBSP(nalu[2:])}
+	r.skip(4) // The video parameter set
+	subLayers := int(r.bits(3))
+	r.skip(1) // The temporal identifier nesting
+	profile, level := skipProfileTierLevel(r, subLayers)
+	r.ue() // The identifier
+
+	chromaFormat := r.ue()
+	if chromaFormat == 3 && r.flag() { // The separate colour planes
+		chromaFormat = 0
+	}
+
+	info := &VideoInfo{
+		Codec:   "h265",
+		Profile: hevcProfiles[profile],
+		Level:   strings.TrimSuffix(fmt.Sprintf("%d.%d", level/30, level%30/3), ".0"),
+		Width:   int(r.ue()),
+		Height:  int(r.ue()),
+	}
+
+	// The conformance window is in chroma samples
+	if r.flag() {
+		cropX, cropY := 1, 1
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY = 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		info.Width -= cropX * int(left+right)
+		info.Height -= cropY * int(top+bottom)
+	}
+	if r.err != nil || info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrInvalidData
+	}
+	return info, nil
+}
+
+// skipProfileTierLevel skips the profile, tier and level of a parameter set, returning
+// the general profile and level.
+func skipProfileTierLevel(r *bitReader, subLayers int) (profile, level uint8) {
+	r.skip(3) // The profile space and the tier
+	profile = uint8(r.bits(5))
+	r.skip(32 + 48) // The compatibility and constraint flags
+	level = uint8(r.bits(8))
+
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i], levelPresent[i] = r.flag(), r.flag()
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+	return
+}
+
+// parseHEVCFrameRate parses a video parameter set, with its NAL unit header, for the
+// frame rate of its timing information, zero if not signaled.
+func parseHEVCFrameRate(nalu []byte) float64 {
+	if HEVCType(nalu) != HEVCVPS || len(nalu) < 3 {
+		return 0
+	}
+
+	r := &bitReader{data: unescapeRBSP(nalu[2:])}
+	r.skip(4 + 2 + 6) // The identifier, the base layer flags and the number of layers
+	subLayers := int(r.bits(3))
+	r.skip(1 + 16) // The temporal identifier nesting and reserved bits
+	skipProfileTierLevel(r, subLayers)
+
+	first := subLayers
+	if r.flag() { // The ordering of the sub-layers
+		first = 0
+	}
+	for i := first; i <= subLayers; i++ {
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+
+	maxLayerID := int(r.bits(6))
+	layerSets := int(r.ue())
+	for i := 0; i < layerSets && r.err == nil; i++ {
+		r.skip(maxLayerID + 1)
+	}
+	if !r.flag() {
+		return 0
+	}
+
+	unitsInTick, timeScale := r.bits(32), r.bits(32)
+	if r.err != nil {
+		return 0
+	}
+	return frameRate(timeScale, uint64(unitsInTick))
+}
@@ -0,0 +1,176 @@
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// The types of the H.264 NAL units.
+const (
+	AVCSlice = 1
+	AVCIDR   = 5
+	AVCSEI   = 6
+	AVCSPS   = 7
+	AVCPPS   = 8
+	AVCAUD   = 9
+)
+
+// The types of the H.265 NAL units.
+const (
+	HEVCBLA    = 16 // The first of the random access point types, up to HEVCCRA.
+	HEVCIDR    = 19
+	HEVCIDRNLP = 20
+	HEVCCRA    = 21
+	HEVCVPS    = 32
+	HEVCSPS    = 33
+	HEVCPPS    = 34
+	HEVCAUD    = 35
+	HEVCSEI    = 39
+)
+
+// AVCType returns the type of an H.264 NAL unit.
+func AVCType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+// HEVCType returns the type of an H.265 NAL unit.
+func HEVCType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] >> 1 & 0x3f
+}
+
+// IsAVCKeyframe returns whether the NAL units of an H.264 access unit are a keyframe.
+func IsAVCKeyframe(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if AVCType(nalu) == AVCIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// IsHEVCKeyframe returns whether the NAL units of an H.265 access unit are a random
+// access point.
+func IsHEVCKeyframe(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if t := HEVCType(nalu); t >= HEVCBLA && t <= HEVCCRA {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAVCParameterSet returns whether an H.264 NAL unit is a parameter set.
+func IsAVCParameterSet(nalu []byte) bool {
+	t := AVCType(nalu)
+	return t == AVCSPS || t == AVCPPS
+}
+
+// IsHEVCParameterSet returns whether an H.265 NAL unit is a parameter set.
+func IsHEVCParameterSet(nalu []byte) bool {
+	t := HEVCType(nalu)
+	return t == HEVCVPS || t == HEVCSPS || t == HEVCPPS
+}
+
+// ------------------------------------------------------------------------------------
+
+// SplitAVCC splits the NAL units of an access unit in the AVCC format, each prefixed by
+// its length, of 1 to 4 bytes.
+func SplitAVCC(data []byte, lengthSize int) ([][]byte, error) {
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, ErrInvalidData
+	}
+
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nalus, ErrInvalidData
+		}
+		n := 0
+		for i := 0; i < lengthSize; i++ {
+			n = n<<8 | int(data[i])
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return nalus, ErrInvalidData
+		}
+		if n > 0 {
+			nalus = append(nalus, data[:n])
+		}
+		data = data[n:]
+	}
+	return nalus, nil
+}
+
+// SplitAnnexB splits the NAL units of an access unit in the Annex-B format, each
+// prefixed by a start code of 3 or 4 bytes.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+
+		if start >= 0 {
+			nalus = appendNALU(nalus, data[start:i])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendNALU appends a NAL unit split from an Annex-B stream, without the trailing
+// zeros, part of the next start code.
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) > 0 {
+		nalus = append(nalus, nalu)
+	}
+	return nalus
+}
+
+// AppendAVCC appends NAL units in the AVCC format, prefixed by a length of 4 bytes.
+func AppendAVCC(dst []byte, nalus ...[]byte) []byte {
+	var length [4]byte
+	for _, nalu := range nalus {
+		binary.BigEndian.PutUint32(length[:], uint32(len(nalu)))
+		dst = append(append(dst, length[:]...), nalu...)
+	}
+	return dst
+}
+
+// AppendAnnexB appends NAL units in the Annex-B format, prefixed by a start code of 4
+// bytes.
+func AppendAnnexB(dst []byte, nalus ...[]byte) []byte {
+	for _, nalu := range nalus {
+		dst = append(append(dst, 0x00, 0x00, 0x00, 0x01), nalu...)
+	}
+	return dst
+}
+
+// AnnexBToAVCC converts an access unit from the Annex-B format to the AVCC format, with
+// lengths of 4 bytes.
+func AnnexBToAVCC(data []byte) []byte {
+	return AppendAVCC(nil, SplitAnnexB(data)...)
+}
+
+// AVCCToAnnexB converts an access unit from the AVCC format to the Annex-B format.
+func AVCCToAnnexB(data []byte, lengthSize int) ([]byte, error) {
+	nalus, err := SplitAVCC(data, lengthSize)
+	if err != nil {
+		return nil, err
+	}
+	return AppendAnnexB(nil, nalus...), nil
+}
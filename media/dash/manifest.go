@@ -0,0 +1,113 @@
+package dash
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/numb3r3/live-go/media/fmp4"
+)
+
+// The format of the times of the manifest.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Manifest returns the dynamic MPD of the window, with the URLs of the segments
+// relative to the manifest, "<app>/<stream>.mpd", and carrying a query, if any, such
+// as the parameters authorizing the player.
+func (s *Segmenter) Manifest(query string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.manifest(s.key[strings.LastIndexByte(s.key, '/')+1:]+"/", query)
+}
+
+// manifest returns the MPD of the window, with the URLs of the segments relative to a
+// base and followed by a query. Each track is an adaptation set whose segments are addressed by their time,
+// so a track missing from a segment is not a gap in the numbering.
+func (s *Segmenter) manifest(base, query string) string {
+	window := time.Duration(s.opts.WindowSize) * s.opts.TargetDuration
+	now := time.Now().UTC()
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`)
+	fmt.Fprintf(&b, ` availabilityStartTime="%s" publishTime="%s"`, s.start.UTC().Format(timeFormat), now.Format(timeFormat))
+	if s.ended {
+		var end time.Duration
+		if n := len(s.segments); n > 0 {
+			end = s.segments[n-1].start + s.segments[n-1].duration
+		}
+		fmt.Fprintf(&b, ` mediaPresentationDuration="%s"`, duration(end))
+	} else {
+		fmt.Fprintf(&b, ` minimumUpdatePeriod="%s"`, duration(s.opts.TargetDuration))
+	}
+	fmt.Fprintf(&b, ` minBufferTime="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">`+"\n",
+		duration(s.opts.TargetDuration), duration(window), duration(3*s.opts.TargetDuration))
+
+	fmt.Fprintf(&b, `  <Period id="%d" start="PT0S">`+"\n", s.period)
+	for i, t := range []*fmp4.Track{s.video, s.audio} {
+		if t != nil {
+			s.writeAdaptationSet(&b, base, query, i, t)
+		}
+	}
+	b.WriteString("  </Period>\n")
+
+	// The players synchronize their clock to the server, as the segments are available
+	// from the start of the stream, in its wall clock time
+	fmt.Fprintf(&b, `  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", now.Format(timeFormat))
+	b.WriteString("</MPD>\n")
+	return b.String()
+}
+
+// writeAdaptationSet writes the adaptation set of a track, with its segment timeline.
+func (s *Segmenter) writeAdaptationSet(b *strings.Builder, base, query string, id int, t *fmp4.Track) {
+	codecs, _ := t.Codecs()
+	name := trackName(t)
+
+	// The bandwidth is measured over the window, for want of a better estimate
+	var size, total uint64
+	var timeline strings.Builder
+	for _, seg := range s.segments {
+		ts := seg.audio
+		if t.IsVideo() {
+			ts = seg.video
+		}
+		if ts != nil {
+			fmt.Fprintf(&timeline, `          <S t="%d" d="%d"/>`+"\n", ts.time, ts.duration)
+			size += uint64(ts.size)
+			total += ts.duration
+		}
+	}
+	bandwidth := uint64(1)
+	if total > 0 {
+		bandwidth = size * 8 * uint64(t.Timescale) / total
+	}
+
+	// The tracks are named as their content types
+	fmt.Fprintf(b, `    <AdaptationSet id="%d" contentType="%s" mimeType="%s/mp4" segmentAlignment="true" startWithSAP="1">`+"\n",
+		id, name, name)
+	// The identifiers of the template are escaped in the query, as "$$"
+	query = html.EscapeString(strings.Replace(query, "$", "$$", -1))
+	fmt.Fprintf(b, `      <SegmentTemplate timescale="%d" initialization="%s%s%s" media="%s%s-$Time$.m4s%s">`+"\n",
+		t.Timescale, base, initName(s.period, t), query, base, name, query)
+	fmt.Fprintf(b, "        <SegmentTimeline>\n%s        </SegmentTimeline>\n", timeline.String())
+	b.WriteString("      </SegmentTemplate>\n")
+
+	fmt.Fprintf(b, `      <Representation id="%s" codecs="%s" bandwidth="%d"`, name, codecs, bandwidth)
+	if t.IsVideo() {
+		if t.Width > 0 && t.Height > 0 {
+			fmt.Fprintf(b, ` width="%d" height="%d"`, t.Width, t.Height)
+		}
+		b.WriteString("/>\n")
+	} else {
+		fmt.Fprintf(b, ` audioSamplingRate="%d">`+"\n", t.SampleRate)
+		fmt.Fprintf(b, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n", t.Channels)
+		b.WriteString("      </Representation>\n")
+	}
+	b.WriteString("    </AdaptationSet>\n")
+}
+
+// duration formats a duration of the manifest.
+func duration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
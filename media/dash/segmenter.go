@@ -0,0 +1,425 @@
+package dash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/codec"
+	"github.com/numb3r3/live-go/media/fmp4"
+)
+
+// errNotFound is returned when a file of a stream is missing.
+var errNotFound = errors.New("dash: file not found")
+
+const (
+	segmenterQueueSize = 4096
+	maxTimestampJump   = 10 * time.Second // A larger jump of the timestamps is a discontinuity.
+	videoTimescale     = 90000
+	aacFrameSamples    = 1024                   // The number of samples of an AAC frame.
+	maxAudioDrift      = 100 * time.Millisecond // A larger gap of the audio is kept in its timeline.
+)
+
+// trackSegment represents the media segment of a track.
+type trackSegment struct {
+	time     uint64 // The decoding time of the first sample, in the timescale of the track.
+	duration uint64
+	size     int
+}
+
+// segment represents a segment of the window, with the media segments of its tracks
+// over the same time range. A track may have no media segment.
+type segment struct {
+	start    time.Duration // The position of the segment in the stream.
+	duration time.Duration
+	video    *trackSegment
+	audio    *trackSegment
+}
+
+// Segmenter represents the DASH output of a stream. Attached as a player, it muxes the
+// video and audio frames of the stream into fragmented MP4 segments, one per track,
+// cut on the keyframes, and keeps a sliding window of them in its manifest.
+type Segmenter struct {
+	sync.Mutex
+	key       string
+	stream    *media.Stream
+	opts      Options
+	queue     *media.Queue
+	onEnd     func(*Segmenter)
+	video     *fmp4.Track
+	audio     *fmp4.Track
+	period    int               // The period of the tracks, incremented when they change.
+	files     map[string][]byte // The initialization and media segments, by name.
+	segments  []*segment        // The complete segments of the window.
+	expired   []*segment        // The segments out of the window, not yet removed.
+	current   *segment          // The segment being muxed, nil until the first keyframe.
+	fragments [2]*fmp4.Fragment // The video and audio samples of the current segment.
+	lastDTS   [2]uint64         // The decoding times of their last samples.
+	seq       uint32            // The sequence number of the last fragment.
+	start     time.Time         // The wall clock time of the start of the stream.
+	offset    int64             // The position of a packet is its timestamp plus the offset, in milliseconds.
+	lastTS    uint32            // The timestamp of the last reference packet.
+	lastDelta int64             // The last difference of the timestamps of the reference packets.
+	hasLast   bool
+	audioNext uint64 // The decoding time following the last audio segment.
+	changed   bool   // Whether the tracks changed, which requires a new period.
+	ended     bool
+}
+
+// newSegmenter creates a new segmenter of a stream.
+func newSegmenter(stream *media.Stream, opts Options, onEnd func(*Segmenter)) *Segmenter {
+	return &Segmenter{
+		key:    stream.Key(),
+		stream: stream,
+		opts:   opts,
+		queue:  media.NewQueue(segmenterQueueSize),
+		onEnd:  onEnd,
+		files:  make(map[string][]byte),
+	}
+}
+
+// ID returns the identifier of the segmenter, as a player.
+func (s *Segmenter) ID() string {
+	return "dash"
+}
+
+// WritePacket queues a packet of the stream, without blocking.
+func (s *Segmenter) WritePacket(p *media.Packet) error {
+	return s.queue.Push(p)
+}
+
+// Close ends the segmenting, once the queued packets are muxed.
+func (s *Segmenter) Close() error {
+	return s.queue.Close()
+}
+
+// run muxes the queued packets until the segmenter is closed.
+func (s *Segmenter) run() {
+	for {
+		packets, ok := s.queue.Pop()
+		if !ok {
+			break
+		}
+
+		s.Lock()
+		for _, p := range packets {
+			if err := s.write(p); err != nil {
+				logging.Error("dash: unable to segment", s.key, err)
+			}
+		}
+		s.Unlock()
+	}
+
+	s.Lock()
+	if s.current != nil {
+		s.endSegment(s.position(s.lastTS) + time.Duration(s.lastDelta)*time.Millisecond)
+	}
+	s.ended = true
+	s.Unlock()
+	s.onEnd(s)
+}
+
+// write muxes a packet.
+func (s *Segmenter) write(p *media.Packet) error {
+	switch {
+	case p.Type == media.PacketMetadata:
+		return nil
+	case p.IsSequenceHeader():
+		return s.configure(p)
+	case p.Type == media.PacketVideo && (s.video == nil || len(p.Data) < 5 || p.Data[1] != 1):
+		return nil
+	case p.Type == media.PacketAudio && (s.audio == nil || p.AudioCodec() != media.CodecAAC || len(p.Data) < 3):
+		return nil
+	}
+
+	// The positions follow the video, or the audio if there is no video, and remain
+	// continuous over the jumps of its timestamps
+	video := p.Type == media.PacketVideo
+	reference := video || s.video == nil
+	if reference {
+		s.advance(p.Timestamp)
+	}
+	position := s.position(p.Timestamp)
+
+	cut := reference && (s.video == nil || p.IsKeyframe())
+	switch {
+	case s.current == nil && !cut:
+		return nil
+	case s.current == nil:
+		s.startSegment(position)
+	case cut && (position-s.current.start >= s.opts.TargetDuration || s.changed):
+		s.endSegment(position)
+		s.startSegment(position)
+	}
+
+	if video {
+		// The composition time offset is a signed 24 bits integer
+		cts := int32(uint32(p.Data[2])<<16|uint32(p.Data[3])<<8|uint32(p.Data[4])) << 8 >> 8
+		s.addSample(0, uint64(position)*videoTimescale/uint64(time.Second), fmp4.Sample{
+			CompositionOffset: cts * (videoTimescale / 1000),
+			Keyframe:          p.IsKeyframe(),
+			Data:              p.Data[5:],
+		})
+		return nil
+	}
+
+	// The audio segments follow each other, unless the audio has a gap, as they are not
+	// cut on the same timestamps as the video
+	dts := uint64(position) * uint64(s.audio.Timescale) / uint64(time.Second)
+	if f := s.fragments[1]; len(f.Samples) == 0 && s.audioNext > 0 {
+		drift := time.Duration(int64(dts)-int64(s.audioNext)) * time.Second / time.Duration(s.audio.Timescale)
+		if drift > -maxAudioDrift && drift < maxAudioDrift {
+			dts = s.audioNext
+		}
+	}
+	s.addSample(1, dts, fmp4.Sample{
+		Keyframe: true,
+		Data:     p.Data[2:],
+	})
+	return nil
+}
+
+// advance moves the position of the stream to the timestamp of a reference packet. On
+// a jump, it resumes after the last packet, or at the wall clock time if later, as
+// when a publisher resumes a stream.
+func (s *Segmenter) advance(ts uint32) {
+	switch delta := int64(ts) - int64(s.lastTS); {
+	case !s.hasLast:
+		s.offset = -int64(ts)
+		s.start = time.Now()
+	case delta < 0 || delta > int64(maxTimestampJump/time.Millisecond):
+		next := int64(s.lastTS) + s.offset + s.lastDelta
+		if now := int64(time.Since(s.start) / time.Millisecond); now > next {
+			next = now
+		}
+		s.offset = next - int64(ts)
+	default:
+		s.lastDelta = delta
+	}
+	s.lastTS, s.hasLast = ts, true
+}
+
+// position returns the position of a timestamp in the stream, never negative.
+func (s *Segmenter) position(ts uint32) time.Duration {
+	if ms := int64(ts) + s.offset; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
+// addSample adds a sample to the video or audio fragment, which sets the duration of
+// the previous sample from their decoding times.
+func (s *Segmenter) addSample(track int, dts uint64, sample fmp4.Sample) {
+	f := s.fragments[track]
+	if len(f.Samples) == 0 {
+		f.BaseTime = dts
+	} else {
+		s.setLastDuration(track, dts)
+	}
+	f.Samples = append(f.Samples, sample)
+	s.lastDTS[track] = dts
+}
+
+// setLastDuration sets the duration of the last sample of the video or audio fragment,
+// up to a decoding time if known and later, or as the previous sample.
+func (s *Segmenter) setLastDuration(track int, to uint64) {
+	f := s.fragments[track]
+	n := len(f.Samples)
+	switch from := s.lastDTS[track]; {
+	case to > from:
+		f.Samples[n-1].Duration = uint32(to - from)
+	case n > 1:
+		f.Samples[n-1].Duration = f.Samples[n-2].Duration
+	case track == 0:
+		f.Samples[n-1].Duration = videoTimescale / 25
+	default:
+		f.Samples[n-1].Duration = aacFrameSamples
+	}
+}
+
+// configure sets the track of a sequence header, which starts a new period if the
+// decoder configuration changes.
+func (s *Segmenter) configure(p *media.Packet) error {
+	switch {
+	case p.Type == media.PacketVideo && len(p.Data) > 5:
+		name := fmp4.CodecAVC
+		if p.VideoCodec() == media.CodecHEVC {
+			name = fmp4.CodecHEVC
+		}
+		if s.video != nil && s.video.Codec == name && bytes.Equal(s.video.Config, p.Data[5:]) {
+			return nil
+		}
+
+		track := &fmp4.Track{ID: 1, Codec: name, Timescale: videoTimescale, Config: p.Data[5:]}
+		if _, err := track.Codecs(); err != nil {
+			return err
+		}
+
+		// The dimensions are informative, so a parameter set not understood is no error
+		if info, err := p.VideoInfo(); err == nil {
+			track.Width, track.Height = uint16(info.Width), uint16(info.Height)
+		}
+		s.changed = s.changed || s.segmenting()
+		s.video = track
+
+	case p.Type == media.PacketAudio && len(p.Data) > 2:
+		if s.audio != nil && bytes.Equal(s.audio.Config, p.Data[2:]) {
+			return nil
+		}
+
+		// The timescale is the sample rate of the core, as the frames of the extensions
+		// have twice its samples
+		config, err := codec.ParseAudioSpecificConfig(p.Data[2:])
+		if err != nil {
+			return err
+		}
+		s.changed = s.changed || s.segmenting()
+		s.audio = &fmp4.Track{
+			ID:         2,
+			Codec:      fmp4.CodecAAC,
+			Timescale:  uint32(config.SampleRate),
+			Config:     p.Data[2:],
+			SampleRate: uint32(config.SampleRate),
+			Channels:   uint16(config.Channels),
+		}
+		s.audioNext = 0
+	}
+	return nil
+}
+
+// segmenting returns whether the segmenting started, so a change of the tracks requires
+// a new period.
+func (s *Segmenter) segmenting() bool {
+	return s.current != nil || len(s.segments) > 0
+}
+
+// startSegment starts a new segment, along with a new period if the tracks changed.
+func (s *Segmenter) startSegment(position time.Duration) {
+	if s.changed {
+		for _, t := range []*fmp4.Track{s.video, s.audio} {
+			if t != nil {
+				delete(s.files, initName(s.period, t))
+			}
+		}
+		s.period++
+		s.expired = append(s.expired, s.segments...)
+		s.segments = nil
+		s.changed = false
+	}
+	s.storeInit()
+
+	s.current = &segment{start: position}
+	s.fragments = [2]*fmp4.Fragment{{Track: s.video}, {Track: s.audio}}
+}
+
+// storeInit stores the initialization segments of the tracks of the period, unless
+// they are already.
+func (s *Segmenter) storeInit() {
+	for _, t := range []*fmp4.Track{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+		if _, ok := s.files[initName(s.period, t)]; ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := fmp4.WriteInit(&buf, t); err != nil {
+			logging.Error("dash: unable to mux the initialization segment of", s.key, err)
+			continue
+		}
+		s.files[initName(s.period, t)] = buf.Bytes()
+	}
+}
+
+// endSegment completes the current segment at a position, stores its media segments
+// and slides the window.
+func (s *Segmenter) endSegment(position time.Duration) {
+	seg := s.current
+	seg.duration = position - seg.start
+	s.current = nil
+
+	for i, f := range s.fragments {
+		if f.Track == nil || len(f.Samples) == 0 {
+			continue
+		}
+
+		// The last video sample lasts up to the end of the segment, the last audio one as
+		// the previous one
+		if i == 0 {
+			s.setLastDuration(i, uint64(position)*videoTimescale/uint64(time.Second))
+		} else {
+			s.setLastDuration(i, 0)
+		}
+
+		var buf bytes.Buffer
+		s.seq++
+		if err := fmp4.WriteFragment(&buf, s.seq, f); err != nil {
+			logging.Error("dash: unable to mux a segment of", s.key, err)
+			continue
+		}
+
+		ts := &trackSegment{time: f.BaseTime, size: buf.Len()}
+		for _, sample := range f.Samples {
+			ts.duration += uint64(sample.Duration)
+		}
+		s.files[mediaName(trackName(f.Track), ts.time)] = buf.Bytes()
+		if i == 1 {
+			s.audioNext = ts.time + ts.duration
+		}
+		if i == 0 {
+			seg.video = ts
+		} else {
+			seg.audio = ts
+		}
+	}
+
+	// The segments out of the window remain available for as long, for the players
+	// which loaded the manifest before
+	s.segments = append(s.segments, seg)
+	for len(s.segments) > s.opts.WindowSize {
+		s.expired = append(s.expired, s.segments[0])
+		s.segments = s.segments[1:]
+	}
+	for len(s.expired) > s.opts.WindowSize {
+		if seg := s.expired[0]; seg.video != nil {
+			delete(s.files, mediaName("video", seg.video.time))
+		}
+		if seg := s.expired[0]; seg.audio != nil {
+			delete(s.files, mediaName("audio", seg.audio.time))
+		}
+		s.expired = s.expired[1:]
+	}
+}
+
+// initName returns the name of the initialization segment of a track in a period.
+func initName(period int, t *fmp4.Track) string {
+	return fmt.Sprintf("%d-%s.mp4", period, trackName(t))
+}
+
+// mediaName returns the name of a media segment of a track, by its decoding time.
+func mediaName(track string, time uint64) string {
+	return fmt.Sprintf("%s-%d.m4s", track, time)
+}
+
+// trackName returns the name of a track in the files and the manifest.
+func trackName(t *fmp4.Track) string {
+	if t.IsVideo() {
+		return "video"
+	}
+	return "audio"
+}
+
+// File returns the bytes of an initialization or media segment.
+func (s *Segmenter) File(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if data, ok := s.files[name]; ok {
+		return data, nil
+	}
+	return nil, errNotFound
+}
@@ -0,0 +1,142 @@
+package dash
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+)
+
+// Options represents the options of the DASH output.
+type Options struct {
+	TargetDuration time.Duration // The minimum duration of the segments, cut on the keyframes.
+	WindowSize     int           // The number of segments listed by the manifests.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		TargetDuration: 2 * time.Second,
+		WindowSize:     6,
+	}
+}
+
+// Server represents the DASH output of the live streams, which segments the streams of
+// a registry and serves their manifests and segments, under "<prefix><app>/<stream>".
+type Server struct {
+	sync.Mutex
+	opts       Options
+	prefix     string
+	segmenters map[string]*Segmenter
+}
+
+// NewServer creates a new DASH server, serving the requests under a path prefix.
+func NewServer(prefix string, opts Options) *Server {
+	return &Server{
+		opts:       opts,
+		prefix:     prefix,
+		segmenters: make(map[string]*Segmenter),
+	}
+}
+
+// Publish starts segmenting a stream, unless it is already, as when its publisher
+// resumes it. A stream published again after ending replaces its previous segments.
+func (s *Server) Publish(stream *media.Stream) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := stream.Key()
+	if prev, ok := s.segmenters[key]; ok {
+		if prev.stream == stream {
+			return nil
+		}
+		prev.Close()
+	}
+
+	seg := newSegmenter(stream, s.opts, s.onEnd)
+	if err := stream.Attach(seg); err != nil {
+		return err
+	}
+	s.segmenters[key] = seg
+	go seg.run()
+	return nil
+}
+
+// onEnd removes the segments of an ended stream, once the players had the time to
+// play its window.
+func (s *Server) onEnd(seg *Segmenter) {
+	delay := time.Duration(s.opts.WindowSize) * s.opts.TargetDuration
+	time.AfterFunc(delay, func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.segmenters[seg.key] == seg {
+			delete(s.segmenters, seg.key)
+			logging.Info("dash: removed the segments of", seg.key)
+		}
+	})
+}
+
+// Get returns the segmenter of a stream.
+func (s *Server) Get(key string) (*Segmenter, bool) {
+	s.Lock()
+	defer s.Unlock()
+	seg, ok := s.segmenters[key]
+	return seg, ok
+}
+
+// ServeHTTP serves the manifests, at "<app>/<stream>.mpd", and the initialization and
+// media segments, at "<app>/<stream>/<name>".
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, s.prefix)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if strings.HasSuffix(path, ".mpd") {
+		seg, ok := s.Get(strings.TrimSuffix(path, ".mpd"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The parameters, such as a signature, are carried over to the segments
+		var query string
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.Query().Encode()
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(seg.Manifest(query)))
+		return
+	}
+
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	seg, ok := s.Get(path[:i])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := seg.File(path[i+1:])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".m4s"):
+		w.Header().Set("Content-Type", "video/iso.segment")
+	default:
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(data)
+}
@@ -0,0 +1,70 @@
+package flv
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/numb3r3/live-go/media"
+)
+
+const (
+	headerSize    = 9
+	tagHeaderSize = 11
+)
+
+// The flags of the FLV header, telling which tracks the file has.
+const (
+	flagVideo = 0x01
+	flagAudio = 0x04
+)
+
+// Writer represents a muxer of packets into an FLV file or live stream.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter creates a new FLV muxer writing to w. Every tag is written in a single
+// call, so a writer sending each write as a message delivers whole tags.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader writes the FLV header, along with the size of the non-existent tag
+// preceding the first one.
+func (w *Writer) WriteHeader(audio, video bool) error {
+	header := []byte{'F', 'L', 'V', 1, 0, 0, 0, 0, headerSize, 0, 0, 0, 0}
+	if audio {
+		header[4] |= flagAudio
+	}
+	if video {
+		header[4] |= flagVideo
+	}
+	_, err := w.w.Write(header)
+	return err
+}
+
+// WritePacket writes a packet as a tag, followed by the size of the tag.
+func (w *Writer) WritePacket(p *media.Packet) error {
+	size := tagHeaderSize + len(p.Data)
+	if cap(w.buf) < size+4 {
+		w.buf = make([]byte, size+4)
+	}
+	buf := w.buf[:size+4]
+
+	// The timestamp is 24 bits long, followed by its upper 8 bits
+	buf[0] = byte(p.Type)
+	putUint24(buf[1:], uint32(len(p.Data)))
+	putUint24(buf[4:], p.Timestamp&0xffffff)
+	buf[7] = byte(p.Timestamp >> 24)
+	putUint24(buf[8:], 0) // The stream id, always zero
+	copy(buf[tagHeaderSize:], p.Data)
+	binary.BigEndian.PutUint32(buf[size:], uint32(size))
+
+	_, err := w.w.Write(buf)
+	return err
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
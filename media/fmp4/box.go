@@ -0,0 +1,92 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// box returns an ISO BMFF box of a type, with the concatenation of its payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox returns a box with a version and flags.
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// fields represents the encoding of a sequence of big-endian fields, each appended by
+// the method of its type.
+type fields []byte
+
+func (f fields) u8(v uint8) fields {
+	return append(f, v)
+}
+
+func (f fields) u16(v uint16) fields {
+	return append(f, byte(v>>8), byte(v))
+}
+
+func (f fields) u32(v uint32) fields {
+	return append(f, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (f fields) i32(v int32) fields {
+	return f.u32(uint32(v))
+}
+
+func (f fields) u64(v uint64) fields {
+	return append(f, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (f fields) bytes(v []byte) fields {
+	return append(f, v...)
+}
+
+func (f fields) str(v string) fields {
+	return append(f, v...)
+}
+
+// zeros appends a number of zero bytes, the reserved fields.
+func (f fields) zeros(n int) fields {
+	return append(f, make([]byte, n)...)
+}
+
+// descriptor returns an MPEG-4 descriptor of the elementary stream descriptor box, its
+// size encoded on 7 bits per byte.
+func descriptor(tag uint8, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := []byte{tag}
+	for shift := 21; shift > 0; shift -= 7 {
+		if size >= 1<<uint(shift) {
+			b = append(b, byte(size>>uint(shift))&0x7f|0x80)
+		}
+	}
+	b = append(b, byte(size)&0x7f)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// The unity transformation matrix of the movie and track headers.
+var matrix = fields{}.
+	u32(0x00010000).u32(0).u32(0).
+	u32(0).u32(0x00010000).u32(0).
+	u32(0).u32(0).u32(0x40000000)
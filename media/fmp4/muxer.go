@@ -0,0 +1,98 @@
+package fmp4
+
+import (
+	"io"
+)
+
+// The flags of the samples.
+const (
+	flagsSync    = 0x02000000 // The sample does not depend on others.
+	flagsNonSync = 0x01010000 // The sample depends on others, and is not a sync sample.
+)
+
+// Sample represents a sample of a track: a video access unit, with its NAL units
+// prefixed by their length, or a raw audio frame.
+type Sample struct {
+	Duration          uint32 // The duration, in the timescale of the track.
+	CompositionOffset int32  // The presentation time minus the decoding time.
+	Keyframe          bool   // Whether the sample is a sync sample, always for the audio.
+	Data              []byte
+}
+
+// Fragment represents the samples of a track in a fragment.
+type Fragment struct {
+	Track    *Track
+	BaseTime uint64 // The decoding time of the first sample, in the timescale of the track.
+	Samples  []Sample
+}
+
+// WriteInit writes the initialization segment of a stream, describing its tracks. The
+// timestamps of the movie are in milliseconds.
+func WriteInit(w io.Writer, tracks ...*Track) error {
+	ftyp := box("ftyp", fields{}.str("iso5").u32(512).str("iso5").str("iso6").str("mp41"))
+
+	var nextID uint32 = 1
+	traks := make([][]byte, 0, len(tracks))
+	trexs := make([][]byte, 0, len(tracks))
+	for _, t := range tracks {
+		if t.ID >= nextID {
+			nextID = t.ID + 1
+		}
+		traks = append(traks, t.trak())
+		trexs = append(trexs, fullBox("trex", 0, 0, fields{}.u32(t.ID).u32(1).u32(0).u32(0).u32(0)))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0, fields{}.
+		u32(0).u32(0).u32(1000).u32(0).        // The times, the timescale and the duration
+		u32(0x00010000).u16(0x0100).zeros(10). // The rate, volume and reserved bytes
+		bytes(matrix).zeros(24).u32(nextID),
+	)
+	moov := box("moov", append(append([][]byte{mvhd}, traks...), box("mvex", trexs...))...)
+
+	_, err := w.Write(append(ftyp, moov...))
+	return err
+}
+
+// WriteFragment writes a media segment of a single fragment, with the samples of one
+// or several tracks. The sequence number of the fragments starts at 1.
+func WriteFragment(w io.Writer, seq uint32, fragments ...*Fragment) error {
+	// The offsets of the samples are relative to the fragment, so they depend on the size
+	// of its header, which does not
+	moof := buildMoof(seq, fragments, 0)
+	moof = buildMoof(seq, fragments, len(moof)+8)
+
+	var data [][]byte
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			data = append(data, s.Data)
+		}
+	}
+
+	_, err := w.Write(append(moof, box("mdat", data...)...))
+	return err
+}
+
+// buildMoof returns the movie fragment box, the samples of the tracks being stored in
+// order from an offset.
+func buildMoof(seq uint32, fragments []*Fragment, offset int) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, fields{}.u32(seq))}
+	for _, f := range fragments {
+		// The sample duration, size, flags and composition time offset are all present
+		run := fields{}.u32(uint32(len(f.Samples))).i32(int32(offset))
+		for _, s := range f.Samples {
+			flags := uint32(flagsSync)
+			if f.Track.IsVideo() && !s.Keyframe {
+				flags = flagsNonSync
+			}
+			run = run.u32(s.Duration).u32(uint32(len(s.Data))).u32(flags).i32(s.CompositionOffset)
+			offset += len(s.Data)
+		}
+
+		trafs = append(trafs, box("traf",
+			fullBox("tfhd", 0, 0x020000, fields{}.u32(f.Track.ID)), // The base is the fragment
+			fullBox("tfdt", 1, 0, fields{}.u64(f.BaseTime)),
+			fullBox("trun", 1, 0x000f01, run),
+		))
+	}
+	return box("moof", trafs...)
+}
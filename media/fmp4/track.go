@@ -0,0 +1,129 @@
+package fmp4
+
+import (
+	"errors"
+
+	"github.com/numb3r3/live-go/media/codec"
+)
+
+// ErrInvalidConfig is returned when the decoder configuration of a track can not be
+// parsed.
+var ErrInvalidConfig = errors.New("fmp4: invalid decoder configuration")
+
+// The codecs of the tracks, named as their sample entries.
+const (
+	CodecAVC  = "avc1"
+	CodecHEVC = "hvc1"
+	CodecAAC  = "mp4a"
+)
+
+// Track represents a video or audio track of a fragmented MP4 stream.
+type Track struct {
+	ID         uint32 // The track identifier, from 1.
+	Codec      string // The codec, as the type of the sample entry.
+	Timescale  uint32 // The number of time units per second of the timestamps.
+	Config     []byte // The AVCDecoderConfigurationRecord, HEVCDecoderConfigurationRecord or AudioSpecificConfig.
+	Width      uint16 // The width of the video, informative only.
+	Height     uint16 // The height of the video, informative only.
+	SampleRate uint32 // The sample rate of the audio.
+	Channels   uint16 // The number of channels of the audio.
+}
+
+// IsVideo returns whether the track is a video track.
+func (t *Track) IsVideo() bool {
+	return t.Codec != CodecAAC
+}
+
+// Codecs returns the codecs parameter of the track, as defined by RFC 6381, such as
+// "avc1.64001f" or "mp4a.40.2".
+func (t *Track) Codecs() (string, error) {
+	switch t.Codec {
+	case CodecAVC:
+		c, err := codec.ParseAVCConfig(t.Config)
+		if err != nil {
+			return "", ErrInvalidConfig
+		}
+		return c.Codecs(), nil
+
+	case CodecHEVC:
+		c, err := codec.ParseHEVCConfig(t.Config)
+		if err != nil {
+			return "", ErrInvalidConfig
+		}
+		return c.Codecs(), nil
+
+	case CodecAAC:
+		c, err := codec.ParseAudioSpecificConfig(t.Config)
+		if err != nil {
+			return "", ErrInvalidConfig
+		}
+		return c.Codecs(), nil
+	}
+	return "", ErrInvalidConfig
+}
+
+// sampleEntry returns the sample entry of the track, describing its samples.
+func (t *Track) sampleEntry() []byte {
+	if t.IsVideo() {
+		configType := "avcC"
+		if t.Codec == CodecHEVC {
+			configType = "hvcC"
+		}
+		return box(t.Codec, fields{}.
+			zeros(6).u16(1). // The reserved bytes and the data reference index
+			zeros(16).       // The pre-defined and reserved fields
+			u16(t.Width).u16(t.Height).
+			u32(0x00480000).u32(0x00480000). // The resolution, 72 dpi
+			u32(0).u16(1).                   // The reserved field and the frame count
+			zeros(32).                       // The compressor name
+			u16(0x0018).u16(0xffff),
+			box(configType, t.Config))
+	}
+
+	// The elementary stream descriptor, wrapping the AudioSpecificConfig
+	esds := fullBox("esds", 0, 0, descriptor(0x03,
+		fields{}.u16(uint16(t.ID)).u8(0),
+		descriptor(0x04,
+			fields{}.u8(0x40).u8(0x15).zeros(3).u32(0).u32(0),
+			descriptor(0x05, t.Config),
+		),
+		descriptor(0x06, []byte{0x02}),
+	))
+	return box(t.Codec, fields{}.
+		zeros(6).u16(1).         // The reserved bytes and the data reference index
+		zeros(8).                // The reserved fields
+		u16(t.Channels).u16(16). // The channel count and the sample size
+		u32(0).u32(t.SampleRate<<16),
+		esds)
+}
+
+// trak returns the track box, without any sample as they are in the fragments.
+func (t *Track) trak() []byte {
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, make([]byte, 8))
+	if !t.IsVideo() {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	// The track is enabled and in the movie
+	tkhd := fullBox("tkhd", 0, 0x000003, fields{}.
+		u32(0).u32(0).u32(t.ID).u32(0).u32(0). // The times, the identifier and the duration
+		zeros(8).u16(0).u16(0).u16(volume).u16(0).
+		bytes(matrix).u32(uint32(t.Width)<<16).u32(uint32(t.Height)<<16),
+	)
+	mdhd := fullBox("mdhd", 0, 0, fields{}.
+		u32(0).u32(0).u32(t.Timescale).u32(0).
+		u16(0x55c4).u16(0), // The undetermined language
+	)
+	hdlr := fullBox("hdlr", 0, 0, fields{}.u32(0).str(handler).zeros(12).str(name).u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, fields{}.u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, fields{}.u32(1), t.sampleEntry()),
+		fullBox("stts", 0, 0, fields{}.u32(0)),
+		fullBox("stsc", 0, 0, fields{}.u32(0)),
+		fullBox("stsz", 0, 0, fields{}.u32(0).u32(0)),
+		fullBox("stco", 0, 0, fields{}.u32(0)),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
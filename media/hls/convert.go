@@ -0,0 +1,66 @@
+package hls
+
+import (
+	"github.com/numb3r3/live-go/media/codec"
+)
+
+// The access unit delimiter starting the H.264 access units.
+var accessUnitDelimiter = []byte{0x09, 0xf0}
+
+// avcConfig represents the decoder configuration of an H.264 stream, along with the
+// sequence header it was parsed from.
+type avcConfig struct {
+	*codec.AVCConfig
+	record []byte
+}
+
+// parseAVCConfig parses an AVCDecoderConfigurationRecord.
+func parseAVCConfig(record []byte) (*avcConfig, error) {
+	c, err := codec.ParseAVCConfig(record)
+	if err != nil {
+		return nil, err
+	}
+	return &avcConfig{AVCConfig: c, record: record}, nil
+}
+
+// annexB converts the NAL units of a frame, prefixed by their length, to the Annex-B
+// format, prefixed by a start code. The access unit starts with a delimiter, and the
+// keyframes with the parameter sets.
+func (c *avcConfig) annexB(data []byte, keyframe bool) []byte {
+	buf := codec.AppendAnnexB(nil, accessUnitDelimiter)
+	if keyframe {
+		buf = codec.AppendAnnexB(buf, c.SPS...)
+		buf = codec.AppendAnnexB(buf, c.PPS...)
+	}
+
+	// The delimiters and parameter sets of the frame are replaced by ours, and the NAL
+	// units following a malformed length are dropped
+	nalus, _ := codec.SplitAVCC(data, c.LengthSize)
+	for _, nalu := range nalus {
+		if codec.AVCType(nalu) != codec.AVCAUD && (!keyframe || !codec.IsAVCParameterSet(nalu)) {
+			buf = codec.AppendAnnexB(buf, nalu)
+		}
+	}
+	return buf
+}
+
+// aacConfig represents the decoder configuration of an AAC stream, along with the
+// sequence header it was parsed from.
+type aacConfig struct {
+	*codec.AudioSpecificConfig
+	record []byte
+}
+
+// parseAACConfig parses an AudioSpecificConfig.
+func parseAACConfig(record []byte) (*aacConfig, error) {
+	c, err := codec.ParseAudioSpecificConfig(record)
+	if err != nil {
+		return nil, err
+	}
+	return &aacConfig{AudioSpecificConfig: c, record: record}, nil
+}
+
+// adts prefixes a raw AAC frame with an ADTS header.
+func (c *aacConfig) adts(frame []byte) []byte {
+	return append(c.ADTSHeader(len(frame)), frame...)
+}
@@ -0,0 +1,443 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/ts"
+)
+
+const (
+	segmenterQueueSize = 4096
+	playlistName       = "index.m3u8"
+	maxTimestampJump   = 10 * time.Second // A larger jump of the timestamps is a discontinuity.
+	llPartsSegments    = 3                // The number of complete segments whose parts are listed.
+)
+
+// segment represents a segment of the playlist.
+type segment struct {
+	seq           uint64
+	duration      time.Duration
+	discontinuity bool    // Whether the timestamps or the codecs changed from the previous one.
+	parts         []*part // The partial segments, for the low-latency playlists.
+}
+
+// part represents a partial segment, a range of the bytes of its segment.
+type part struct {
+	offset      int
+	size        int
+	duration    time.Duration
+	independent bool // Whether the part contains a keyframe.
+}
+
+// Segmenter represents the HLS output of a stream. Attached as a player, it muxes the
+// H.264 and AAC frames of the stream into MPEG-TS segments cut on the keyframes, and
+// keeps a sliding window of them in its playlist.
+type Segmenter struct {
+	sync.Mutex
+	key      string
+	stream   *media.Stream
+	opts     Options
+	store    storage
+	queue    *media.Queue
+	onEnd    func(*Segmenter)
+	avc      *avcConfig
+	aac      *aacConfig
+	muxer    *ts.Muxer
+	segments []*segment    // The complete segments of the window.
+	expired  []uint64      // The segments out of the window, not yet removed.
+	current  *segment      // The segment being muxed, nil until the first keyframe.
+	buf      *bytes.Buffer // The bytes of the current segment.
+	nextSeq  uint64
+	discSeq  uint64        // The number of discontinuities out of the window.
+	elapsed  time.Duration // The duration of the stream, accumulated between the frames.
+	segStart time.Duration // The elapsed duration at the start of the current segment.
+	partFrom time.Duration // The elapsed duration at the start of the current part.
+	partKey  bool          // Whether the current part contains a keyframe.
+	lastTS   uint32
+	hasLast  bool
+	discont  bool // Whether the next segment is a discontinuity.
+	changed  bool // Whether the codecs changed, which requires new tables.
+	ended    bool
+	updated  chan struct{} // Closed and replaced whenever the playlist changes.
+}
+
+// newSegmenter creates a new segmenter of a stream.
+func newSegmenter(stream *media.Stream, opts Options, store storage, onEnd func(*Segmenter)) *Segmenter {
+	return &Segmenter{
+		key:     stream.Key(),
+		stream:  stream,
+		opts:    opts,
+		store:   store,
+		queue:   media.NewQueue(segmenterQueueSize),
+		onEnd:   onEnd,
+		updated: make(chan struct{}),
+	}
+}
+
+// ID returns the identifier of the segmenter, as a player.
+func (s *Segmenter) ID() string {
+	return "hls"
+}
+
+// WritePacket queues a packet of the stream, without blocking.
+func (s *Segmenter) WritePacket(p *media.Packet) error {
+	return s.queue.Push(p)
+}
+
+// Close ends the segmenting, once the queued packets are muxed.
+func (s *Segmenter) Close() error {
+	return s.queue.Close()
+}
+
+// run muxes the queued packets until the segmenter is closed.
+func (s *Segmenter) run() {
+	for {
+		packets, ok := s.queue.Pop()
+		if !ok {
+			break
+		}
+
+		s.Lock()
+		for _, p := range packets {
+			if err := s.write(p); err != nil {
+				logging.Error("hls: unable to segment", s.key, err)
+			}
+		}
+		s.Unlock()
+	}
+
+	s.Lock()
+	if s.current != nil {
+		s.endSegment()
+	}
+	s.ended = true
+	s.notify()
+	s.Unlock()
+	s.onEnd(s)
+}
+
+// write muxes a packet.
+func (s *Segmenter) write(p *media.Packet) error {
+	switch {
+	case p.Type == media.PacketMetadata:
+		return nil
+	case p.IsSequenceHeader():
+		return s.configure(p)
+	case p.Type == media.PacketVideo && (s.avc == nil || p.VideoCodec() != media.CodecAVC || len(p.Data) < 5):
+		return nil
+	case p.Type == media.PacketAudio && (s.aac == nil || p.AudioCodec() != media.CodecAAC || len(p.Data) < 2):
+		return nil
+	}
+
+	// The durations are accumulated over the video, or over the audio if there is no
+	// video, a jump in its timestamps being a discontinuity
+	video := p.Type == media.PacketVideo
+	keyframe := p.IsKeyframe()
+	reference := video || s.avc == nil
+	if reference {
+		delta := time.Duration(int64(p.Timestamp)-int64(s.lastTS)) * time.Millisecond
+		switch {
+		case !s.hasLast:
+		case delta < 0 || delta > maxTimestampJump:
+			s.discont = true
+		default:
+			s.elapsed += delta
+		}
+		s.lastTS, s.hasLast = p.Timestamp, true
+	}
+
+	// The segments start on the keyframes, the parts on any frame
+	cut := reference && (s.avc == nil || keyframe)
+	switch {
+	case s.current == nil && !cut:
+		return nil
+	case s.current == nil:
+		s.startSegment()
+	case cut && (s.elapsed-s.segStart >= s.opts.TargetDuration || s.discont || s.changed):
+		s.endSegment()
+		s.startSegment()
+	case reference && s.opts.PartDuration > 0 && s.elapsed-s.partFrom >= s.opts.PartDuration:
+		s.endPart()
+	}
+
+	dts := uint64(p.Timestamp) * 90
+	if !video {
+		return s.muxer.WriteAudio(dts, s.aac.adts(p.Data[2:]))
+	}
+
+	// The composition time offset is a signed 24 bits integer
+	cts := int32(uint32(p.Data[2])<<16|uint32(p.Data[3])<<8|uint32(p.Data[4])) << 8 >> 8
+	pts := dts
+	if cts > 0 {
+		pts += uint64(cts) * 90
+	}
+	s.partKey = s.partKey || keyframe
+	return s.muxer.WriteVideo(pts, dts, keyframe, s.avc.annexB(p.Data[5:], keyframe))
+}
+
+// configure sets the decoder configuration of a track from its sequence header.
+func (s *Segmenter) configure(p *media.Packet) (err error) {
+	switch {
+	case p.Type == media.PacketVideo && p.VideoCodec() == media.CodecAVC && len(p.Data) > 5:
+		if s.avc == nil || !bytes.Equal(s.avc.record, p.Data[5:]) {
+			s.changed = s.changed || s.avc != nil
+			s.avc, err = parseAVCConfig(p.Data[5:])
+		}
+	case p.Type == media.PacketAudio && p.AudioCodec() == media.CodecAAC && len(p.Data) > 2:
+		if s.aac == nil || !bytes.Equal(s.aac.record, p.Data[2:]) {
+			s.changed = s.changed || s.aac != nil
+			s.aac, err = parseAACConfig(p.Data[2:])
+		}
+	}
+	return
+}
+
+// startSegment starts a new segment with the tables, as it must be decodable alone.
+func (s *Segmenter) startSegment() {
+	s.buf = new(bytes.Buffer)
+	if s.muxer == nil || s.changed {
+		var videoType, audioType uint8
+		if s.avc != nil {
+			videoType = ts.StreamH264
+		}
+		if s.aac != nil {
+			audioType = ts.StreamAAC
+		}
+		s.muxer = ts.NewMuxer(s.buf, videoType, audioType)
+		s.discont = s.discont || s.changed
+		s.changed = false
+	}
+
+	s.muxer.SetOutput(s.buf)
+	s.muxer.WriteTables()
+	s.current = &segment{seq: s.nextSeq, discontinuity: s.discont && s.nextSeq > 0}
+	s.nextSeq++
+	s.discont = false
+	s.segStart, s.partFrom, s.partKey = s.elapsed, s.elapsed, false
+}
+
+// endPart ends the current part of the current segment.
+func (s *Segmenter) endPart() {
+	offset := 0
+	if n := len(s.current.parts); n > 0 {
+		last := s.current.parts[n-1]
+		offset = last.offset + last.size
+	}
+	if s.buf.Len() == offset {
+		return
+	}
+
+	s.current.parts = append(s.current.parts, &part{
+		offset:      offset,
+		size:        s.buf.Len() - offset,
+		duration:    s.elapsed - s.partFrom,
+		independent: s.partKey,
+	})
+	s.partFrom, s.partKey = s.elapsed, false
+	s.notify()
+}
+
+// endSegment completes the current segment, stores it and slides the window.
+func (s *Segmenter) endSegment() {
+	if s.opts.PartDuration > 0 {
+		s.endPart()
+	}
+
+	seg := s.current
+	seg.duration = s.elapsed - s.segStart
+	s.current = nil
+	if err := s.store.Put(segmentName(seg.seq), s.buf.Bytes()); err != nil {
+		logging.Error("hls: unable to store a segment of", s.key, err)
+	}
+
+	// The segments out of the window remain available for as long, for the players
+	// which loaded the playlist before
+	s.segments = append(s.segments, seg)
+	for len(s.segments) > s.opts.WindowSize {
+		if s.segments[0].discontinuity {
+			s.discSeq++
+		}
+		s.expired = append(s.expired, s.segments[0].seq)
+		s.segments = s.segments[1:]
+	}
+	for s.opts.Cleanup && len(s.expired) > s.opts.WindowSize {
+		s.store.Remove(segmentName(s.expired[0]))
+		s.expired = s.expired[1:]
+	}
+
+	// The stored playlist is next to the segments, unlike the served one
+	if err := s.store.Put(playlistName, []byte(s.playlist("", ""))); err != nil {
+		logging.Error("hls: unable to store the playlist of", s.key, err)
+	}
+	s.notify()
+}
+
+// notify wakes up the requests waiting for the playlist to change.
+func (s *Segmenter) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// segmentName returns the name of a segment file.
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%d.ts", seq)
+}
+
+// partName returns the name of a partial segment file.
+func partName(seq uint64, index int) string {
+	return fmt.Sprintf("%d.%d.ts", seq, index)
+}
+
+// ------------------------------------------------------------------------------------
+
+// playlist returns the media playlist of the window, with the URIs of the segments
+// relative to a base and followed by a query, if any. The low-latency playlists also
+// list the parts of the last segments, along with the hint of the next part.
+func (s *Segmenter) playlist(base, query string) string {
+	lowLatency := s.opts.PartDuration > 0
+	target := s.opts.TargetDuration
+	for _, seg := range s.segments {
+		if seg.duration > target {
+			target = seg.duration
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		partTarget := s.opts.PartDuration.Seconds()
+		b.WriteString("#EXT-X-VERSION:9\n")
+		fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+		fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	}
+
+	first := s.nextSeq
+	if len(s.segments) > 0 {
+		first = s.segments[0].seq
+	} else if s.current != nil {
+		first = s.current.seq
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	if s.discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", s.discSeq)
+	}
+
+	for i, seg := range s.segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if lowLatency && i >= len(s.segments)-llPartsSegments {
+			writeParts(&b, base, query, seg)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s%s%s\n", seg.duration.Seconds(), base, segmentName(seg.seq), query)
+	}
+
+	switch {
+	case s.ended:
+		b.WriteString("#EXT-X-ENDLIST\n")
+	case lowLatency && s.current != nil:
+		if s.current.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		writeParts(&b, base, query, s.current)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s%s%s\"\n", base, partName(s.current.seq, len(s.current.parts)), query)
+	}
+	return b.String()
+}
+
+// writeParts writes the parts of a segment to a playlist.
+func writeParts(b *strings.Builder, base, query string, seg *segment) {
+	for i, p := range seg.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s%s%s\"", p.duration.Seconds(), base, partName(seg.seq, i), query)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// available returns whether a segment, or one of its parts if not negative, is
+// available.
+func (s *Segmenter) available(seq uint64, index int) bool {
+	if s.ended || s.current == nil || seq < s.current.seq {
+		return seq < s.nextSeq
+	}
+	return index >= 0 && seq == s.current.seq && index < len(s.current.parts)
+}
+
+// wait waits until a segment or one of its parts is available, up to a timeout. It is
+// called locked, and returns locked.
+func (s *Segmenter) wait(seq uint64, index int, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for !s.available(seq, index) {
+		updated := s.updated
+		s.Unlock()
+		select {
+		case <-updated:
+			s.Lock()
+		case <-deadline.C:
+			s.Lock()
+			return s.available(seq, index)
+		}
+	}
+	return true
+}
+
+// Playlist returns the playlist, the URIs of the segments carrying a query, such as the
+// parameters authorizing the player. A segment sequence number, and optionally a part
+// index, blocks until the segment or the part is available, as for the blocking
+// playlist reloads of the low-latency players.
+func (s *Segmenter) Playlist(seq uint64, index int, block bool, query string) string {
+	s.Lock()
+	defer s.Unlock()
+	if block {
+		s.wait(seq, index, 3*s.opts.TargetDuration)
+	}
+
+	// The segments are relative to the playlist, "<app>/<stream>.m3u8"
+	return s.playlist(s.key[strings.LastIndexByte(s.key, '/')+1:]+"/", query)
+}
+
+// Segment returns the bytes of a segment.
+func (s *Segmenter) Segment(seq uint64) ([]byte, error) {
+	return s.store.Get(segmentName(seq))
+}
+
+// Part returns the bytes of a part, waiting for it when it is the next one.
+func (s *Segmenter) Part(seq uint64, index int) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.wait(seq, index, 3*s.opts.PartDuration) {
+		return nil, errNotFound
+	}
+
+	// The part of the current segment is in the buffer, the others in the stored segments
+	if s.current != nil && seq == s.current.seq {
+		p := s.current.parts[index]
+		return append([]byte(nil), s.buf.Bytes()[p.offset:p.offset+p.size]...), nil
+	}
+	for _, seg := range s.segments {
+		if seg.seq == seq && index < len(seg.parts) {
+			data, err := s.store.Get(segmentName(seq))
+			if err != nil {
+				return nil, err
+			}
+			p := seg.parts[index]
+			return data[p.offset : p.offset+p.size], nil
+		}
+	}
+	return nil, errNotFound
+}
@@ -0,0 +1,195 @@
+package hls
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+)
+
+// Options represents the options of the HLS output.
+type Options struct {
+	TargetDuration time.Duration // The minimum duration of the segments, cut on the keyframes.
+	WindowSize     int           // The number of segments listed by the playlists.
+	Directory      string        // The directory of the segments, kept in memory if empty.
+	Cleanup        bool          // Whether the segments out of the window are removed.
+	PartDuration   time.Duration // The duration of the low-latency parts, disabled if zero.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		TargetDuration: 2 * time.Second,
+		WindowSize:     6,
+		Cleanup:        true,
+	}
+}
+
+// Server represents the HLS output of the live streams, which segments the streams of
+// a registry and serves their playlists and segments, under "<prefix><app>/<stream>".
+type Server struct {
+	sync.Mutex
+	opts       Options
+	prefix     string
+	segmenters map[string]*Segmenter
+}
+
+// NewServer creates a new HLS server, serving the requests under a path prefix.
+func NewServer(prefix string, opts Options) *Server {
+	return &Server{
+		opts:       opts,
+		prefix:     prefix,
+		segmenters: make(map[string]*Segmenter),
+	}
+}
+
+// Publish starts segmenting a stream, unless it is already, as when its publisher
+// resumes it. A stream published again after ending replaces its previous segments.
+func (s *Server) Publish(stream *media.Stream) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := stream.Key()
+	if prev, ok := s.segmenters[key]; ok {
+		if prev.stream == stream {
+			return nil
+		}
+		prev.Close()
+		prev.store.RemoveAll()
+	}
+
+	var store storage = newMemoryStorage()
+	if s.opts.Directory != "" {
+		var err error
+		if store, err = newDiskStorage(filepath.Join(s.opts.Directory, filepath.FromSlash(key))); err != nil {
+			return err
+		}
+	}
+
+	seg := newSegmenter(stream, s.opts, store, s.onEnd)
+	if err := stream.Attach(seg); err != nil {
+		return err
+	}
+	s.segmenters[key] = seg
+	go seg.run()
+	return nil
+}
+
+// onEnd removes the segments of an ended stream, once the players had the time to
+// play its window.
+func (s *Server) onEnd(seg *Segmenter) {
+	if !s.opts.Cleanup {
+		return
+	}
+
+	delay := time.Duration(s.opts.WindowSize) * s.opts.TargetDuration
+	time.AfterFunc(delay, func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.segmenters[seg.key] == seg {
+			delete(s.segmenters, seg.key)
+			seg.store.RemoveAll()
+			logging.Info("hls: removed the segments of", seg.key)
+		}
+	})
+}
+
+// Get returns the segmenter of a stream.
+func (s *Server) Get(key string) (*Segmenter, bool) {
+	s.Lock()
+	defer s.Unlock()
+	seg, ok := s.segmenters[key]
+	return seg, ok
+}
+
+// ServeHTTP serves the playlists, at "<app>/<stream>.m3u8", and the segments, at
+// "<app>/<stream>/<seq>.ts" or "<app>/<stream>/<seq>.<part>.ts" for the parts.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, s.prefix)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if strings.HasSuffix(path, ".m3u8") {
+		s.servePlaylist(w, r, strings.TrimSuffix(path, ".m3u8"))
+		return
+	}
+
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 || !strings.HasSuffix(path, ".ts") {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveSegment(w, r, path[:i], strings.TrimSuffix(path[i+1:], ".ts"))
+}
+
+// servePlaylist serves the playlist of a stream, blocking for the low-latency players
+// which request the next segment or part.
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, key string) {
+	seg, ok := s.Get(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	seq, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+	block := err == nil && s.opts.PartDuration > 0
+	index := -1
+	if v, err := strconv.Atoi(query.Get("_HLS_part")); err == nil && v >= 0 {
+		index = v
+	}
+
+	// The other parameters, such as a signature, are carried over to the segments
+	for name := range query {
+		if strings.HasPrefix(name, "_HLS_") {
+			delete(query, name)
+		}
+	}
+	var segmentQuery string
+	if len(query) > 0 {
+		segmentQuery = "?" + query.Encode()
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(seg.Playlist(seq, index, block, segmentQuery)))
+}
+
+// serveSegment serves a segment, or a part as "<seq>.<part>".
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request, key, name string) {
+	seg, ok := s.Get(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data []byte
+	seqPart := strings.SplitN(name, ".", 2)
+	seq, err := strconv.ParseUint(seqPart[0], 10, 64)
+	switch {
+	case err != nil:
+	case len(seqPart) == 1:
+		data, err = seg.Segment(seq)
+	default:
+		var index uint64
+		if index, err = strconv.ParseUint(seqPart[1], 10, 16); err == nil {
+			data, err = seg.Part(seq, int(index))
+		}
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(data)
+}
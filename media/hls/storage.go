@@ -0,0 +1,106 @@
+package hls
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errNotFound is returned when a file is missing from a storage.
+var errNotFound = errors.New("hls: file not found")
+
+// storage represents where the files of a stream, its segments and its playlist, are
+// kept until removed.
+type storage interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Remove(name string) error
+	RemoveAll() error
+}
+
+// ------------------------------------------------------------------------------------
+
+// memoryStorage keeps the files in memory.
+type memoryStorage struct {
+	sync.RWMutex
+	files map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{files: make(map[string][]byte)}
+}
+
+func (s *memoryStorage) Put(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.files[name] = data
+	return nil
+}
+
+func (s *memoryStorage) Get(name string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if data, ok := s.files[name]; ok {
+		return data, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStorage) RemoveAll() error {
+	s.Lock()
+	defer s.Unlock()
+	s.files = make(map[string][]byte)
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// diskStorage keeps the files in a directory, so they can also be served by another
+// HTTP server.
+type diskStorage struct {
+	dir string
+}
+
+func newDiskStorage(dir string) (*diskStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskStorage{dir: dir}, nil
+}
+
+// Put writes a file, through a temporary one so it is never read partially written.
+func (s *diskStorage) Put(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *diskStorage) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	return data, err
+}
+
+func (s *diskStorage) Remove(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *diskStorage) RemoveAll() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,105 @@
+package media
+
+import (
+	"github.com/numb3r3/live-go/media/codec"
+)
+
+// PacketType represents the kind of a packet, numbered as the FLV tag types.
+type PacketType uint8
+
+// The packet types.
+const (
+	PacketAudio    = PacketType(8)
+	PacketVideo    = PacketType(9)
+	PacketMetadata = PacketType(18)
+)
+
+// The codec identifiers of the FLV audio and video tags.
+const (
+	CodecMP3  = 2
+	CodecAAC  = 10
+	CodecAVC  = 7
+	CodecHEVC = 12
+)
+
+// Packet represents a single audio, video or metadata message of a stream. The data is
+// the body of an FLV tag: the audio and video tag headers followed by the frame, or the
+// AMF0 encoded script data.
+type Packet struct {
+	Type      PacketType
+	Timestamp uint32 // The decoding timestamp, in milliseconds.
+	Data      []byte
+}
+
+// IsKeyframe returns whether the packet is a video keyframe.
+func (p *Packet) IsKeyframe() bool {
+	return p.Type == PacketVideo && len(p.Data) > 0 && p.Data[0]>>4 == 1
+}
+
+// IsSequenceHeader returns whether the packet carries the decoder configuration of an
+// AVC, HEVC or AAC stream rather than a frame.
+func (p *Packet) IsSequenceHeader() bool {
+	if len(p.Data) < 2 {
+		return false
+	}
+
+	switch p.Type {
+	case PacketVideo:
+		codec := p.Data[0] & 0x0f
+		return (codec == CodecAVC || codec == CodecHEVC) && p.Data[1] == 0
+	case PacketAudio:
+		return p.Data[0]>>4 == CodecAAC && p.Data[1] == 0
+	}
+	return false
+}
+
+// VideoCodec returns the codec identifier of a video packet.
+func (p *Packet) VideoCodec() uint8 {
+	if p.Type != PacketVideo || len(p.Data) == 0 {
+		return 0
+	}
+	return p.Data[0] & 0x0f
+}
+
+// AudioCodec returns the codec identifier of an audio packet.
+func (p *Packet) AudioCodec() uint8 {
+	if p.Type != PacketAudio || len(p.Data) == 0 {
+		return 0
+	}
+	return p.Data[0] >> 4
+}
+
+// VideoInfo returns the properties of the video of an AVC or HEVC sequence header, read
+// from its parameter sets.
+func (p *Packet) VideoInfo() (*codec.VideoInfo, error) {
+	if p.Type != PacketVideo || !p.IsSequenceHeader() || len(p.Data) < 6 {
+		return nil, codec.ErrInvalidData
+	}
+
+	if p.VideoCodec() == CodecHEVC {
+		config, err := codec.ParseHEVCConfig(p.Data[5:])
+		if err != nil {
+			return nil, err
+		}
+		return config.Info()
+	}
+
+	config, err := codec.ParseAVCConfig(p.Data[5:])
+	if err != nil {
+		return nil, err
+	}
+	return config.Info()
+}
+
+// AudioInfo returns the properties of the audio of an AAC sequence header.
+func (p *Packet) AudioInfo() (*codec.AudioInfo, error) {
+	if p.Type != PacketAudio || !p.IsSequenceHeader() {
+		return nil, codec.ErrInvalidData
+	}
+
+	config, err := codec.ParseAudioSpecificConfig(p.Data[2:])
+	if err != nil {
+		return nil, err
+	}
+	return config.Info(), nil
+}
@@ -0,0 +1,133 @@
+package media
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueClosed is returned when pushing to a closed queue.
+var ErrQueueClosed = errors.New("queue closed")
+
+// Queue represents the bounded send queue of a player, so a slow player never holds
+// the publisher back. When full, the queue drops its frames rather than blocking: the
+// audio and the video frames depending on others go first, then the oldest keyframes.
+// Once video frames are dropped, the next ones are skipped up to a keyframe, as they
+// could not be decoded anyway.
+type Queue struct {
+	sync.Mutex
+	packets  []*Packet
+	capacity int
+	signal   chan struct{} // Signaled when packets are pushed.
+	closing  chan struct{} // Closed when the queue is closed.
+	skipping bool          // Whether the video is skipped up to the next keyframe.
+	dropped  uint64        // The number of packets dropped.
+	closed   bool
+}
+
+// NewQueue creates a new queue holding up to a number of packets, at least one. The
+// video starts at the first keyframe pushed.
+func NewQueue(capacity int) *Queue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Queue{
+		packets:  make([]*Packet, 0, capacity),
+		capacity: capacity,
+		signal:   make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		skipping: true,
+	}
+}
+
+// Push adds a packet to the queue, dropping packets if full. It never blocks.
+func (q *Queue) Push(p *Packet) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if len(q.packets) >= q.capacity {
+		q.shed()
+	}
+
+	if p.Type == PacketVideo && !p.IsSequenceHeader() {
+		if p.IsKeyframe() {
+			q.skipping = false
+		} else if q.skipping {
+			q.dropped++
+			return nil
+		}
+	}
+	q.packets = append(q.packets, p)
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// shed drops the frames of a full queue, keeping the headers and the keyframes unless
+// the queue is full of them.
+func (q *Queue) shed() {
+	kept := q.packets[:0]
+	for _, p := range q.packets {
+		if p.Type == PacketMetadata || p.IsSequenceHeader() || p.IsKeyframe() {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) >= q.capacity {
+		kept = kept[:copy(kept, kept[1:])]
+	}
+
+	q.dropped += uint64(len(q.packets) - len(kept))
+	for i := len(kept); i < len(q.packets); i++ {
+		q.packets[i] = nil
+	}
+	q.packets = kept
+	q.skipping = true
+}
+
+// Pop removes all of the queued packets, waiting for some if the queue is empty. It
+// returns false once the queue is closed and drained.
+func (q *Queue) Pop() ([]*Packet, bool) {
+	for {
+		q.Lock()
+		if len(q.packets) > 0 {
+			packets := q.packets
+			q.packets = make([]*Packet, 0, q.capacity)
+			q.Unlock()
+			return packets, true
+		}
+		if q.closed {
+			q.Unlock()
+			return nil, false
+		}
+		q.Unlock()
+
+		select {
+		case <-q.signal:
+		case <-q.closing:
+		}
+	}
+}
+
+// Dropped returns the number of packets dropped so far.
+func (q *Queue) Dropped() uint64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
+
+// Close closes the queue, which wakes up the pending Pop. The packets already queued
+// are still popped.
+func (q *Queue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.closing)
+	}
+	return nil
+}
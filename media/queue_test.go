@@ -0,0 +1,40 @@
+package media
+
+import "testing"
+
+func TestQueueDrainsOnClose(t *testing.T) {
+	q := NewQueue(4)
+	for i := 0; i < 2; i++ {
+		if err := q.Push(&Packet{Type: PacketAudio, Timestamp: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	if err := q.Push(&Packet{Type: PacketAudio}); err != ErrQueueClosed {
+		t.Fatalf("push to a closed queue: %v", err)
+	}
+	if packets, ok := q.Pop(); !ok || len(packets) != 2 {
+		t.Fatalf("popped %d packets, ok=%v", len(packets), ok)
+	}
+	if _, ok := q.Pop(); ok {
+		t.Fatal("closed queue not reported once drained")
+	}
+}
+
+func TestQueueMinimumCapacity(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		q := NewQueue(capacity)
+		for i := 0; i < 3; i++ {
+			if err := q.Push(&Packet{Type: PacketAudio, Timestamp: uint32(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if packets, _ := q.Pop(); len(packets) != 1 || packets[0].Timestamp != 2 {
+			t.Fatalf("capacity %d: popped %d packets", capacity, len(packets))
+		}
+		if q.Dropped() != 2 {
+			t.Fatalf("capacity %d: dropped %d packets", capacity, q.Dropped())
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package record
+
+import (
+	"errors"
+	"io"
+
+	"github.com/numb3r3/live-go/media"
+	"github.com/numb3r3/live-go/media/codec"
+	"github.com/numb3r3/live-go/media/flv"
+	"github.com/numb3r3/live-go/media/fmp4"
+)
+
+// errNoTrack is returned when none of the codecs of a stream fit the format of a file.
+var errNoTrack = errors.New("record: no track of a supported codec")
+
+const (
+	mp4Timescale         = 1000 // The timestamps of the packets are in milliseconds.
+	maxAudioFragment     = 1000 // The duration of the fragments of the audio only files.
+	defaultVideoDuration = 40
+	defaultAudioDuration = 23
+)
+
+// flvMuxer writes the packets as they are, in an FLV file.
+type flvMuxer struct {
+	*flv.Writer
+}
+
+// newFLVMuxer creates a new FLV muxer, and writes the header and the headers of the
+// stream, those which were received.
+func newFLVMuxer(w io.Writer, headers ...*media.Packet) (*flvMuxer, error) {
+	m := &flvMuxer{Writer: flv.NewWriter(w)}
+	if err := m.WriteHeader(true, true); err != nil {
+		return nil, err
+	}
+	for _, p := range headers {
+		if p == nil {
+			continue
+		}
+		if err := m.WritePacket(&media.Packet{Type: p.Type, Data: p.Data}); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Close does nothing, as the tags are not buffered.
+func (m *flvMuxer) Close() error {
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// mp4Muxer remuxes the H.264, H.265 and AAC frames into a fragmented MP4 file, with a
+// fragment per GOP, so the file remains playable if the recording is cut short.
+type mp4Muxer struct {
+	w         io.Writer
+	fragments [2]*fmp4.Fragment // The buffered video and audio samples.
+	lastDTS   [2]uint64
+	seq       uint32
+}
+
+// newMP4Muxer creates a new MP4 muxer for the tracks of the sequence headers, and
+// writes the initialization segment.
+func newMP4Muxer(w io.Writer, videoHeader, audioHeader *media.Packet) (*mp4Muxer, error) {
+	m := &mp4Muxer{w: w}
+	var tracks []*fmp4.Track
+	if p := videoHeader; p != nil && len(p.Data) > 5 {
+		name := fmp4.CodecAVC
+		if p.VideoCodec() == media.CodecHEVC {
+			name = fmp4.CodecHEVC
+		}
+		t := &fmp4.Track{ID: 1, Codec: name, Timescale: mp4Timescale, Config: p.Data[5:]}
+		if info, err := p.VideoInfo(); err == nil {
+			t.Width, t.Height = uint16(info.Width), uint16(info.Height)
+		}
+		if _, err := t.Codecs(); err == nil {
+			m.fragments[0] = &fmp4.Fragment{Track: t}
+			tracks = append(tracks, t)
+		}
+	}
+	if p := audioHeader; p != nil && p.AudioCodec() == media.CodecAAC && len(p.Data) > 2 {
+		if config, err := codec.ParseAudioSpecificConfig(p.Data[2:]); err == nil {
+			t := &fmp4.Track{
+				ID:         2,
+				Codec:      fmp4.CodecAAC,
+				Timescale:  mp4Timescale,
+				Config:     p.Data[2:],
+				SampleRate: uint32(config.SampleRate),
+				Channels:   uint16(config.Channels),
+			}
+			m.fragments[1] = &fmp4.Fragment{Track: t}
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil, errNoTrack
+	}
+	return m, fmp4.WriteInit(w, tracks...)
+}
+
+// WritePacket buffers a frame, writing the buffered fragment before a keyframe, or
+// every second for the audio only files.
+func (m *mp4Muxer) WritePacket(p *media.Packet) error {
+	track, offset := 1, 2
+	if p.Type == media.PacketVideo {
+		track, offset = 0, 5
+	}
+
+	f := m.fragments[track]
+	switch {
+	case f == nil || p.IsSequenceHeader() || len(p.Data) <= offset:
+		return nil
+	case p.Type == media.PacketVideo && p.Data[1] != 1:
+		return nil
+	}
+
+	dts := uint64(p.Timestamp)
+	flush := p.IsKeyframe() || m.fragments[0] == nil && len(f.Samples) > 0 && dts-f.BaseTime >= maxAudioFragment
+	if flush {
+		if err := m.flush(dts); err != nil {
+			return err
+		}
+	}
+
+	sample := fmp4.Sample{Keyframe: p.IsKeyframe() || track == 1, Data: p.Data[offset:]}
+	if track == 0 {
+		sample.CompositionOffset = int32(uint32(p.Data[2])<<16|uint32(p.Data[3])<<8|uint32(p.Data[4])) << 8 >> 8
+	}
+	if n := len(f.Samples); n == 0 {
+		f.BaseTime = dts
+	} else {
+		m.setLastDuration(track, dts)
+	}
+	f.Samples = append(f.Samples, sample)
+	m.lastDTS[track] = dts
+	return nil
+}
+
+// setLastDuration sets the duration of the last sample of a track, up to a decoding
+// time if later, or as the previous sample.
+func (m *mp4Muxer) setLastDuration(track int, to uint64) {
+	f := m.fragments[track]
+	n := len(f.Samples)
+	switch from := m.lastDTS[track]; {
+	case to > from:
+		f.Samples[n-1].Duration = uint32(to - from)
+	case n > 1:
+		f.Samples[n-1].Duration = f.Samples[n-2].Duration
+	case track == 0:
+		f.Samples[n-1].Duration = defaultVideoDuration
+	default:
+		f.Samples[n-1].Duration = defaultAudioDuration
+	}
+}
+
+// flush writes the buffered samples as a fragment, the last video sample lasting up to
+// a decoding time.
+func (m *mp4Muxer) flush(end uint64) error {
+	var fragments []*fmp4.Fragment
+	for track, f := range m.fragments {
+		if f == nil || len(f.Samples) == 0 {
+			continue
+		}
+		if track == 0 {
+			m.setLastDuration(track, end)
+		} else {
+			m.setLastDuration(track, 0)
+		}
+		fragments = append(fragments, f)
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+
+	m.seq++
+	err := fmp4.WriteFragment(m.w, m.seq, fragments...)
+	for _, f := range fragments {
+		f.Samples = nil
+	}
+	return err
+}
+
+// Close writes the buffered samples.
+func (m *mp4Muxer) Close() error {
+	return m.flush(0)
+}
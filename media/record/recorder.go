@@ -0,0 +1,130 @@
+package record
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/media"
+)
+
+// The formats of the recordings.
+const (
+	FormatFLV = "flv"
+	FormatMP4 = "mp4" // Fragmented, so a recording cut short remains playable.
+)
+
+// Options represents the options of the recordings of an app.
+type Options struct {
+	Enabled       bool
+	Format        string        // The format of the files, FormatFLV or FormatMP4.
+	Directory     string        // The directory of the files.
+	Filename      string        // The template of the file names, without their extension.
+	SplitDuration time.Duration // The duration after which a file is split, on a keyframe, zero for none.
+	SplitSize     int64         // The size after which a file is split, on a keyframe, zero for none.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		Format:    FormatFLV,
+		Directory: "recordings",
+		Filename:  "{app}/{stream}-{time}",
+	}
+}
+
+// File represents a finished recording file, as handed to the callback.
+type File struct {
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Duration  float64   `json:"duration"` // The duration of the media, in seconds.
+	Size      int64     `json:"size"`
+}
+
+// Recorder represents the recording of the live streams to files, by the rules of their
+// apps.
+type Recorder struct {
+	sync.Mutex
+	opts       Options
+	apps       map[string]Options // The options overridden by app.
+	onFinish   func(File)
+	recordings map[string]*Recording
+}
+
+// NewRecorder creates a new recorder, with the default options, those of the apps, and
+// a callback run once a file is finished, which may be nil.
+func NewRecorder(opts Options, apps map[string]Options, onFinish func(File)) *Recorder {
+	if onFinish == nil {
+		onFinish = func(File) {}
+	}
+	return &Recorder{
+		opts:       opts,
+		apps:       apps,
+		onFinish:   onFinish,
+		recordings: make(map[string]*Recording),
+	}
+}
+
+// options returns the options of the recordings of a stream, by its app.
+func (r *Recorder) options(key string) Options {
+	if opts, ok := r.apps[key[:strings.IndexByte(key, '/')]]; ok {
+		return opts
+	}
+	return r.opts
+}
+
+// Publish starts recording a stream if its app is recorded, unless it is already, as
+// when its publisher resumes it.
+func (r *Recorder) Publish(stream *media.Stream) error {
+	opts := r.options(stream.Key())
+	if !opts.Enabled {
+		return nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	key := stream.Key()
+	if prev, ok := r.recordings[key]; ok {
+		if prev.stream == stream {
+			return nil
+		}
+		prev.Close()
+	}
+
+	rec := newRecording(stream, opts, r.onFinish, r.onEnd)
+	if err := stream.Attach(rec); err != nil {
+		return err
+	}
+	r.recordings[key] = rec
+	go rec.run()
+	return nil
+}
+
+// onEnd forgets the recording of an ended stream.
+func (r *Recorder) onEnd(rec *Recording) {
+	r.Lock()
+	defer r.Unlock()
+	if r.recordings[rec.key] == rec {
+		delete(r.recordings, rec.key)
+	}
+}
+
+// Close stops all the recordings, finishing their files.
+func (r *Recorder) Close() error {
+	r.Lock()
+	recordings := make([]*Recording, 0, len(r.recordings))
+	for _, rec := range r.recordings {
+		recordings = append(recordings, rec)
+	}
+	r.Unlock()
+
+	for _, rec := range recordings {
+		rec.stream.Detach(rec)
+		rec.Close()
+		<-rec.done
+	}
+	return nil
+}
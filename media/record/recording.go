@@ -0,0 +1,278 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+)
+
+const (
+	recordingQueueSize = 8192
+	fileBufferSize     = 256 * 1024
+	maxTimestampJump   = 10 * time.Second // A larger jump of the timestamps is a discontinuity.
+)
+
+// muxer represents the format of a file, written packet by packet.
+type muxer interface {
+	WritePacket(p *media.Packet) error
+	Close() error // Flushes the buffered packets, without closing the file.
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Recording represents the recording of a stream. Attached as a player, it queues the
+// packets without blocking, and writes them to files from its own goroutine, so a slow
+// disk only ever drops frames of the recording.
+type Recording struct {
+	key         string
+	stream      *media.Stream
+	opts        Options
+	queue       *media.Queue
+	onFinish    func(File)
+	onEnd       func(*Recording)
+	done        chan struct{}
+	metadata    *media.Packet
+	videoHeader *media.Packet
+	audioHeader *media.Packet
+	resplit     bool // Whether the next keyframe starts a new file, as the codecs changed.
+
+	// The file being written, nil until the first keyframe
+	file      *os.File
+	out       *countingWriter
+	mux       muxer
+	current   File
+	index     int   // The number of the file, from 1.
+	fileStart int64 // The position of the start of the file.
+	fileEnd   int64 // The position of the last packet of the file.
+
+	// The timestamps are continuous over the jumps of the publishers
+	offset    int64
+	lastTS    uint32
+	lastDelta int64
+	hasLast   bool
+}
+
+// newRecording creates a new recording of a stream.
+func newRecording(stream *media.Stream, opts Options, onFinish func(File), onEnd func(*Recording)) *Recording {
+	return &Recording{
+		key:      stream.Key(),
+		stream:   stream,
+		opts:     opts,
+		queue:    media.NewQueue(recordingQueueSize),
+		onFinish: onFinish,
+		onEnd:    onEnd,
+		done:     make(chan struct{}),
+	}
+}
+
+// ID returns the identifier of the recording, as a player.
+func (r *Recording) ID() string {
+	return "record"
+}
+
+// WritePacket queues a packet of the stream, without blocking.
+func (r *Recording) WritePacket(p *media.Packet) error {
+	return r.queue.Push(p)
+}
+
+// Close ends the recording, once the queued packets are written.
+func (r *Recording) Close() error {
+	return r.queue.Close()
+}
+
+// run writes the queued packets until the recording is closed.
+func (r *Recording) run() {
+	for {
+		packets, ok := r.queue.Pop()
+		if !ok {
+			break
+		}
+		for _, p := range packets {
+			if err := r.write(p); err != nil {
+				logging.Error("record: unable to write", r.current.Path, err)
+				r.finish()
+			}
+		}
+	}
+
+	r.finish()
+	close(r.done)
+	r.onEnd(r)
+}
+
+// write writes a packet, starting a new file on the keyframes when needed.
+func (r *Recording) write(p *media.Packet) error {
+	switch {
+	case p.Type == media.PacketMetadata:
+		r.metadata = p
+		return r.writeHeader(p)
+	case p.IsSequenceHeader():
+		prev := &r.audioHeader
+		if p.Type == media.PacketVideo {
+			prev = &r.videoHeader
+		}
+
+		// The MP4 files describe the codecs once, so a change requires a new file
+		if *prev != nil && !bytes.Equal((*prev).Data, p.Data) && r.opts.Format == FormatMP4 {
+			r.resplit = true
+		}
+		*prev = p
+		return r.writeHeader(p)
+	}
+
+	reference := p.Type == media.PacketVideo || r.videoHeader == nil
+	if reference {
+		r.advance(p.Timestamp)
+	}
+	position := int64(p.Timestamp) + r.offset
+
+	// The files start on a keyframe, so they are playable on their own
+	cut := reference && (r.videoHeader == nil || p.IsKeyframe())
+	switch {
+	case r.file == nil && !cut:
+		return nil
+	case r.file != nil && cut && r.shouldSplit(position):
+		r.finish()
+	}
+	if r.file == nil {
+		if err := r.open(position); err != nil {
+			return err
+		}
+	}
+
+	if position < r.fileStart {
+		position = r.fileStart
+	}
+	if position > r.fileEnd {
+		r.fileEnd = position
+	}
+	return r.mux.WritePacket(&media.Packet{Type: p.Type, Timestamp: uint32(position - r.fileStart), Data: p.Data})
+}
+
+// writeHeader writes the metadata or a sequence header to the FLV file being written.
+func (r *Recording) writeHeader(p *media.Packet) error {
+	if r.file == nil || r.opts.Format != FormatFLV {
+		return nil
+	}
+	return r.mux.WritePacket(&media.Packet{Type: p.Type, Timestamp: uint32(r.fileEnd - r.fileStart), Data: p.Data})
+}
+
+// advance follows the timestamp of a reference packet. On a jump, the position resumes
+// after the last packet, as when a publisher resumes the stream.
+func (r *Recording) advance(ts uint32) {
+	switch delta := int64(ts) - int64(r.lastTS); {
+	case !r.hasLast:
+	case delta < 0 || delta > int64(maxTimestampJump/time.Millisecond):
+		r.offset = int64(r.lastTS) + r.offset + r.lastDelta - int64(ts)
+	default:
+		r.lastDelta = delta
+	}
+	r.lastTS, r.hasLast = ts, true
+}
+
+// shouldSplit returns whether the file being written is split before a keyframe at a
+// position.
+func (r *Recording) shouldSplit(position int64) bool {
+	elapsed := time.Duration(position-r.fileStart) * time.Millisecond
+	return r.resplit ||
+		r.opts.SplitDuration > 0 && elapsed >= r.opts.SplitDuration ||
+		r.opts.SplitSize > 0 && r.out.n >= r.opts.SplitSize
+}
+
+// open creates a new file, starting at a position, and writes the headers.
+func (r *Recording) open(position int64) (err error) {
+	r.index++
+	now := time.Now()
+	path := filepath.Join(r.opts.Directory, r.filename(now))
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// A file is never overwritten, the name getting a suffix instead
+	name := path
+	for i := 1; ; i++ {
+		r.file, err = os.OpenFile(name+"."+r.opts.Format, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !os.IsExist(err) || i > 100 {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", path, i)
+	}
+	if err != nil {
+		r.file = nil
+		return err
+	}
+
+	r.out = &countingWriter{w: bufio.NewWriterSize(r.file, fileBufferSize)}
+	r.current = File{Key: r.key, Path: r.file.Name(), Format: r.opts.Format, StartTime: now.UTC()}
+	r.fileStart, r.fileEnd, r.resplit = position, position, false
+	if r.opts.Format == FormatMP4 {
+		r.mux, err = newMP4Muxer(r.out, r.videoHeader, r.audioHeader)
+	} else {
+		r.mux, err = newFLVMuxer(r.out, r.metadata, r.videoHeader, r.audioHeader)
+	}
+	if err != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		r.file = nil
+		return err
+	}
+
+	logging.Info("record: recording", r.key, "to", r.current.Path)
+	return nil
+}
+
+// filename expands the template of the file names, at a time.
+func (r *Recording) filename(t time.Time) string {
+	i := strings.IndexByte(r.key, '/')
+	return strings.NewReplacer(
+		"{app}", r.key[:i],
+		"{stream}", r.key[i+1:],
+		"{time}", t.Format("20060102-150405"),
+		"{date}", t.Format("20060102"),
+		"{unix}", strconv.FormatInt(t.Unix(), 10),
+		"{index}", strconv.Itoa(r.index),
+	).Replace(r.opts.Filename)
+}
+
+// finish completes the file being written, if any, and runs the callback.
+func (r *Recording) finish() {
+	if r.file == nil {
+		return
+	}
+
+	err := r.mux.Close()
+	if err == nil {
+		err = r.out.w.Flush()
+	}
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	if err != nil {
+		logging.Error("record: unable to finish", r.current.Path, err)
+	}
+
+	r.current.EndTime = time.Now().UTC()
+	r.current.Duration = float64(r.fileEnd-r.fileStart) / 1000
+	r.current.Size = r.out.n
+	logging.Info("record: recorded", r.key, "to", r.current.Path)
+	r.onFinish(r.current)
+}
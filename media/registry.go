@@ -0,0 +1,264 @@
+package media
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// Errors reported by the registry.
+var (
+	ErrInvalidKey      = errors.New("invalid stream key")
+	ErrStreamPublished = errors.New("stream already published")
+	ErrStreamNotFound  = errors.New("stream not found")
+	ErrNotPublishing   = errors.New("publisher no longer publishing")
+	ErrUnauthorized    = errors.New("not authorized")
+)
+
+// Client represents a publisher or a player of a stream, as handed to the hook.
+type Client struct {
+	Remote string     // The address of the client.
+	Params url.Values // The parameters of its request, such as the query of its URL.
+}
+
+// Hook authorizes the publishers and the players of the streams, and follows the end
+// of the publishing. The hook is called outside of the locks of the registry, so it
+// may block, such as to call a remote service.
+type Hook interface {
+	// OnPublish is called before a stream is published, an error refuses it.
+	OnPublish(key string, c Client) error
+
+	// OnPlay is called before a player is attached to a stream, an error refuses it.
+	OnPlay(key string, c Client) error
+
+	// OnDone is called once the publisher of a stream left.
+	OnDone(key string, c Client)
+}
+
+// CacheOptions represents the options of the GOP cache of a stream.
+type CacheOptions struct {
+	Enabled   bool // Whether the latest GOP is cached.
+	MaxFrames int  // The maximum number of audio and video frames cached.
+	MaxBytes  int  // The maximum size of the frames cached.
+}
+
+// Options represents the options of a registry.
+type Options struct {
+	GracePeriod time.Duration           // How long a stream waits for its publisher to reconnect.
+	Cache       CacheOptions            // The GOP cache of the streams.
+	AppCache    map[string]CacheOptions // The GOP cache of the streams of specific apps.
+	Hook        Hook                    // The authorization of the clients, nil to accept all of them.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		Cache: CacheOptions{
+			Enabled:   true,
+			MaxFrames: 512,
+			MaxBytes:  8 << 20,
+		},
+	}
+}
+
+// StreamRegistry represents the live streams, by their key. The output protocols look
+// the streams up in the registry to attach their players.
+type StreamRegistry struct {
+	sync.RWMutex
+	streams map[string]*Stream
+	opts    Options
+}
+
+// NewStreamRegistry creates a new empty registry. A stream whose publisher leaves is
+// kept for the grace period, along with its players, in case the publisher comes back.
+func NewStreamRegistry(opts Options) *StreamRegistry {
+	return &StreamRegistry{
+		streams: make(map[string]*Stream),
+		opts:    opts,
+	}
+}
+
+// cacheOptions returns the options of the GOP cache of a stream, by the app of its key.
+func (r *StreamRegistry) cacheOptions(key string) CacheOptions {
+	app := key
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		app = key[:i]
+	}
+	if opts, ok := r.opts.AppCache[app]; ok {
+		return opts
+	}
+	return r.opts.Cache
+}
+
+// ValidKey returns whether a key of a stream is made of its app and its name, both of
+// them usable as a file name.
+func ValidKey(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\?#%:*\"<>|") {
+			return false
+		}
+		for _, c := range part {
+			if c < 0x20 || c == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Publish starts publishing a stream, or resumes it while in its grace period. A
+// stream has a single publisher, so publishing a stream twice is refused.
+func (r *StreamRegistry) Publish(key string, client Client) (*Publisher, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	if r.opts.Hook != nil {
+		if err := r.opts.Hook.OnPublish(key, client); err != nil {
+			logging.Info("stream", key, "refused to", client.Remote+":", err)
+			return nil, ErrUnauthorized
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.streams[key]
+	if !ok {
+		s = &Stream{
+			key:      key,
+			registry: r,
+			players:  make(map[string]Player),
+			cache:    newGOPCache(r.cacheOptions(key)),
+		}
+		r.streams[key] = s
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.publisher != nil {
+		return nil, ErrStreamPublished
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+		logging.Info("stream", key, "resumed by", client.Remote)
+	}
+
+	// The headers of the previous publisher may not match the new one
+	now := time.Now()
+	s.publisher = &Publisher{stream: s, client: client}
+	s.startTime = now.UTC()
+	s.metadata, s.videoHeader, s.audioHeader = nil, nil, nil
+	s.videoInfo, s.audioInfo = nil, nil
+	s.cache.Reset()
+	s.sampleTime, s.sampleBytes, s.bitrate = now, s.bytes, 0
+	return s.publisher, nil
+}
+
+// Get returns a stream by its key.
+func (r *StreamRegistry) Get(key string) (*Stream, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	s, ok := r.streams[key]
+	return s, ok
+}
+
+// Authorize checks whether a client may play a stream, as when its media is served
+// without attaching a player, such as the segments of HLS or DASH.
+func (r *StreamRegistry) Authorize(key string, client Client) error {
+	if r.opts.Hook == nil {
+		return nil
+	}
+	if err := r.opts.Hook.OnPlay(key, client); err != nil {
+		logging.Info("stream", key, "refused to", client.Remote+":", err)
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Play attaches a player to a stream, once the client is authorized, and returns it.
+func (r *StreamRegistry) Play(key string, player Player, client Client) (*Stream, error) {
+	s, ok := r.Get(key)
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	if err := r.Authorize(key, client); err != nil {
+		return nil, err
+	}
+
+	if err := s.Attach(player); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the state of all of the streams, ordered by their key.
+func (r *StreamRegistry) List() []Info {
+	r.RLock()
+	streams := make([]*Stream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, s)
+	}
+	r.RUnlock()
+
+	infos := make([]Info, 0, len(streams))
+	for _, s := range streams {
+		infos = append(infos, s.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+	return infos
+}
+
+// unpublish ends the publishing of a stream, which is removed right away or once its
+// grace period is over.
+func (r *StreamRegistry) unpublish(p *Publisher) {
+	s := p.stream
+	s.Lock()
+	if s.publisher != p {
+		s.Unlock()
+		return
+	}
+
+	s.publisher = nil
+	if r.opts.Hook != nil {
+		defer r.opts.Hook.OnDone(s.key, p.client)
+	}
+	if r.opts.GracePeriod > 0 {
+		s.expiry = time.AfterFunc(r.opts.GracePeriod, func() { r.expire(s) })
+		s.Unlock()
+		logging.Info("stream", s.key, "waiting for its publisher")
+		return
+	}
+	s.Unlock()
+	r.expire(s)
+}
+
+// expire removes a stream unless published again, and closes its players.
+func (r *StreamRegistry) expire(s *Stream) {
+	r.Lock()
+	s.Lock()
+	if s.publisher != nil || r.streams[s.key] != s {
+		s.Unlock()
+		r.Unlock()
+		return
+	}
+	delete(r.streams, s.key)
+	s.expiry, s.ended = nil, true
+	s.Unlock()
+	r.Unlock()
+
+	s.closePlayers()
+	logging.Info("stream", s.key, "ended")
+}
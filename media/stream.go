@@ -0,0 +1,240 @@
+package media
+
+import (
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/media/codec"
+)
+
+// Player represents a receiver of a stream, such as the connection of a viewer. The
+// packets are written while the stream is locked, so a player must never block.
+type Player interface {
+	ID() string
+	WritePacket(p *Packet) error
+	Close() error
+}
+
+// Info represents the state of a stream, as shown by the admin API.
+type Info struct {
+	Key        string           `json:"key"`
+	Publisher  string           `json:"publisher,omitempty"` // The address of the publisher.
+	Published  bool             `json:"published"`           // False while waiting for the publisher.
+	StartTime  time.Time        `json:"start_time"`
+	VideoCodec string           `json:"video_codec,omitempty"`
+	AudioCodec string           `json:"audio_codec,omitempty"`
+	Video      *codec.VideoInfo `json:"video,omitempty"` // As read from the sequence header.
+	Audio      *codec.AudioInfo `json:"audio,omitempty"`
+	Bitrate    uint64           `json:"bitrate"` // The incoming bitrate, in bits per second.
+	Bytes      uint64           `json:"bytes"`
+	Cached     int              `json:"cached_frames"` // The number of frames in the GOP cache.
+	Players    []string         `json:"players"`
+}
+
+// Stream represents a live stream, fed by a single publisher and played by any number
+// of players. A stream outlives its publisher during the grace period of the registry,
+// so the players stay attached while the broadcaster reconnects.
+type Stream struct {
+	sync.RWMutex
+	key         string
+	registry    *StreamRegistry
+	publisher   *Publisher        // The current publisher, nil while waiting for one.
+	players     map[string]Player // The players by their id.
+	startTime   time.Time
+	videoCodec  uint8
+	audioCodec  uint8
+	metadata    *Packet // The last onMetaData of the publisher.
+	videoHeader *Packet // The sequence header of the video, the decoder configuration.
+	audioHeader *Packet // The sequence header of the audio.
+	videoInfo   *codec.VideoInfo
+	audioInfo   *codec.AudioInfo
+	cache       *gopCache
+	bytes       uint64
+	bitrate     uint64
+	sampleTime  time.Time // The start of the current bitrate sample.
+	sampleBytes uint64    // The bytes received at the start of the sample.
+	expiry      *time.Timer
+	ended       bool // Whether the stream was removed from the registry.
+}
+
+// Key returns the key of the stream, as "<app>/<name>".
+func (s *Stream) Key() string {
+	return s.key
+}
+
+// Headers returns the packets a player needs before the frames: the metadata and the
+// sequence headers, those which were received.
+func (s *Stream) Headers() []*Packet {
+	s.RLock()
+	defer s.RUnlock()
+	return s.headers()
+}
+
+func (s *Stream) headers() (packets []*Packet) {
+	for _, p := range []*Packet{s.metadata, s.videoHeader, s.audioHeader} {
+		if p != nil {
+			packets = append(packets, p)
+		}
+	}
+	return
+}
+
+// Attach adds a player to the stream, unless the stream has ended. The player gets
+// the headers right away, followed by the cached GOP so it starts on a keyframe.
+func (s *Stream) Attach(player Player) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.ended {
+		return ErrStreamNotFound
+	}
+
+	for _, p := range append(s.headers(), s.cache.Packets()...) {
+		if err := player.WritePacket(p); err != nil {
+			return err
+		}
+	}
+	s.players[player.ID()] = player
+	return nil
+}
+
+// Detach removes a player from the stream, without closing it.
+func (s *Stream) Detach(player Player) {
+	s.Lock()
+	defer s.Unlock()
+	if s.players[player.ID()] == player {
+		delete(s.players, player.ID())
+	}
+}
+
+// Info returns the state of the stream.
+func (s *Stream) Info() Info {
+	s.RLock()
+	defer s.RUnlock()
+
+	info := Info{
+		Key:        s.key,
+		Published:  s.publisher != nil,
+		StartTime:  s.startTime,
+		VideoCodec: CodecName(PacketVideo, s.videoCodec),
+		AudioCodec: CodecName(PacketAudio, s.audioCodec),
+		Video:      s.videoInfo,
+		Audio:      s.audioInfo,
+		Bitrate:    s.bitrate,
+		Bytes:      s.bytes,
+		Cached:     s.cache.Len(),
+		Players:    make([]string, 0, len(s.players)),
+	}
+	if s.publisher != nil {
+		info.Publisher = s.publisher.client.Remote
+	}
+	for id := range s.players {
+		info.Players = append(info.Players, id)
+	}
+	return info
+}
+
+// write receives a packet of the publisher and hands it over to the players.
+func (s *Stream) write(pub *Publisher, p *Packet) error {
+	s.Lock()
+	if s.publisher != pub {
+		s.Unlock()
+		return ErrNotPublishing
+	}
+
+	// Keep what the players joining later need, along with the codecs
+	switch {
+	case p.Type == PacketMetadata:
+		s.metadata = p
+	case p.IsSequenceHeader() && p.Type == PacketVideo:
+		s.videoHeader = p
+		s.videoInfo, _ = p.VideoInfo()
+	case p.IsSequenceHeader():
+		s.audioHeader = p
+		s.audioInfo, _ = p.AudioInfo()
+	}
+	if codec := p.VideoCodec(); codec != 0 {
+		s.videoCodec = codec
+	}
+	if p.Type == PacketAudio {
+		s.audioCodec = p.AudioCodec()
+	}
+	s.cache.Add(p)
+
+	// Sample the bitrate every second
+	s.bytes += uint64(len(p.Data))
+	if elapsed := time.Since(s.sampleTime); elapsed >= time.Second {
+		s.bitrate = uint64(float64(s.bytes-s.sampleBytes) * 8 / elapsed.Seconds())
+		s.sampleTime, s.sampleBytes = time.Now(), s.bytes
+	}
+
+	// The players failing to keep up are dropped, and closed once unlocked
+	var dropped []Player
+	for id, player := range s.players {
+		if err := player.WritePacket(p); err != nil {
+			delete(s.players, id)
+			dropped = append(dropped, player)
+		}
+	}
+	s.Unlock()
+
+	for _, player := range dropped {
+		player.Close()
+	}
+	return nil
+}
+
+// closePlayers removes and closes all of the players.
+func (s *Stream) closePlayers() {
+	s.Lock()
+	players := s.players
+	s.players = make(map[string]Player)
+	s.Unlock()
+
+	for _, player := range players {
+		player.Close()
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// Publisher represents the source of a stream, such as an RTMP broadcaster.
+type Publisher struct {
+	stream    *Stream
+	client    Client
+	closeOnce sync.Once
+}
+
+// Stream returns the stream being published.
+func (p *Publisher) Stream() *Stream {
+	return p.stream
+}
+
+// WritePacket publishes a packet.
+func (p *Publisher) WritePacket(packet *Packet) error {
+	return p.stream.write(p, packet)
+}
+
+// Close ends the publishing, which ends the stream once the grace period is over.
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		p.stream.registry.unpublish(p)
+	})
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// CodecName returns the name of a codec of an audio or video packet, empty if unknown.
+func CodecName(t PacketType, codec uint8) string {
+	switch {
+	case t == PacketVideo && codec == CodecAVC:
+		return "h264"
+	case t == PacketVideo && codec == CodecHEVC:
+		return "h265"
+	case t == PacketAudio && codec == CodecAAC:
+		return "aac"
+	case t == PacketAudio && codec == CodecMP3:
+		return "mp3"
+	}
+	return ""
+}
@@ -0,0 +1,234 @@
+package ts
+
+import (
+	"io"
+)
+
+// PacketSize is the size of a transport stream packet.
+const PacketSize = 188
+
+// The stream types of the program map table.
+const (
+	StreamH264 = 0x1b
+	StreamH265 = 0x24
+	StreamAAC  = 0x0f
+)
+
+// The packet identifiers.
+const (
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+)
+
+// The stream ids of the PES packets.
+const (
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+)
+
+// Muxer represents a muxer of elementary streams into an MPEG transport stream, with
+// a single program of up to one video and one audio track. The video is expected in
+// Annex-B format, the audio as ADTS frames. The timestamps are in the 90kHz clock.
+type Muxer struct {
+	w          io.Writer
+	videoType  uint8 // The stream type of the video, zero if none.
+	audioType  uint8 // The stream type of the audio, zero if none.
+	continuity map[uint16]uint8
+	packet     [PacketSize]byte
+}
+
+// NewMuxer creates a new muxer writing to w, with the stream types of the video and
+// the audio tracks, zero for a missing track.
+func NewMuxer(w io.Writer, videoType, audioType uint8) *Muxer {
+	return &Muxer{
+		w:          w,
+		videoType:  videoType,
+		audioType:  audioType,
+		continuity: make(map[uint16]uint8),
+	}
+}
+
+// SetOutput sets the writer the next packets are written to, such as a new segment.
+// The continuity counters carry on, as for a single stream split in files.
+func (m *Muxer) SetOutput(w io.Writer) {
+	m.w = w
+}
+
+// WriteTables writes the program association and program map tables, which start
+// every segment so it can be decoded on its own.
+func (m *Muxer) WriteTables() error {
+	// The program association table, with a single program
+	pat := []byte{
+		0x00,       // The table id
+		0xb0, 0x0d, // The section syntax indicator and the section length
+		0x00, 0x01, // The transport stream id
+		0xc1,       // The version and current next indicator
+		0x00, 0x00, // The section numbers
+		0x00, 0x01, // The program number
+		0xe0 | pidPMT>>8, pidPMT & 0xff,
+	}
+	if err := m.writeSection(pidPAT, pat); err != nil {
+		return err
+	}
+
+	// The program map table, with its tracks
+	pcrPID := uint16(pidVideo)
+	if m.videoType == 0 {
+		pcrPID = pidAudio
+	}
+	pmt := []byte{
+		0x02,       // The table id
+		0xb0, 0x00, // The section syntax indicator and the section length, set below
+		0x00, 0x01, // The program number
+		0xc1,       // The version and current next indicator
+		0x00, 0x00, // The section numbers
+		0xe0 | byte(pcrPID>>8), byte(pcrPID),
+		0xf0, 0x00, // The program info length
+	}
+	if m.videoType != 0 {
+		pmt = append(pmt, m.videoType, 0xe0|pidVideo>>8, pidVideo&0xff, 0xf0, 0x00)
+	}
+	if m.audioType != 0 {
+		pmt = append(pmt, m.audioType, 0xe0|pidAudio>>8, pidAudio&0xff, 0xf0, 0x00)
+	}
+	pmt[2] = byte(len(pmt) - 3 + 4) // Up to the CRC, included
+	return m.writeSection(pidPMT, pmt)
+}
+
+// writeSection writes a table section in a single packet, followed by its CRC.
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	crc := crc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	p := m.packet[:]
+	m.writeHeader(p, pid, true)
+	p[4] = 0 // The pointer field
+	n := copy(p[5:], section)
+	for i := 5 + n; i < PacketSize; i++ {
+		p[i] = 0xff
+	}
+	_, err := m.w.Write(p)
+	return err
+}
+
+// WriteVideo writes a video access unit.
+func (m *Muxer) WriteVideo(pts, dts uint64, keyframe bool, data []byte) error {
+	return m.writePES(pidVideo, streamIDVideo, pts, dts, keyframe, true, data)
+}
+
+// WriteAudio writes an audio frame, which carries the clock when there is no video.
+func (m *Muxer) WriteAudio(pts uint64, data []byte) error {
+	return m.writePES(pidAudio, streamIDAudio, pts, pts, false, m.videoType == 0, data)
+}
+
+// writePES writes an elementary stream packet, split in transport stream packets.
+func (m *Muxer) writePES(pid uint16, streamID byte, pts, dts uint64, randomAccess, withPCR bool, data []byte) error {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 5}
+	header = appendTimestamp(header, 0x20, pts)
+	if dts != pts {
+		header[7], header[8] = 0xc0, 10
+		header[len(header)-5] |= 0x10
+		header = appendTimestamp(header, 0x10, dts)
+	}
+
+	// The length of the video packets may exceed 16 bits, so it is left unbounded
+	if length := len(header) - 6 + len(data); streamID != streamIDVideo && length <= 0xffff {
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+
+	payload := append(header, data...)
+	first := true
+	for len(payload) > 0 {
+		p := m.packet[:]
+		m.writeHeader(p, pid, first)
+
+		// The adaptation field carries the clock and the random access indicator on the
+		// first packet, and the stuffing on the last one
+		var adaptation []byte
+		hasAdaptation := first && (withPCR || randomAccess)
+		if hasAdaptation {
+			adaptation = []byte{0x00}
+			if randomAccess {
+				adaptation[0] |= 0x40
+			}
+			if withPCR {
+				adaptation[0] |= 0x10
+				adaptation = appendPCR(adaptation, dts)
+			}
+		}
+
+		space := PacketSize - 4
+		if hasAdaptation {
+			space -= 1 + len(adaptation)
+		}
+		if len(payload) < space {
+			stuffing := space - len(payload)
+			if !hasAdaptation {
+				hasAdaptation = true
+				stuffing-- // The length of the adaptation field
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0x00) // The flags
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xff)
+			}
+			space = len(payload)
+		}
+
+		n := 4
+		if hasAdaptation {
+			p[3] |= 0x20
+			p[4] = byte(len(adaptation))
+			n += 1 + copy(p[5:], adaptation)
+		}
+		n += copy(p[n:], payload[:space])
+		payload = payload[space:]
+		first = false
+		if _, err := m.w.Write(p[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader writes the header of a packet with a payload, and increments the
+// continuity counter of its packet identifier.
+func (m *Muxer) writeHeader(p []byte, pid uint16, start bool) {
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+
+	p[0] = 0x47
+	p[1] = byte(pid >> 8 & 0x1f)
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	p[3] = 0x10 | cc
+}
+
+// appendTimestamp appends a 33 bits timestamp of a PES header, with its 4 bits prefix.
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix|byte(ts>>29)&0x0e|0x01,
+		byte(ts>>22),
+		byte(ts>>14)|0x01,
+		byte(ts>>7),
+		byte(ts<<1)|0x01,
+	)
+}
+
+// appendPCR appends a program clock reference, without its extension.
+func appendPCR(b []byte, pcr uint64) []byte {
+	return append(b,
+		byte(pcr>>25),
+		byte(pcr>>17),
+		byte(pcr>>9),
+		byte(pcr>>1),
+		byte(pcr<<7)|0x7e,
+		0x00,
+	)
+}
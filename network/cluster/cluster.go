@@ -0,0 +1,539 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// The frame types handled by the cluster itself, the others are handed over.
+const (
+	frameHello  = "hello"
+	frameProof  = "proof"
+	frameGossip = "gossip"
+)
+
+// The roles of the two ends of a connection, which the proofs and the keys are bound to.
+const (
+	roleDialer   = "dialer"
+	roleAcceptor = "acceptor"
+)
+
+const (
+	handshakeTimeout = 5 * time.Second
+	writeTimeout     = 10 * time.Second
+	queueSize        = 4096 // The number of frames queued for a peer.
+)
+
+// Errors returned by the cluster.
+var (
+	ErrClosed      = errors.New("cluster: closed")
+	ErrUnknownPeer = errors.New("cluster: unknown peer")
+	ErrQueueFull   = errors.New("cluster: peer queue full")
+	ErrNoSecret    = errors.New("cluster: no shared secret")
+)
+
+// Options represents the options of a cluster node.
+type Options struct {
+	Name           string        // The unique name of this node.
+	Bind           string        // The address to listen on for the peers.
+	Advertise      string        // The address the peers dial, the bind address by default.
+	Seeds          []string      // The addresses of the nodes to join on startup.
+	Secret         string        // The secret shared by the nodes, which proves their membership.
+	GossipInterval time.Duration // The interval between two gossip rounds.
+	DeadTimeout    time.Duration // The silence after which a peer is considered gone.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		Bind:           "127.0.0.1:7946",
+		GossipInterval: time.Second,
+		DeadTimeout:    5 * time.Second,
+	}
+}
+
+// Frame represents a message exchanged between two nodes, encoded as a JSON object
+// per line.
+type Frame struct {
+	Type    string          `json:"type"`
+	From    string          `json:"from,omitempty"`
+	Addr    string          `json:"addr,omitempty"`
+	Members []Member        `json:"members,omitempty"`
+	Filters []string        `json:"filters,omitempty"`
+	Nonce   string          `json:"nonce,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// sealed represents a frame sent once connected, authenticated with the key of its
+// direction and its position on the connection, so it can be neither forged nor
+// replayed.
+type sealed struct {
+	Frame json.RawMessage `json:"frame"`
+	MAC   string          `json:"mac"`
+}
+
+// Member represents a node of the cluster.
+type Member struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// Handler receives the membership changes and the frames sent by the peers. The calls
+// for a given peer are made in order, from the goroutine reading its connection.
+type Handler interface {
+	OnJoin(node string)
+	OnLeave(node string)
+	OnFrame(node string, f *Frame)
+}
+
+// Cluster represents this node within a full mesh of nodes. The nodes join through a
+// static list of seeds, then learn about the rest of the cluster by gossiping their
+// members to each other. Every pair of nodes shares a single TCP connection, which is
+// used for both the heartbeats and the frames of the handler. A peer is gone once its
+// connection breaks or it stays silent for longer than the dead timeout.
+type Cluster struct {
+	sync.Mutex
+	opts      Options
+	handler   Handler
+	listener  net.Listener
+	peers     map[string]*peer  // The connected peers by name.
+	dialing   map[string]bool   // The addresses being dialed.
+	resolved  map[string]string // The names of the nodes behind the dialed addresses.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// peer represents the connection to another node.
+type peer struct {
+	Member
+	conn      net.Conn
+	dialer    string // The name of the node which dialed the connection.
+	sendKey   []byte // The key authenticating the frames sent.
+	recvKey   []byte // The key authenticating the frames received.
+	sent      uint64 // The number of frames sent, only used by the writer.
+	received  uint64 // The number of frames received, only used by the reader.
+	out       chan *Frame
+	lastSeen  int64
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a cluster node, which starts connecting once started.
+func New(opts Options, handler Handler) *Cluster {
+	if opts.Advertise == "" {
+		opts.Advertise = opts.Bind
+	}
+	return &Cluster{
+		opts:     opts,
+		handler:  handler,
+		peers:    make(map[string]*peer),
+		dialing:  make(map[string]bool),
+		resolved: make(map[string]string),
+		closing:  make(chan struct{}),
+	}
+}
+
+// Name returns the name of this node.
+func (c *Cluster) Name() string {
+	return c.opts.Name
+}
+
+// Start listens for the peers and joins the seeds.
+func (c *Cluster) Start() (err error) {
+	if c.opts.Secret == "" {
+		return ErrNoSecret
+	}
+	if c.opts.GossipInterval <= 0 || c.opts.DeadTimeout <= 0 {
+		return errors.New("cluster: the gossip interval and dead timeout must be positive")
+	}
+	if c.listener, err = net.Listen("tcp", c.opts.Bind); err != nil {
+		return err
+	}
+
+	logging.Infof("cluster: node %s listening on %s", c.opts.Name, c.listener.Addr())
+	go c.accept()
+	go c.maintain()
+	c.joinSeeds()
+	return nil
+}
+
+// Send queues a frame for a peer, without waiting for it to be written.
+func (c *Cluster) Send(node string, f *Frame) error {
+	c.Lock()
+	p, ok := c.peers[node]
+	c.Unlock()
+	if !ok {
+		return ErrUnknownPeer
+	}
+	return p.send(f)
+}
+
+// Broadcast queues a frame for all of the peers.
+func (c *Cluster) Broadcast(f *Frame) {
+	for _, p := range c.connected() {
+		if err := p.send(f); err != nil {
+			logging.Error("cluster: unable to send to", p.Name, err)
+		}
+	}
+}
+
+// Members returns the connected peers, sorted by name.
+func (c *Cluster) Members() []Member {
+	peers := c.connected()
+	members := make([]Member, 0, len(peers))
+	for _, p := range peers {
+		m := p.Member
+		m.LastSeen = time.Unix(0, atomic.LoadInt64(&p.lastSeen)).UTC()
+		members = append(members, m)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+// Close leaves the cluster.
+func (c *Cluster) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		if c.listener != nil {
+			c.listener.Close()
+		}
+		for _, p := range c.connected() {
+			p.close()
+		}
+	})
+	return nil
+}
+
+// connected returns the connected peers.
+func (c *Cluster) connected() []*peer {
+	c.Lock()
+	defer c.Unlock()
+
+	peers := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// accept accepts the connections of the peers until the cluster is closed.
+func (c *Cluster) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			select {
+			case <-c.closing:
+			default:
+				logging.Error("cluster: listener stopped", err)
+			}
+			return
+		}
+		go c.handshake(conn, "")
+	}
+}
+
+// maintain gossips the members to the peers, drops the silent ones and rejoins the
+// seeds which are not connected, until the cluster is closed.
+func (c *Cluster) maintain() {
+	ticker := time.NewTicker(c.opts.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-ticker.C:
+			gossip := &Frame{Type: frameGossip, Members: c.Members()}
+			deadline := time.Now().Add(-c.opts.DeadTimeout).UnixNano()
+			for _, p := range c.connected() {
+				if atomic.LoadInt64(&p.lastSeen) < deadline {
+					logging.Info("cluster: peer", p.Name, "timed out")
+					p.close()
+					continue
+				}
+				p.send(gossip)
+			}
+			c.joinSeeds()
+		}
+	}
+}
+
+// joinSeeds dials the seeds which are not connected.
+func (c *Cluster) joinSeeds() {
+	for _, addr := range c.opts.Seeds {
+		c.dial(addr)
+	}
+}
+
+// dial connects to a node, unless already connected or being dialed.
+func (c *Cluster) dial(addr string) {
+	if addr == c.opts.Advertise {
+		return
+	}
+
+	c.Lock()
+	if name, ok := c.resolved[addr]; c.dialing[addr] || ok && (name == c.opts.Name || c.peers[name] != nil) {
+		c.Unlock()
+		return
+	}
+	for _, p := range c.peers {
+		if p.Addr == addr {
+			c.Unlock()
+			return
+		}
+	}
+	c.dialing[addr] = true
+	c.Unlock()
+
+	go func() {
+		defer func() {
+			c.Lock()
+			delete(c.dialing, addr)
+			c.Unlock()
+		}()
+
+		conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+		if err != nil {
+			return
+		}
+		c.handshake(conn, addr)
+	}()
+}
+
+// handshake exchanges the names of the nodes over a new connection, dialed to the
+// address or accepted when empty, then serves it until it breaks. Each node proves it
+// knows the shared secret by signing the handshake of the connection: both random
+// nonces, both names and its own role, so a proof can not be replayed on another
+// connection nor reflected in the other direction. The secret itself never goes over
+// the connection, and the frames which follow are authenticated with keys derived
+// from the same handshake.
+func (c *Cluster) handshake(conn net.Conn, addr string) {
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return
+	}
+
+	own := &Frame{Type: frameHello, From: c.opts.Name, Addr: c.opts.Advertise, Nonce: hex.EncodeToString(nonce[:])}
+	var hello, proof Frame
+	if err := enc.Encode(own); err != nil {
+		conn.Close()
+		return
+	}
+	if err := dec.Decode(&hello); err != nil || hello.Type != frameHello || hello.From == "" || hello.Nonce == "" {
+		conn.Close()
+		return
+	}
+
+	role, peerRole, dialer, acceptor := roleAcceptor, roleDialer, &hello, own
+	if addr != "" {
+		role, peerRole, dialer, acceptor = roleDialer, roleAcceptor, own, &hello
+	}
+	if err := enc.Encode(&Frame{Type: frameProof, Nonce: hex.EncodeToString(c.sign("proof", role, dialer, acceptor))}); err != nil {
+		conn.Close()
+		return
+	}
+	if err := dec.Decode(&proof); err != nil || proof.Type != frameProof ||
+		!hmac.Equal([]byte(proof.Nonce), []byte(hex.EncodeToString(c.sign("proof", peerRole, dialer, acceptor)))) {
+		logging.Info("cluster: refused the node", hello.From, "from", conn.RemoteAddr(), "with an invalid proof")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Remember who is behind the address, so it is not dialed again while connected
+	if addr != "" {
+		c.Lock()
+		c.resolved[addr] = hello.From
+		c.Unlock()
+	}
+	if hello.From == c.opts.Name {
+		conn.Close()
+		return
+	}
+
+	p := &peer{
+		Member:   Member{Name: hello.From, Addr: hello.Addr},
+		conn:     conn,
+		dialer:   dialer.From,
+		sendKey:  c.sign("frames", role, dialer, acceptor),
+		recvKey:  c.sign("frames", peerRole, dialer, acceptor),
+		out:      make(chan *Frame, queueSize),
+		lastSeen: time.Now().UnixNano(),
+		closing:  make(chan struct{}),
+	}
+	if !c.register(p) {
+		conn.Close()
+		return
+	}
+
+	logging.Info("cluster: peer", p.Name, "joined from", p.Addr)
+	go p.write(enc)
+	c.handler.OnJoin(p.Name)
+	c.read(p, dec)
+}
+
+// sign signs the handshake of a connection for a purpose and a role, with the nonces
+// and the names of the dialer then the acceptor.
+func (c *Cluster) sign(purpose, role string, dialer, acceptor *Frame) []byte {
+	mac := hmac.New(sha256.New, []byte(c.opts.Secret))
+	for _, field := range []string{purpose, role, dialer.Nonce, acceptor.Nonce, dialer.From, acceptor.From} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write([]byte(field))
+	}
+	return mac.Sum(nil)
+}
+
+// register adds a connected peer. When both nodes dial each other at the same time,
+// both keep the connection dialed by the node with the lowest name.
+func (c *Cluster) register(p *peer) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+
+	if existing, ok := c.peers[p.Name]; ok {
+		preferred := c.opts.Name
+		if p.Name < preferred {
+			preferred = p.Name
+		}
+		if existing.dialer == preferred || p.dialer != preferred {
+			return false
+		}
+		existing.close()
+	}
+
+	c.peers[p.Name] = p
+	return true
+}
+
+// read handles the frames of a peer until its connection breaks.
+func (c *Cluster) read(p *peer, dec *json.Decoder) {
+	defer func() {
+		p.close()
+		c.Lock()
+		current := c.peers[p.Name] == p
+		if current {
+			delete(c.peers, p.Name)
+		}
+		c.Unlock()
+
+		if current {
+			logging.Info("cluster: peer", p.Name, "left")
+			c.handler.OnLeave(p.Name)
+		}
+	}()
+
+	for {
+		var s sealed
+		if err := dec.Decode(&s); err != nil {
+			return
+		}
+		if !hmac.Equal([]byte(s.MAC), []byte(authenticate(p.recvKey, p.received, s.Frame))) {
+			logging.Info("cluster: dropped the peer", p.Name, "after an unauthenticated frame")
+			return
+		}
+		p.received++
+
+		var f Frame
+		if err := json.Unmarshal(s.Frame, &f); err != nil {
+			return
+		}
+		atomic.StoreInt64(&p.lastSeen, time.Now().UnixNano())
+
+		switch f.Type {
+		case frameGossip:
+			for _, m := range f.Members {
+				if m.Name != c.opts.Name && !c.isConnected(m.Name) {
+					c.dial(m.Addr)
+				}
+			}
+		default:
+			c.handler.OnFrame(p.Name, &f)
+		}
+	}
+}
+
+// isConnected returns whether a node is connected.
+func (c *Cluster) isConnected(node string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.peers[node]
+	return ok
+}
+
+// ------------------------------------------------------------------------------------
+
+// send queues a frame, without blocking.
+func (p *peer) send(f *Frame) error {
+	select {
+	case <-p.closing:
+		return ErrClosed
+	case p.out <- f:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// write writes the queued frames until the connection is closed.
+func (p *peer) write(enc *json.Encoder) {
+	for {
+		select {
+		case <-p.closing:
+			return
+		case f := <-p.out:
+			data, err := json.Marshal(f)
+			if err != nil {
+				logging.Error("cluster: unable to encode a frame for", p.Name, err)
+				continue
+			}
+
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := enc.Encode(&sealed{Frame: data, MAC: authenticate(p.sendKey, p.sent, data)}); err != nil {
+				p.close()
+				return
+			}
+			p.sent++
+		}
+	}
+}
+
+// close closes the connection, which ends the reading of its frames.
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.conn.Close()
+	})
+}
+
+// authenticate returns the code authenticating an encoded frame at a position on the
+// connection.
+func authenticate(key []byte, seq uint64, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, seq)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a handler recording the membership changes and the frames.
+type recorder struct {
+	sync.Mutex
+	joined map[string]bool
+	left   map[string]bool
+	frames []*Frame
+}
+
+func newRecorder() *recorder {
+	return &recorder{joined: make(map[string]bool), left: make(map[string]bool)}
+}
+
+func (r *recorder) OnJoin(node string) {
+	r.Lock()
+	defer r.Unlock()
+	r.joined[node] = true
+}
+
+func (r *recorder) OnLeave(node string) {
+	r.Lock()
+	defer r.Unlock()
+	r.left[node] = true
+}
+
+func (r *recorder) OnFrame(node string, f *Frame) {
+	r.Lock()
+	defer r.Unlock()
+	f.From = node
+	r.frames = append(r.frames, f)
+}
+
+func (r *recorder) hasLeft(node string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.left[node]
+}
+
+func (r *recorder) received() []*Frame {
+	r.Lock()
+	defer r.Unlock()
+	return append([]*Frame(nil), r.frames...)
+}
+
+// freeAddr returns a local address with a free port.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startNode starts a node on a local port, joining the seeds.
+func startNode(t *testing.T, name, secret string, seeds ...string) (*Cluster, *recorder) {
+	opts := DefaultOptions()
+	opts.Name = name
+	opts.Bind = freeAddr(t)
+	opts.Secret = secret
+	opts.Seeds = seeds
+	opts.GossipInterval = 50 * time.Millisecond
+	opts.DeadTimeout = time.Second
+
+	r := newRecorder()
+	c := New(opts, r)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, r
+}
+
+// eventually waits for a condition, failing the test if it does not hold in time.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// memberNames returns the names of the members of a node.
+func memberNames(c *Cluster) map[string]bool {
+	names := make(map[string]bool)
+	for _, m := range c.Members() {
+		names[m.Name] = true
+	}
+	return names
+}
+
+func TestJoinGossipLeave(t *testing.T) {
+	a, ra := startNode(t, "a", "secret")
+	b, rb := startNode(t, "b", "secret", a.opts.Advertise)
+	c, _ := startNode(t, "c", "secret", a.opts.Advertise)
+
+	// The seeds introduce b and c to each other
+	for _, n := range []*Cluster{a, b, c} {
+		n := n
+		eventually(t, n.Name()+" to see the full mesh", func() bool {
+			return len(n.Members()) == 2
+		})
+	}
+	if names := memberNames(b); !names["a"] || !names["c"] {
+		t.Fatalf("b sees %v", names)
+	}
+
+	c.Close()
+	eventually(t, "a to see c leave", func() bool { return ra.hasLeft("c") })
+	eventually(t, "b to see c leave", func() bool { return rb.hasLeft("c") })
+	if names := memberNames(a); len(names) != 1 || !names["b"] {
+		t.Fatalf("a sees %v after c left", names)
+	}
+}
+
+func TestSend(t *testing.T) {
+	a, ra := startNode(t, "a", "secret")
+	b, rb := startNode(t, "b", "secret", a.opts.Advertise)
+	eventually(t, "b to join", func() bool { return len(a.Members()) == 1 && len(b.Members()) == 1 })
+
+	if err := a.Send("b", &Frame{Type: "publish", Data: []byte(`{"topic":"a/b"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	b.Broadcast(&Frame{Type: "interest", Filters: []string{"x/#"}})
+
+	eventually(t, "b to receive the frame", func() bool { return len(rb.received()) == 1 })
+	if f := rb.received()[0]; f.From != "a" || f.Type != "publish" || string(f.Data) != `{"topic":"a/b"}` {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	eventually(t, "a to receive the broadcast", func() bool { return len(ra.received()) == 1 })
+	if f := ra.received()[0]; f.From != "b" || len(f.Filters) != 1 || f.Filters[0] != "x/#" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	if err := a.Send("nobody", &Frame{Type: "publish"}); err != ErrUnknownPeer {
+		t.Fatalf("send to an unknown peer: %v", err)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	a, _ := startNode(t, "a", "secret")
+	b, _ := startNode(t, "b", "guessed", a.opts.Advertise)
+
+	time.Sleep(300 * time.Millisecond)
+	if len(a.Members()) != 0 || len(b.Members()) != 0 {
+		t.Fatalf("nodes joined with different secrets: %v, %v", a.Members(), b.Members())
+	}
+}
+
+// attacker represents a connection opened to a node by someone without the secret.
+type attacker struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func dialAttacker(t *testing.T, addr string) *attacker {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return &attacker{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+}
+
+func (a *attacker) read(t *testing.T) *Frame {
+	t.Helper()
+	var f Frame
+	if err := a.dec.Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	return &f
+}
+
+func (a *attacker) write(t *testing.T, f *Frame) {
+	t.Helper()
+	if err := a.enc.Encode(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayedProof(t *testing.T) {
+	a, _ := startNode(t, "a", "secret")
+	b, _ := startNode(t, "b", "secret")
+
+	// Pose as b to a, with the proof b signed for the nonce of a
+	toA := dialAttacker(t, a.opts.Advertise)
+	helloA := toA.read(t)
+	toB := dialAttacker(t, b.opts.Advertise)
+	helloB := toB.read(t)
+	toB.write(t, &Frame{Type: frameHello, From: "a", Addr: a.opts.Advertise, Nonce: helloA.Nonce})
+	proofB := toB.read(t)
+
+	toA.write(t, &Frame{Type: frameHello, From: "b", Addr: b.opts.Advertise, Nonce: helloB.Nonce})
+	toA.read(t) // The proof of a
+	toA.write(t, proofB)
+
+	var f Frame
+	if err := toA.dec.Decode(&f); err == nil {
+		t.Fatalf("connection kept after a relayed proof, got %+v", f)
+	}
+	if len(a.Members()) != 0 {
+		t.Fatalf("a accepted a relayed proof: %v", a.Members())
+	}
+}
+
+func TestForgedFrame(t *testing.T) {
+	a, ra := startNode(t, "a", "secret")
+	b, rb := startNode(t, "b", "secret", a.opts.Advertise)
+	eventually(t, "b to join", func() bool { return len(a.Members()) == 1 && len(b.Members()) == 1 })
+
+	// A frame without a valid code drops the connection before reaching the handler
+	a.Lock()
+	p := a.peers["b"]
+	a.Unlock()
+	data, _ := json.Marshal(&Frame{Type: "publish"})
+	json.NewEncoder(p.conn).Encode(&sealed{Frame: data, MAC: "00"})
+
+	eventually(t, "b to drop a", func() bool { return rb.hasLeft("a") })
+	eventually(t, "a to see b leave", func() bool { return ra.hasLeft("b") })
+	if n := len(rb.received()); n != 0 {
+		t.Fatalf("b handled %d forged frames", n)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Name, opts.Bind = "a", freeAddr(t)
+	if err := New(opts, newRecorder()).Start(); err != ErrNoSecret {
+		t.Fatalf("start without a secret: %v", err)
+	}
+
+	opts.Secret, opts.GossipInterval = "secret", 0
+	if err := New(opts, newRecorder()).Start(); err == nil {
+		t.Fatal("start without a gossip interval")
+	}
+}
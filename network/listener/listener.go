@@ -89,12 +89,12 @@ func (m *Listener) Accept() (net.Conn, error) {
 
 // ServeAsync adds a protocol based on the matcher and serves it.
 func (m *Listener) ServeAsync(serve func(l net.Listener) error) {
-	// ml := muxListener{
-	// 	Listener:    m.root,
-	// 	connections: make(chan net.Conn, m.bufferSize),
-	// }
-	// go serve(ml)
-	go serve(m.root)
+	ml := muxListener{
+		Listener:    m.root,
+		connections: m.connections,
+		closing:     m.closing,
+	}
+	go serve(ml)
 }
 
 // SetReadTimeout sets a timeout for the read of matchers.
@@ -178,20 +178,25 @@ func (m *Listener) Close() error {
 	return m.root.Close()
 }
 
-// // ------------------------------------------------------------------------------------
+// ------------------------------------------------------------------------------------
 
-// type muxListener struct {
-// 	net.Listener
-// 	connections chan net.Conn
-// }
+// muxListener is the listener handed to the servers, which accepts the connections
+// once they have been sniffed by the root listener.
+type muxListener struct {
+	net.Listener
+	connections chan net.Conn
+	closing     chan struct{}
+}
 
-// func (l muxListener) Accept() (net.Conn, error) {
-// 	c, ok := <-l.connections
-// 	if !ok {
-// 		return nil, ErrListenerClosed
-// 	}
-// 	return c, nil
-// }
+// Accept waits for and returns the next sniffed connection.
+func (l muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connections:
+		return c, nil
+	case <-l.closing:
+		return nil, ErrListenerClosed
+	}
+}
 
 // ------------------------------------------------------------------------------------
 
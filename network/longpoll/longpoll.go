@@ -0,0 +1,473 @@
+package longpoll
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	maxPending   = 1 << 20 // The maximum number of unacknowledged downlink bytes.
+	maxFrameSize = 1 << 16 // The maximum size of an uplink frame.
+)
+
+// The timeouts used when not set to a positive duration.
+const (
+	DefaultPollTimeout = 25 * time.Second
+	DefaultIdleTimeout = 60 * time.Second
+)
+
+// Errors returned by the long-polling sessions.
+var (
+	ErrClosed  = errors.New("longpoll: session closed")
+	errTimeout = timeoutError{}
+)
+
+// timeoutError is returned when a deadline is exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "longpoll: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Server serves the long-polling sessions over HTTP, and hands each new session over
+// as a net.Conn. A session is opened with a POST on "open", then the client POSTs the
+// uplink frames on "<session>?seq=<n>" and GETs the downlink data on "<session>?ack=<n>",
+// which blocks until some data is available or the poll times out.
+type Server struct {
+	sync.Mutex
+	sessions    map[string]*session
+	onAccept    func(net.Conn)
+	pollTimeout time.Duration
+	idleTimeout time.Duration
+	closing     chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewServer creates a new long-polling server, handing over the new sessions to the
+// accept function. The idle sessions are garbage collected. The timeouts which are not
+// positive fall back to their defaults, and a poll timeout not below the idle timeout is
+// clamped to half of it, so a session waiting on a poll is never collected.
+func NewServer(onAccept func(net.Conn), pollTimeout, idleTimeout time.Duration) *Server {
+	if pollTimeout <= 0 {
+		pollTimeout = DefaultPollTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	if pollTimeout >= idleTimeout {
+		pollTimeout = idleTimeout / 2
+	}
+
+	s := &Server{
+		sessions:    make(map[string]*session),
+		onAccept:    onAccept,
+		pollTimeout: pollTimeout,
+		idleTimeout: idleTimeout,
+		closing:     make(chan struct{}),
+	}
+
+	go s.collect()
+	return s
+}
+
+// ServeHTTP handles a long-polling request, with the path relative to the mount point.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	id := strings.Trim(r.URL.Path, "/")
+	if i := strings.LastIndexByte(id, '/'); i >= 0 {
+		id = id[i+1:]
+	}
+
+	if id == "open" && r.Method == http.MethodPost {
+		s.onOpen(w, r)
+		return
+	}
+
+	s.Lock()
+	c, ok := s.sessions[id]
+	s.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	c.touch()
+	switch r.Method {
+	case http.MethodPost:
+		c.onUplink(w, r)
+	case http.MethodGet:
+		c.onPoll(w, r, s.pollTimeout)
+	case http.MethodDelete:
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// onOpen opens a new session and replies with its id.
+func (s *Server) onOpen(w http.ResponseWriter, r *http.Request) {
+	c := newSession(uuid.NewRandom().String(), r.RemoteAddr)
+
+	s.Lock()
+	s.sessions[c.id] = c
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Session string `json:"session"`
+	}{c.id})
+
+	go s.onAccept(c)
+}
+
+// collect periodically removes the idle and the drained closed sessions.
+func (s *Server) collect() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			s.Lock()
+			for id, c := range s.sessions {
+				if c.idle(s.idleTimeout) || c.drained() {
+					c.Close()
+					delete(s.sessions, id)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// Close closes all of the sessions and stops the garbage collection.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+
+		s.Lock()
+		defer s.Unlock()
+		for id, c := range s.sessions {
+			c.Close()
+			delete(s.sessions, id)
+		}
+	})
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// frame represents a chunk of downlink data, kept until acknowledged.
+type frame struct {
+	seq  uint64
+	data []byte
+}
+
+// addr represents the remote address of a session.
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
+
+// session represents a long-polling session, implementing net.Conn.
+type session struct {
+	sync.Mutex
+	id            string
+	remote        addr
+	uplink        bytes.Buffer  // The received uplink data, not read yet.
+	upSeq         uint64        // The sequence of the last uplink frame received.
+	downlink      []frame       // The downlink frames not acknowledged yet.
+	downSeq       uint64        // The sequence of the last downlink frame written.
+	pending       int           // The number of bytes not acknowledged yet.
+	readable      chan struct{} // Signaled when uplink data is received.
+	polled        chan struct{} // Signaled when downlink data is written.
+	acked         chan struct{} // Signaled when downlink data is acknowledged.
+	closed        chan struct{}
+	closeOnce     sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lastSeen      time.Time
+}
+
+// newSession creates a new session.
+func newSession(id, remote string) *session {
+	return &session{
+		id:       id,
+		remote:   addr(remote),
+		readable: make(chan struct{}, 1),
+		polled:   make(chan struct{}, 1),
+		acked:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+}
+
+// onUplink receives an uplink frame. A retried frame is acknowledged again but not
+// appended twice, a frame received out of order is rejected.
+func (c *session) onUplink(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence", http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFrameSize))
+	if err != nil {
+		http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	c.Lock()
+	switch {
+	case c.isClosed():
+		c.Unlock()
+		http.Error(w, ErrClosed.Error(), http.StatusGone)
+		return
+	case seq > c.upSeq+1:
+		c.Unlock()
+		http.Error(w, "out of order frame", http.StatusConflict)
+		return
+	case seq == c.upSeq+1:
+		c.uplink.Write(data)
+		c.upSeq = seq
+		notify(c.readable)
+	}
+	upSeq := c.upSeq
+	c.Unlock()
+
+	w.Header().Set("X-Seq", strconv.FormatUint(upSeq, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// onPoll acknowledges the downlink frames up to the acknowledged sequence, then waits
+// for downlink data and replies with all of the unacknowledged frames, so a retried
+// poll receives the same data again.
+func (c *session) onPoll(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	ack, _ := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64)
+	c.acknowledge(ack)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.Lock()
+		if len(c.downlink) > 0 {
+			var body bytes.Buffer
+			for _, f := range c.downlink {
+				body.Write(f.data)
+			}
+			last := c.downlink[len(c.downlink)-1].seq
+			c.Unlock()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Seq", strconv.FormatUint(last, 10))
+			w.Write(body.Bytes())
+			return
+		}
+		closed := c.isClosed()
+		c.Unlock()
+
+		if closed {
+			http.Error(w, ErrClosed.Error(), http.StatusGone)
+			return
+		}
+
+		select {
+		case <-c.polled:
+		case <-c.closed:
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			w.Header().Set("X-Seq", strconv.FormatUint(ack, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
+
+// acknowledge drops the downlink frames up to the sequence.
+func (c *session) acknowledge(seq uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	i := 0
+	for ; i < len(c.downlink) && c.downlink[i].seq <= seq; i++ {
+		c.pending -= len(c.downlink[i].data)
+	}
+	if i > 0 {
+		c.downlink = c.downlink[i:]
+		notify(c.acked)
+	}
+}
+
+// Read reads the uplink data, blocking until some is received.
+func (c *session) Read(b []byte) (int, error) {
+	for {
+		c.Lock()
+		if c.uplink.Len() > 0 {
+			n, _ := c.uplink.Read(b)
+			c.Unlock()
+			return n, nil
+		}
+		deadline := c.readDeadline
+		c.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			if err == ErrClosed {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+	}
+}
+
+// Write queues the downlink data for the next poll, blocking while too much data is
+// waiting for an acknowledgement.
+func (c *session) Write(b []byte) (int, error) {
+	for {
+		c.Lock()
+		if c.isClosed() {
+			c.Unlock()
+			return 0, ErrClosed
+		}
+		if c.pending < maxPending {
+			c.downSeq++
+			c.downlink = append(c.downlink, frame{seq: c.downSeq, data: append([]byte(nil), b...)})
+			c.pending += len(b)
+			c.Unlock()
+
+			notify(c.polled)
+			return len(b), nil
+		}
+		deadline := c.writeDeadline
+		c.Unlock()
+
+		if err := c.wait(c.acked, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait waits for a signal, the session to be closed or the deadline to be exceeded.
+func (c *session) wait(signal chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-signal:
+		return nil
+	case <-c.closed:
+		return ErrClosed
+	case <-timeout:
+		return errTimeout
+	}
+}
+
+// Close closes the session.
+func (c *session) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// isClosed returns whether the session is closed.
+func (c *session) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// touch records the activity of the client.
+func (c *session) touch() {
+	c.Lock()
+	defer c.Unlock()
+	c.lastSeen = time.Now()
+}
+
+// idle returns whether the client has not been seen for the duration.
+func (c *session) idle(timeout time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	return time.Since(c.lastSeen) > timeout
+}
+
+// drained returns whether the session is closed and its downlink data acknowledged.
+func (c *session) drained() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.isClosed() && len(c.downlink) == 0
+}
+
+// Transport returns the name of the transport.
+func (c *session) Transport() string {
+	return "longpoll"
+}
+
+// LocalAddr returns the local network address.
+func (c *session) LocalAddr() net.Addr {
+	return addr("")
+}
+
+// RemoteAddr returns the remote network address.
+func (c *session) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines associated with the session.
+func (c *session) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any currently-blocked
+// Read call.
+func (c *session) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any currently-blocked
+// Write call.
+func (c *session) SetWriteDeadline(t time.Time) error {
+	c.Lock()
+	c.writeDeadline = t
+	c.Unlock()
+	notify(c.acked)
+	return nil
+}
+
+// notify signals a channel without blocking.
+func notify(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
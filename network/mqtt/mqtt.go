@@ -0,0 +1,820 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types as defined in the MQTT 3.1.1 specification, which MQTT 5 extends with
+// properties and reason codes.
+const (
+	TypeOfConnect = uint8(iota + 1)
+	TypeOfConnack
+	TypeOfPublish
+	TypeOfPuback
+	TypeOfPubrec
+	TypeOfPubrel
+	TypeOfPubcomp
+	TypeOfSubscribe
+	TypeOfSuback
+	TypeOfUnsubscribe
+	TypeOfUnsuback
+	TypeOfPingreq
+	TypeOfPingresp
+	TypeOfDisconnect
+)
+
+// Return codes of a CONNACK packet.
+const (
+	Accepted = uint8(iota)
+	ErrRefusedBadProtocolVersion
+	ErrRefusedIDRejected
+	ErrRefusedServerUnavailable
+	ErrRefusedBadUsernameOrPassword
+	ErrRefusedNotAuthorised
+)
+
+// SubackFailure is the return code of a SUBACK for a rejected subscription.
+const SubackFailure = uint8(0x80)
+
+// Protocol versions
+const (
+	Version31  = uint8(3)
+	Version311 = uint8(4)
+	Version5   = uint8(5)
+)
+
+// MaxMessageSize is the default maximum size of a packet.
+const MaxMessageSize = 65536
+
+// Decoding errors
+var (
+	ErrMessageTooLarge     = errors.New("mqtt: message size exceeds the limit")
+	ErrMalformedLength     = errors.New("mqtt: malformed remaining length")
+	ErrMalformedPacket     = errors.New("mqtt: malformed packet")
+	ErrUnknownPacketType   = errors.New("mqtt: unknown packet type")
+	ErrInvalidQoS          = errors.New("mqtt: invalid QoS level")
+	ErrUnsupportedProtocol = errors.New("mqtt: unsupported protocol")
+)
+
+// Reader is the required reader for an efficient decoding.
+type Reader interface {
+	io.Reader
+	ReadByte() (byte, error)
+}
+
+// Message represents a message which can be encoded and sent over the wire.
+type Message interface {
+	fmt.Stringer
+	Type() uint8
+	EncodeTo(w io.Writer) (int, error)
+}
+
+// Header represents the fixed header flags of a PUBLISH packet.
+type Header struct {
+	DUP    bool
+	Retain bool
+	QOS    uint8
+}
+
+// TopicQOSTuple is a struct for pairing the QoS and topic together for the
+// SUBSCRIBE packets.
+type TopicQOSTuple struct {
+	Qos     uint8
+	Topic   []byte
+	NoLocal bool // Whether the messages published by the subscriber are not sent back to it, with MQTT 5.
+}
+
+// Connect represents a CONNECT packet.
+type Connect struct {
+	ProtoName      []byte
+	Version        uint8
+	UsernameFlag   bool
+	PasswordFlag   bool
+	WillRetainFlag bool
+	WillQOS        uint8
+	WillFlag       bool
+	CleanSeshFlag  bool
+	KeepAlive      uint16
+	ClientID       []byte
+	WillTopic      []byte
+	WillMessage    []byte
+	Username       []byte
+	Password       []byte
+	Properties     Properties // The properties, MQTT 5 only.
+	WillProperties Properties // The properties of the will message, MQTT 5 only.
+}
+
+// The packets below carry the protocol version of their connection, the properties and
+// reason codes are only encoded and decoded for MQTT 5.
+
+// Connack represents a CONNACK packet.
+type Connack struct {
+	Version        uint8
+	SessionPresent bool
+	ReturnCode     uint8
+	Properties     Properties
+}
+
+// Publish represents a PUBLISH packet.
+type Publish struct {
+	Header
+	Version    uint8
+	Topic      []byte
+	MessageID  uint16
+	Properties Properties
+	Payload    []byte
+}
+
+// Puback represents a PUBACK packet.
+type Puback struct {
+	Version    uint8
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
+}
+
+// Pubrec represents a PUBREC packet.
+type Pubrec struct {
+	Version    uint8
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
+}
+
+// Pubrel represents a PUBREL packet.
+type Pubrel struct {
+	Version    uint8
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
+}
+
+// Pubcomp represents a PUBCOMP packet.
+type Pubcomp struct {
+	Version    uint8
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
+}
+
+// Subscribe represents a SUBSCRIBE packet.
+type Subscribe struct {
+	Version       uint8
+	MessageID     uint16
+	Properties    Properties
+	Subscriptions []TopicQOSTuple
+}
+
+// Suback represents a SUBACK packet.
+type Suback struct {
+	Version    uint8
+	MessageID  uint16
+	Properties Properties
+	Qos        []uint8
+}
+
+// Unsubscribe represents an UNSUBSCRIBE packet.
+type Unsubscribe struct {
+	Version    uint8
+	MessageID  uint16
+	Properties Properties
+	Topics     [][]byte
+}
+
+// Unsuback represents an UNSUBACK packet.
+type Unsuback struct {
+	Version     uint8
+	MessageID   uint16
+	Properties  Properties
+	ReasonCodes []uint8
+}
+
+// Pingreq represents a PINGREQ packet.
+type Pingreq struct{}
+
+// Pingresp represents a PINGRESP packet.
+type Pingresp struct{}
+
+// Disconnect represents a DISCONNECT packet.
+type Disconnect struct {
+	Version    uint8
+	ReasonCode uint8
+	Properties Properties
+}
+
+// ------------------------------------------------------------------------------------
+
+// Type returns the packet type.
+func (c *Connect) Type() uint8 { return TypeOfConnect }
+
+// Type returns the packet type.
+func (c *Connack) Type() uint8 { return TypeOfConnack }
+
+// Type returns the packet type.
+func (p *Publish) Type() uint8 { return TypeOfPublish }
+
+// Type returns the packet type.
+func (p *Puback) Type() uint8 { return TypeOfPuback }
+
+// Type returns the packet type.
+func (p *Pubrec) Type() uint8 { return TypeOfPubrec }
+
+// Type returns the packet type.
+func (p *Pubrel) Type() uint8 { return TypeOfPubrel }
+
+// Type returns the packet type.
+func (p *Pubcomp) Type() uint8 { return TypeOfPubcomp }
+
+// Type returns the packet type.
+func (s *Subscribe) Type() uint8 { return TypeOfSubscribe }
+
+// Type returns the packet type.
+func (s *Suback) Type() uint8 { return TypeOfSuback }
+
+// Type returns the packet type.
+func (u *Unsubscribe) Type() uint8 { return TypeOfUnsubscribe }
+
+// Type returns the packet type.
+func (u *Unsuback) Type() uint8 { return TypeOfUnsuback }
+
+// Type returns the packet type.
+func (p *Pingreq) Type() uint8 { return TypeOfPingreq }
+
+// Type returns the packet type.
+func (p *Pingresp) Type() uint8 { return TypeOfPingresp }
+
+// Type returns the packet type.
+func (d *Disconnect) Type() uint8 { return TypeOfDisconnect }
+
+// String returns the name of the packet.
+func (c *Connect) String() string { return "connect" }
+
+// String returns the name of the packet.
+func (c *Connack) String() string { return "connack" }
+
+// String returns the name of the packet.
+func (p *Publish) String() string { return "pub" }
+
+// String returns the name of the packet.
+func (p *Puback) String() string { return "puback" }
+
+// String returns the name of the packet.
+func (p *Pubrec) String() string { return "pubrec" }
+
+// String returns the name of the packet.
+func (p *Pubrel) String() string { return "pubrel" }
+
+// String returns the name of the packet.
+func (p *Pubcomp) String() string { return "pubcomp" }
+
+// String returns the name of the packet.
+func (s *Subscribe) String() string { return "sub" }
+
+// String returns the name of the packet.
+func (s *Suback) String() string { return "suback" }
+
+// String returns the name of the packet.
+func (u *Unsubscribe) String() string { return "unsub" }
+
+// String returns the name of the packet.
+func (u *Unsuback) String() string { return "unsuback" }
+
+// String returns the name of the packet.
+func (p *Pingreq) String() string { return "pingreq" }
+
+// String returns the name of the packet.
+func (p *Pingresp) String() string { return "pingresp" }
+
+// String returns the name of the packet.
+func (d *Disconnect) String() string { return "disconnect" }
+
+// ------------------------------------------------------------------------------------
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (c *Connect) EncodeTo(w io.Writer) (int, error) {
+	var flags byte
+	if c.UsernameFlag {
+		flags |= 0x80
+	}
+	if c.PasswordFlag {
+		flags |= 0x40
+	}
+	if c.WillRetainFlag {
+		flags |= 0x20
+	}
+	flags |= (c.WillQOS & 0x03) << 3
+	if c.WillFlag {
+		flags |= 0x04
+	}
+	if c.CleanSeshFlag {
+		flags |= 0x02
+	}
+
+	protoName := c.ProtoName
+	if len(protoName) == 0 {
+		protoName = []byte("MQTT")
+	}
+	version := c.Version
+	if version == 0 {
+		version = 4
+	}
+
+	var buf bytes.Buffer
+	writeBytes(&buf, protoName)
+	buf.WriteByte(version)
+	buf.WriteByte(flags)
+	writeUint16(&buf, c.KeepAlive)
+	if version == Version5 {
+		c.Properties.encode(&buf)
+	}
+	writeBytes(&buf, c.ClientID)
+	if c.WillFlag {
+		if version == Version5 {
+			c.WillProperties.encode(&buf)
+		}
+		writeBytes(&buf, c.WillTopic)
+		writeBytes(&buf, c.WillMessage)
+	}
+	if c.UsernameFlag {
+		writeBytes(&buf, c.Username)
+	}
+	if c.PasswordFlag {
+		writeBytes(&buf, c.Password)
+	}
+	return writePacket(w, TypeOfConnect<<4, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (c *Connack) EncodeTo(w io.Writer) (int, error) {
+	var sp byte
+	if c.SessionPresent {
+		sp = 0x01
+	}
+	if c.Version != Version5 {
+		return writePacket(w, TypeOfConnack<<4, []byte{sp, c.ReturnCode})
+	}
+
+	buf := bytes.NewBuffer([]byte{sp, c.ReturnCode})
+	c.Properties.encode(buf)
+	return writePacket(w, TypeOfConnack<<4, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Publish) EncodeTo(w io.Writer) (int, error) {
+	header := TypeOfPublish<<4 | (p.QOS&0x03)<<1
+	if p.DUP {
+		header |= 0x08
+	}
+	if p.Retain {
+		header |= 0x01
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(p.Topic) + len(p.Payload) + 4)
+	writeBytes(&buf, p.Topic)
+	if p.QOS > 0 {
+		writeUint16(&buf, p.MessageID)
+	}
+	if p.Version == Version5 {
+		p.Properties.encode(&buf)
+	}
+	buf.Write(p.Payload)
+	return writePacket(w, header, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Puback) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPuback<<4, encodeAck(p.Version, p.MessageID, p.ReasonCode, p.Properties))
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Pubrec) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPubrec<<4, encodeAck(p.Version, p.MessageID, p.ReasonCode, p.Properties))
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Pubrel) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPubrel<<4|0x02, encodeAck(p.Version, p.MessageID, p.ReasonCode, p.Properties))
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Pubcomp) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPubcomp<<4, encodeAck(p.Version, p.MessageID, p.ReasonCode, p.Properties))
+}
+
+// encodeAck encodes the body of the acknowledgements of a PUBLISH. With MQTT 5, the
+// reason code and the properties may be omitted on success.
+func encodeAck(version uint8, id uint16, reason uint8, props Properties) []byte {
+	if version != Version5 || (reason == 0 && len(props) == 0) {
+		return encodeUint16(id)
+	}
+
+	buf := bytes.NewBuffer(encodeUint16(id))
+	buf.WriteByte(reason)
+	props.encode(buf)
+	return buf.Bytes()
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (s *Subscribe) EncodeTo(w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	writeUint16(&buf, s.MessageID)
+	if s.Version == Version5 {
+		s.Properties.encode(&buf)
+	}
+	for _, t := range s.Subscriptions {
+		writeBytes(&buf, t.Topic)
+		options := t.Qos & 0x03
+		if s.Version == Version5 && t.NoLocal {
+			options |= 0x04
+		}
+		buf.WriteByte(options)
+	}
+	return writePacket(w, TypeOfSubscribe<<4|0x02, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (s *Suback) EncodeTo(w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	writeUint16(&buf, s.MessageID)
+	if s.Version == Version5 {
+		s.Properties.encode(&buf)
+	}
+	buf.Write(s.Qos)
+	return writePacket(w, TypeOfSuback<<4, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (u *Unsubscribe) EncodeTo(w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	writeUint16(&buf, u.MessageID)
+	if u.Version == Version5 {
+		u.Properties.encode(&buf)
+	}
+	for _, t := range u.Topics {
+		writeBytes(&buf, t)
+	}
+	return writePacket(w, TypeOfUnsubscribe<<4|0x02, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (u *Unsuback) EncodeTo(w io.Writer) (int, error) {
+	if u.Version != Version5 {
+		return writePacket(w, TypeOfUnsuback<<4, encodeUint16(u.MessageID))
+	}
+
+	buf := bytes.NewBuffer(encodeUint16(u.MessageID))
+	u.Properties.encode(buf)
+	buf.Write(u.ReasonCodes)
+	return writePacket(w, TypeOfUnsuback<<4, buf.Bytes())
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Pingreq) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPingreq<<4, nil)
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (p *Pingresp) EncodeTo(w io.Writer) (int, error) {
+	return writePacket(w, TypeOfPingresp<<4, nil)
+}
+
+// EncodeTo writes the encoded packet to the underlying writer.
+func (d *Disconnect) EncodeTo(w io.Writer) (int, error) {
+	if d.Version != Version5 || (d.ReasonCode == 0 && len(d.Properties) == 0) {
+		return writePacket(w, TypeOfDisconnect<<4, nil)
+	}
+
+	buf := bytes.NewBuffer([]byte{d.ReasonCode})
+	d.Properties.encode(buf)
+	return writePacket(w, TypeOfDisconnect<<4, buf.Bytes())
+}
+
+// ------------------------------------------------------------------------------------
+
+// DecodePacket decodes the packet from the provided reader, refusing the packets
+// larger than the maximum size. The packets are decoded according to the protocol
+// version of the connection, except the CONNECT packet which tells the version.
+func DecodePacket(rdr Reader, maxSize uint32, version uint8) (Message, error) {
+	hdr, err := rdr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readLength(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && length > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rdr, buf); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: buf, version: version}
+	switch msgType := hdr >> 4; msgType {
+	case TypeOfConnect:
+		return d.decodeConnect()
+	case TypeOfConnack:
+		c := &Connack{Version: version, SessionPresent: d.byte()&0x01 == 1, ReturnCode: d.byte()}
+		if d.v5() {
+			c.Properties = d.properties()
+		}
+		return c, d.err
+	case TypeOfPublish:
+		return d.decodePublish(hdr)
+	case TypeOfPuback:
+		p := &Puback{Version: version}
+		p.MessageID, p.ReasonCode, p.Properties = d.ack()
+		return p, d.err
+	case TypeOfPubrec:
+		p := &Pubrec{Version: version}
+		p.MessageID, p.ReasonCode, p.Properties = d.ack()
+		return p, d.err
+	case TypeOfPubrel:
+		p := &Pubrel{Version: version}
+		p.MessageID, p.ReasonCode, p.Properties = d.ack()
+		return p, d.err
+	case TypeOfPubcomp:
+		p := &Pubcomp{Version: version}
+		p.MessageID, p.ReasonCode, p.Properties = d.ack()
+		return p, d.err
+	case TypeOfSubscribe:
+		return d.decodeSubscribe()
+	case TypeOfSuback:
+		s := &Suback{Version: version, MessageID: d.uint16()}
+		if d.v5() {
+			s.Properties = d.properties()
+		}
+		s.Qos = d.rest()
+		return s, d.err
+	case TypeOfUnsubscribe:
+		return d.decodeUnsubscribe()
+	case TypeOfUnsuback:
+		u := &Unsuback{Version: version, MessageID: d.uint16()}
+		if d.v5() {
+			u.Properties = d.properties()
+			u.ReasonCodes = d.rest()
+		}
+		return u, d.err
+	case TypeOfPingreq:
+		return &Pingreq{}, nil
+	case TypeOfPingresp:
+		return &Pingresp{}, nil
+	case TypeOfDisconnect:
+		p := &Disconnect{Version: version}
+		if d.v5() && d.more() {
+			p.ReasonCode = d.byte()
+			if d.more() {
+				p.Properties = d.properties()
+			}
+		}
+		return p, d.err
+	default:
+		return nil, ErrUnknownPacketType
+	}
+}
+
+// decoder reads the variable header and the payload of a packet.
+type decoder struct {
+	buf     []byte
+	offset  int
+	err     error
+	version uint8
+}
+
+// v5 returns whether the packet is decoded as MQTT 5.
+func (d *decoder) v5() bool {
+	return d.version == Version5
+}
+
+// ack reads the body of an acknowledgement of a PUBLISH, where the reason code and the
+// properties are optional.
+func (d *decoder) ack() (id uint16, reason uint8, props Properties) {
+	id = d.uint16()
+	if d.v5() && d.more() {
+		reason = d.byte()
+		if d.more() {
+			props = d.properties()
+		}
+	}
+	return
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformedPacket
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.offset+1 > len(d.buf) {
+		d.fail()
+		return 0
+	}
+	b := d.buf[d.offset]
+	d.offset++
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.offset+2 > len(d.buf) {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf[d.offset:])
+	d.offset += 2
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || d.offset+n > len(d.buf) {
+		d.fail()
+		return nil
+	}
+	v := d.buf[d.offset : d.offset+n]
+	d.offset += n
+	return v
+}
+
+func (d *decoder) rest() []byte {
+	if d.offset > len(d.buf) {
+		return nil
+	}
+	v := d.buf[d.offset:]
+	d.offset = len(d.buf)
+	return v
+}
+
+func (d *decoder) more() bool {
+	return d.err == nil && d.offset < len(d.buf)
+}
+
+func (d *decoder) decodeConnect() (Message, error) {
+	c := &Connect{ProtoName: d.bytes(), Version: d.byte()}
+	flags := d.byte()
+	c.UsernameFlag = flags&0x80 > 0
+	c.PasswordFlag = flags&0x40 > 0
+	c.WillRetainFlag = flags&0x20 > 0
+	c.WillQOS = (flags >> 3) & 0x03
+	c.WillFlag = flags&0x04 > 0
+	c.CleanSeshFlag = flags&0x02 > 0
+	c.KeepAlive = d.uint16()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	switch {
+	case string(c.ProtoName) == "MQTT" && (c.Version == Version311 || c.Version == Version5):
+	case string(c.ProtoName) == "MQIsdp" && c.Version == Version31:
+	default:
+		return c, ErrUnsupportedProtocol
+	}
+
+	d.version = c.Version
+	if d.v5() {
+		c.Properties = d.properties()
+	}
+	c.ClientID = d.bytes()
+	if c.WillFlag {
+		if d.v5() {
+			c.WillProperties = d.properties()
+		}
+		c.WillTopic = d.bytes()
+		c.WillMessage = d.bytes()
+	}
+	if c.UsernameFlag {
+		c.Username = d.bytes()
+	}
+	if c.PasswordFlag {
+		c.Password = d.bytes()
+	}
+	return c, d.err
+}
+
+func (d *decoder) decodePublish(hdr byte) (Message, error) {
+	p := &Publish{
+		Header: Header{
+			DUP:    hdr&0x08 > 0,
+			QOS:    (hdr >> 1) & 0x03,
+			Retain: hdr&0x01 > 0,
+		},
+		Version: d.version,
+	}
+	if p.QOS > 2 {
+		return nil, ErrInvalidQoS
+	}
+
+	p.Topic = d.bytes()
+	if p.QOS > 0 {
+		p.MessageID = d.uint16()
+	}
+	if d.v5() {
+		p.Properties = d.properties()
+	}
+	p.Payload = d.rest()
+	return p, d.err
+}
+
+func (d *decoder) decodeSubscribe() (Message, error) {
+	s := &Subscribe{Version: d.version, MessageID: d.uint16()}
+	if d.v5() {
+		s.Properties = d.properties()
+	}
+	for d.more() {
+		topic := d.bytes()
+		qos := d.byte()
+		var noLocal bool
+		if d.v5() {
+			// The other subscription options of MQTT 5 are not supported
+			noLocal = qos&0x04 != 0
+			qos &= 0x03
+		}
+		if qos > 2 {
+			return nil, ErrInvalidQoS
+		}
+		s.Subscriptions = append(s.Subscriptions, TopicQOSTuple{Topic: topic, Qos: qos, NoLocal: noLocal})
+	}
+	if d.err == nil && len(s.Subscriptions) == 0 {
+		d.fail()
+	}
+	return s, d.err
+}
+
+func (d *decoder) decodeUnsubscribe() (Message, error) {
+	u := &Unsubscribe{Version: d.version, MessageID: d.uint16()}
+	if d.v5() {
+		u.Properties = d.properties()
+	}
+	for d.more() {
+		u.Topics = append(u.Topics, d.bytes())
+	}
+	return u, d.err
+}
+
+// ------------------------------------------------------------------------------------
+
+// readLength reads the variable remaining length of the fixed header.
+func readLength(r io.ByteReader) (uint32, error) {
+	var value, multiplier uint32 = 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value += uint32(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedLength
+}
+
+// writePacket writes the fixed header followed by the body of the packet.
+func writePacket(w io.Writer, header byte, body []byte) (int, error) {
+	var head [5]byte
+	head[0] = header
+	n := 1
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		head[n] = b
+		n++
+		if length == 0 {
+			break
+		}
+	}
+
+	// Write in a single call, so the transports emit a single frame per packet
+	out := make([]byte, 0, n+len(body))
+	out = append(out, head[:n]...)
+	out = append(out, body...)
+	return w.Write(out)
+}
+
+func writeBytes(buf *bytes.Buffer, v []byte) {
+	writeUint16(buf, uint16(len(v)))
+	buf.Write(v)
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	buf.Write(encodeUint16(v))
+}
+
+func encodeUint16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
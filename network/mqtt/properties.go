@@ -0,0 +1,250 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Property identifiers as defined in the MQTT 5 specification.
+const (
+	PropPayloadFormat          = 0x01
+	PropMessageExpiry          = 0x02
+	PropContentType            = 0x03
+	PropResponseTopic          = 0x08
+	PropCorrelationData        = 0x09
+	PropSubscriptionIdentifier = 0x0B
+	PropSessionExpiry          = 0x11
+	PropAssignedClientID       = 0x12
+	PropServerKeepAlive        = 0x13
+	PropAuthMethod             = 0x15
+	PropAuthData               = 0x16
+	PropRequestProblemInfo     = 0x17
+	PropWillDelay              = 0x18
+	PropRequestResponseInfo    = 0x19
+	PropResponseInfo           = 0x1A
+	PropServerReference        = 0x1C
+	PropReasonString           = 0x1F
+	PropReceiveMaximum         = 0x21
+	PropTopicAliasMaximum      = 0x22
+	PropTopicAlias             = 0x23
+	PropMaximumQoS             = 0x24
+	PropRetainAvailable        = 0x25
+	PropUserProperty           = 0x26
+	PropMaximumPacketSize      = 0x27
+	PropWildcardSubAvailable   = 0x28
+	PropSubIDAvailable         = 0x29
+	PropSharedSubAvailable     = 0x2A
+)
+
+// Reason codes of MQTT 5 used in place of the 3.1.1 return codes.
+const (
+	ReasonUnspecifiedError           = uint8(0x80)
+	ReasonUnsupportedProtocolVersion = uint8(0x84)
+	ReasonClientIDNotValid           = uint8(0x85)
+	ReasonBadUsernameOrPassword      = uint8(0x86)
+	ReasonNotAuthorized              = uint8(0x87)
+	ReasonServerUnavailable          = uint8(0x88)
+	ReasonSessionTakenOver           = uint8(0x8E)
+	ReasonQuotaExceeded              = uint8(0x97)
+)
+
+// The encodings of the property values.
+const (
+	propByte = iota
+	propUint16
+	propUint32
+	propVarint
+	propString
+	propBinary
+	propPair
+)
+
+// propTypes maps the property identifiers to the encoding of their values.
+var propTypes = map[byte]int{
+	PropPayloadFormat:          propByte,
+	PropMessageExpiry:          propUint32,
+	PropContentType:            propString,
+	PropResponseTopic:          propString,
+	PropCorrelationData:        propBinary,
+	PropSubscriptionIdentifier: propVarint,
+	PropSessionExpiry:          propUint32,
+	PropAssignedClientID:       propString,
+	PropServerKeepAlive:        propUint16,
+	PropAuthMethod:             propString,
+	PropAuthData:               propBinary,
+	PropRequestProblemInfo:     propByte,
+	PropWillDelay:              propUint32,
+	PropRequestResponseInfo:    propByte,
+	PropResponseInfo:           propString,
+	PropServerReference:        propString,
+	PropReasonString:           propString,
+	PropReceiveMaximum:         propUint16,
+	PropTopicAliasMaximum:      propUint16,
+	PropTopicAlias:             propUint16,
+	PropMaximumQoS:             propByte,
+	PropRetainAvailable:        propByte,
+	PropUserProperty:           propPair,
+	PropMaximumPacketSize:      propUint32,
+	PropWildcardSubAvailable:   propByte,
+	PropSubIDAvailable:         propByte,
+	PropSharedSubAvailable:     propByte,
+}
+
+// Property represents a single property of an MQTT 5 packet.
+type Property struct {
+	ID    byte
+	Value uint32 // The value of the integer properties.
+	Data  []byte // The value of the string and binary properties, and of the user properties.
+	Name  []byte // The name of a user property.
+}
+
+// Properties represents the properties of an MQTT 5 packet, in their order on the wire.
+type Properties []Property
+
+// Get returns the first property with the identifier.
+func (p Properties) Get(id byte) (Property, bool) {
+	for _, prop := range p {
+		if prop.ID == id {
+			return prop, true
+		}
+	}
+	return Property{}, false
+}
+
+// User returns the value of the first user property with the name.
+func (p Properties) User(name string) (string, bool) {
+	for _, prop := range p {
+		if prop.ID == PropUserProperty && string(prop.Name) == name {
+			return string(prop.Data), true
+		}
+	}
+	return "", false
+}
+
+// Users returns the values of all of the user properties with the name.
+func (p Properties) Users(name string) (values []string) {
+	for _, prop := range p {
+		if prop.ID == PropUserProperty && string(prop.Name) == name {
+			values = append(values, string(prop.Data))
+		}
+	}
+	return
+}
+
+// AddUser appends a user property.
+func (p *Properties) AddUser(name, value string) {
+	*p = append(*p, Property{ID: PropUserProperty, Name: []byte(name), Data: []byte(value)})
+}
+
+// encode writes the properties preceded by their length.
+func (p Properties) encode(buf *bytes.Buffer) {
+	var body bytes.Buffer
+	for _, prop := range p {
+		writeVarint(&body, uint32(prop.ID))
+		switch propTypes[prop.ID] {
+		case propByte:
+			body.WriteByte(byte(prop.Value))
+		case propUint16:
+			writeUint16(&body, uint16(prop.Value))
+		case propUint32:
+			var v [4]byte
+			binary.BigEndian.PutUint32(v[:], prop.Value)
+			body.Write(v[:])
+		case propVarint:
+			writeVarint(&body, prop.Value)
+		case propString, propBinary:
+			writeBytes(&body, prop.Data)
+		case propPair:
+			writeBytes(&body, prop.Name)
+			writeBytes(&body, prop.Data)
+		}
+	}
+
+	writeVarint(buf, uint32(body.Len()))
+	buf.Write(body.Bytes())
+}
+
+// properties reads the properties preceded by their length.
+func (d *decoder) properties() Properties {
+	length := int(d.varint())
+	if d.err != nil || d.offset+length > len(d.buf) {
+		d.fail()
+		return nil
+	}
+
+	end := d.offset + length
+	var props Properties
+	for d.err == nil && d.offset < end {
+		prop := Property{ID: byte(d.varint())}
+		kind, ok := propTypes[prop.ID]
+		if !ok {
+			d.fail()
+			return nil
+		}
+
+		switch kind {
+		case propByte:
+			prop.Value = uint32(d.byte())
+		case propUint16:
+			prop.Value = uint32(d.uint16())
+		case propUint32:
+			prop.Value = d.uint32()
+		case propVarint:
+			prop.Value = d.varint()
+		case propString, propBinary:
+			prop.Data = d.bytes()
+		case propPair:
+			prop.Name = d.bytes()
+			prop.Data = d.bytes()
+		}
+		props = append(props, prop)
+	}
+
+	if d.offset != end {
+		d.fail()
+	}
+	return props
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.offset+4 > len(d.buf) {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.buf[d.offset:])
+	d.offset += 4
+	return v
+}
+
+func (d *decoder) varint() uint32 {
+	var value, multiplier uint32 = 0, 1
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+
+		value += uint32(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value
+		}
+		multiplier *= 128
+	}
+	d.fail()
+	return 0
+}
+
+// writeVarint writes a variable byte integer.
+func writeVarint(buf *bytes.Buffer, v uint32) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
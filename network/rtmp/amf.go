@@ -0,0 +1,239 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers.
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// errAMF is returned when an AMF0 value can not be decoded.
+var errAMF = errors.New("rtmp: invalid amf0 value")
+
+// Object represents an AMF0 object or ECMA array.
+type Object map[string]interface{}
+
+// String returns the string property of the object, empty if missing.
+func (o Object) String(key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+// Number returns the number property of the object, zero if missing.
+func (o Object) Number(key string) float64 {
+	n, _ := o[key].(float64)
+	return n
+}
+
+// undefined represents the AMF0 undefined value.
+type undefined struct{}
+
+// DecodeAMF decodes all of the AMF0 values of a message. The numbers are decoded as
+// float64, the strings as string, the objects and ECMA arrays as Object, the strict
+// arrays as []interface{} and both null and undefined as nil.
+func DecodeAMF(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := decodeAMFValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func decodeAMFValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errAMF
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errAMF
+		}
+		return math.Float64frombits(bits), nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amfString:
+		return readAMFString(r, 2)
+	case amfLongString:
+		return readAMFString(r, 4)
+	case amfObject:
+		return readAMFObject(r)
+	case amfECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, errAMF
+		}
+		return readAMFObject(r)
+	case amfStrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil || int(n) > r.Len() {
+			return nil, errAMF
+		}
+		array := make([]interface{}, 0, n)
+		for i := uint32(0); i < n; i++ {
+			v, err := decodeAMFValue(r)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	case amfDate:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errAMF
+		}
+		_, err := r.Seek(2, io.SeekCurrent) // The time zone is unused
+		return math.Float64frombits(bits), err
+	case amfNull, amfUndefined:
+		return nil, nil
+	}
+	return nil, errAMF
+}
+
+func readAMFString(r *bytes.Reader, lengthSize int) (string, error) {
+	var n int
+	if lengthSize == 2 {
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return "", errAMF
+		}
+		n = int(l)
+	} else {
+		var l uint32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return "", errAMF
+		}
+		n = int(l)
+	}
+
+	if n > r.Len() {
+		return "", errAMF
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func readAMFObject(r *bytes.Reader) (Object, error) {
+	obj := make(Object)
+	for {
+		key, err := readAMFString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, errAMF
+			}
+			if marker == amfObjectEnd {
+				return obj, nil
+			}
+			r.UnreadByte()
+		}
+
+		if obj[key], err = decodeAMFValue(r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// EncodeAMF encodes values as AMF0, with the same types as decoded. The properties of
+// the objects are encoded in the order of their keys.
+func EncodeAMF(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		encodeAMFValue(&buf, v)
+	}
+	return buf.Bytes()
+}
+
+func encodeAMFValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		buf.WriteByte(amfNumber)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeAMFValue(buf, float64(v))
+	case uint32:
+		encodeAMFValue(buf, float64(v))
+	case bool:
+		buf.WriteByte(amfBoolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			buf.WriteByte(amfLongString)
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		} else {
+			buf.WriteByte(amfString)
+			binary.Write(buf, binary.BigEndian, uint16(len(v)))
+		}
+		buf.WriteString(v)
+	case Object:
+		buf.WriteByte(amfObject)
+		writeAMFProperties(buf, v)
+	case []interface{}:
+		buf.WriteByte(amfStrictArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, item := range v {
+			encodeAMFValue(buf, item)
+		}
+	case undefined:
+		buf.WriteByte(amfUndefined)
+	default:
+		buf.WriteByte(amfNull)
+	}
+}
+
+// EncodeECMAArray encodes an object as an AMF0 ECMA array, as used by onMetaData.
+func EncodeECMAArray(obj Object) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(amfECMAArray)
+	binary.Write(&buf, binary.BigEndian, uint32(len(obj)))
+	writeAMFProperties(&buf, obj)
+	return buf.Bytes()
+}
+
+func writeAMFProperties(buf *bytes.Buffer, obj Object) {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		binary.Write(buf, binary.BigEndian, uint16(len(key)))
+		buf.WriteString(key)
+		encodeAMFValue(buf, obj[key])
+	}
+	buf.Write([]byte{0, 0, amfObjectEnd})
+}
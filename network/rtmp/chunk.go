@@ -0,0 +1,290 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Message types
+const (
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAck              = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	typeAudio            = 8
+	typeVideo            = 9
+	typeDataAMF3         = 15
+	typeCommandAMF3      = 17
+	typeDataAMF0         = 18
+	typeCommandAMF0      = 20
+)
+
+const (
+	defaultChunkSize = 128
+	maxChunkSize     = 1 << 24
+	maxMessageSize   = 16 << 20
+	maxChunkStreams  = 64 // The clients use a handful of chunk streams.
+	extendedStamp    = 0xffffff
+)
+
+// Errors of the chunk stream.
+var (
+	errChunkSize   = errors.New("rtmp: invalid chunk size")
+	errMessageSize = errors.New("rtmp: message too large")
+	errNoHeader    = errors.New("rtmp: chunk without a previous header")
+	errLength      = errors.New("rtmp: message length changed in the middle of a message")
+	errStreams     = errors.New("rtmp: too many chunk streams")
+)
+
+// message represents a message reassembled from its chunks.
+type message struct {
+	csid      uint32
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32
+	data      []byte
+}
+
+// chunkStream represents the state of a chunk stream, as its headers are compressed
+// against the previous chunk of the same stream.
+type chunkStream struct {
+	started   bool
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	data      []byte // The message being reassembled.
+}
+
+// chunkReader demultiplexes the chunk streams into messages.
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStream
+	read      uint64 // The number of bytes read, for the acknowledgements.
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{
+		r:         bufio.NewReaderSize(r, 16<<10),
+		chunkSize: defaultChunkSize,
+		streams:   make(map[uint32]*chunkStream),
+	}
+}
+
+func (cr *chunkReader) readByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	cr.read++
+	return b, err
+}
+
+func (cr *chunkReader) readFull(buf []byte) error {
+	n, err := io.ReadFull(cr.r, buf)
+	cr.read += uint64(n)
+	return err
+}
+
+func (cr *chunkReader) readUint(n int) (uint32, error) {
+	var buf [4]byte
+	if err := cr.readFull(buf[4-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// ReadMessage reads chunks until a message is complete.
+func (cr *chunkReader) ReadMessage() (*message, error) {
+	for {
+		m, err := cr.readChunk()
+		if err != nil || m != nil {
+			return m, err
+		}
+	}
+}
+
+// readChunk reads a single chunk, and returns the message it completes if any.
+func (cr *chunkReader) readChunk() (*message, error) {
+	b, err := cr.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	format, csid := b>>6, uint32(b&0x3f)
+	switch csid {
+	case 0:
+		b, err := cr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		v, err := cr.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + (v >> 8) + (v&0xff)*256 // The id is little endian
+	}
+
+	cs, ok := cr.streams[csid]
+	if !ok {
+		if len(cr.streams) >= maxChunkStreams {
+			return nil, errStreams
+		}
+		cs = new(chunkStream)
+		cr.streams[csid] = cs
+	}
+	if format != 0 && !cs.started {
+		return nil, errNoHeader
+	}
+
+	// Read the message header, compressed against the previous chunk
+	newMessage := len(cs.data) == 0
+	var stamp uint32
+	if format < 3 {
+		if stamp, err = cr.readUint(3); err != nil {
+			return nil, err
+		}
+	}
+	if format < 2 {
+		length, err := cr.readUint(3)
+		if err != nil {
+			return nil, err
+		}
+		if length > maxMessageSize {
+			return nil, errMessageSize
+		}
+		if !newMessage && length != cs.length {
+			return nil, errLength
+		}
+		cs.length = length
+		t, err := cr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		cs.typeID = t
+	}
+	if format == 0 {
+		var id [4]byte
+		if err := cr.readFull(id[:]); err != nil {
+			return nil, err
+		}
+		cs.streamID = binary.LittleEndian.Uint32(id[:])
+	}
+
+	if format < 3 {
+		cs.extended = stamp == extendedStamp
+	}
+	if cs.extended {
+		if stamp, err = cr.readUint(4); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case format == 0:
+		cs.timestamp, cs.delta = stamp, 0
+	case format < 3:
+		cs.delta = stamp
+		cs.timestamp += stamp
+	case newMessage:
+		cs.timestamp += cs.delta
+	}
+	cs.started = true
+
+	// Read the payload of the chunk, the message growing as its chunks arrive
+	n := cs.length - uint32(len(cs.data))
+	if n > cr.chunkSize {
+		n = cr.chunkSize
+	}
+	offset := len(cs.data)
+	cs.data = append(cs.data, make([]byte, n)...)
+	if err := cr.readFull(cs.data[offset:]); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.data)) < cs.length {
+		return nil, nil
+	}
+
+	m := &message{csid: csid, typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, data: cs.data}
+	cs.data = nil
+	return m, nil
+}
+
+// SetChunkSize sets the size of the incoming chunks.
+func (cr *chunkReader) SetChunkSize(size uint32) error {
+	if size == 0 || size > maxChunkSize {
+		return errChunkSize
+	}
+	cr.chunkSize = size
+	return nil
+}
+
+// Abort discards the message being reassembled on a chunk stream.
+func (cr *chunkReader) Abort(csid uint32) {
+	if cs, ok := cr.streams[csid]; ok {
+		cs.data = nil
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// chunkWriter multiplexes the outgoing messages into chunks, always with full headers.
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize uint32
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{w: bufio.NewWriter(w), chunkSize: defaultChunkSize}
+}
+
+// WriteMessage writes a message and flushes it.
+func (cw *chunkWriter) WriteMessage(m *message) error {
+	stamp := m.timestamp
+	if stamp >= extendedStamp {
+		stamp = extendedStamp
+	}
+
+	var header [16]byte
+	header[0] = byte(m.csid & 0x3f)
+	putUint24(header[1:], stamp)
+	putUint24(header[4:], uint32(len(m.data)))
+	header[7] = m.typeID
+	binary.LittleEndian.PutUint32(header[8:], m.streamID)
+	n := 12
+	if stamp == extendedStamp {
+		binary.BigEndian.PutUint32(header[12:], m.timestamp)
+		n = 16
+	}
+	cw.w.Write(header[:n])
+
+	data := m.data
+	for {
+		size := uint32(len(data))
+		if size > cw.chunkSize {
+			size = cw.chunkSize
+		}
+		cw.w.Write(data[:size])
+		if data = data[size:]; len(data) == 0 {
+			break
+		}
+
+		// The continuation chunks have a type 3 header
+		cw.w.WriteByte(0xc0 | byte(m.csid&0x3f))
+		if stamp == extendedStamp {
+			cw.w.Write(header[12:16])
+		}
+	}
+	return cw.w.Flush()
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
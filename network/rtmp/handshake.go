@@ -0,0 +1,118 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	handshakeSize = 1536
+	digestSize    = 32
+)
+
+// errHandshake is returned when the handshake of a client is invalid.
+var errHandshake = errors.New("rtmp: invalid handshake")
+
+// The keys of the digests of the handshake, the client ones use the first 30 bytes of
+// the player key and the server ones the first 36 bytes of the server key.
+var (
+	handshakeKeySuffix = []byte{
+		0xF0, 0xEE, 0xC2, 0x4A, 0x80, 0x68, 0xBE, 0xE8, 0x2E, 0x00, 0xD0, 0xD1,
+		0x02, 0x9E, 0x7E, 0x57, 0x6E, 0xEC, 0x5D, 0x2D, 0x29, 0x80, 0x6F, 0xAB,
+		0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
+	}
+	playerKey = append([]byte("Genuine Adobe Flash Player 001"), handshakeKeySuffix...)
+	serverKey = append([]byte("Genuine Adobe Flash Media Server 001"), handshakeKeySuffix...)
+)
+
+// serverHandshake performs the handshake of a client. The clients sending a digest in
+// their C1 chunk, such as the flash based encoders, get the digested handshake, the
+// others the plain one which echoes C1 back.
+func serverHandshake(rw io.ReadWriter) error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return errHandshake
+	}
+
+	c1 := c0c1[1:]
+	s1 := make([]byte, handshakeSize)
+	s2 := make([]byte, handshakeSize)
+	rand.Read(s1[8:])
+	binary.BigEndian.PutUint32(s1, uint32(time.Now().Unix()))
+
+	if clientDigest, ok := findDigest(c1, playerKey[:30]); ok {
+		copy(s1[4:], []byte{0x0d, 0x0e, 0x0a, 0x0d})
+		writeDigest(s1, serverKey[:36])
+
+		rand.Read(s2)
+		key := hmacSHA256(serverKey, clientDigest)
+		copy(s2[handshakeSize-digestSize:], hmacSHA256(key, s2[:handshakeSize-digestSize]))
+	} else {
+		copy(s2, c1)
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(3)
+	out.Write(s1)
+	out.Write(s2)
+	if _, err := rw.Write(out.Bytes()); err != nil {
+		return err
+	}
+
+	// The C2 chunk is not verified, as most servers do
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(rw, c2)
+	return err
+}
+
+// digestOffset returns the offset of the digest of a chunk, in either of the two
+// schemes: with the digest located from the bytes 8 to 11, or from the bytes 772 to 775.
+func digestOffset(chunk []byte, scheme int) int {
+	base := 8
+	if scheme == 1 {
+		base = 772
+	}
+	sum := int(chunk[base]) + int(chunk[base+1]) + int(chunk[base+2]) + int(chunk[base+3])
+	return base + 4 + sum%728
+}
+
+// findDigest returns the digest of a chunk, if valid in either of the schemes.
+func findDigest(chunk []byte, key []byte) ([]byte, bool) {
+	for scheme := 0; scheme < 2; scheme++ {
+		offset := digestOffset(chunk, scheme)
+		digest := chunk[offset : offset+digestSize]
+		if hmac.Equal(digest, chunkDigest(chunk, offset, key)) {
+			return digest, true
+		}
+	}
+	return nil, false
+}
+
+// writeDigest writes the digest of a chunk, in the first scheme.
+func writeDigest(chunk []byte, key []byte) {
+	offset := digestOffset(chunk, 0)
+	copy(chunk[offset:], chunkDigest(chunk, offset, key))
+}
+
+// chunkDigest computes the digest of a chunk, excluding the digest itself.
+func chunkDigest(chunk []byte, offset int, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(chunk[:offset])
+	h.Write(chunk[offset+digestSize:])
+	return h.Sum(nil)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
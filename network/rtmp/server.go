@@ -0,0 +1,379 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+	"github.com/numb3r3/live-go/media"
+)
+
+const (
+	serverChunkSize  = 4096
+	windowAckSize    = 2500000
+	handshakeTimeout = 10 * time.Second
+	idleTimeout      = 30 * time.Second // The silence after which a publisher is gone.
+)
+
+// errNotConnected is returned when a client publishes before connecting.
+var errNotConnected = errors.New("rtmp: command before connect")
+
+// Request represents a request of a client to publish a stream.
+type Request struct {
+	App        string     // The application, from the connect command.
+	Name       string     // The name of the stream, the stream key.
+	Query      url.Values // The parameters appended to the stream name, if any.
+	TcURL      string     // The URL the client connected to.
+	RemoteAddr net.Addr
+}
+
+// Key returns the key of the stream, as "<app>/<name>".
+func (r *Request) Key() string {
+	return r.App + "/" + r.Name
+}
+
+// Publisher represents the receiver of a published stream.
+type Publisher interface {
+	WritePacket(p *media.Packet) error
+	Close() error
+}
+
+// Handler handles the streams published to the server.
+type Handler interface {
+	// OnPublish is called when a client starts publishing. An error refuses it.
+	OnPublish(req *Request) (Publisher, error)
+}
+
+// HandlerFunc adapts a function to a handler.
+type HandlerFunc func(req *Request) (Publisher, error)
+
+// OnPublish calls the function.
+func (f HandlerFunc) OnPublish(req *Request) (Publisher, error) {
+	return f(req)
+}
+
+// Server represents an RTMP server accepting the live streams of the broadcasters,
+// such as OBS or ffmpeg.
+type Server struct {
+	handler Handler
+	sync.Mutex
+	conns map[*Conn]struct{}
+}
+
+// NewServer creates a new server handing the published streams to the handler.
+func NewServer(handler Handler) *Server {
+	return &Server{handler: handler, conns: make(map[*Conn]struct{})}
+}
+
+// Serve accepts the connections of the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection until it is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	c := newConn(conn, s.handler)
+	s.Lock()
+	s.conns[c] = struct{}{}
+	s.Unlock()
+
+	err := c.safeServe()
+	c.Close()
+
+	s.Lock()
+	delete(s.conns, c)
+	s.Unlock()
+	logging.Info("rtmp: connection of", conn.RemoteAddr(), "closed:", err)
+}
+
+// Close closes all of the connections, which end their publishing as they stop.
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// Conn represents the connection of a broadcaster.
+type Conn struct {
+	conn      net.Conn
+	handler   Handler
+	reader    *chunkReader
+	writer    *chunkWriter
+	app       string
+	tcURL     string
+	streamID  uint32
+	window    uint32 // The acknowledgement window of the client.
+	acked     uint64 // The number of bytes read when last acknowledged.
+	publisher Publisher
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, handler Handler) *Conn {
+	return &Conn{
+		conn:    conn,
+		handler: handler,
+		reader:  newChunkReader(conn),
+		writer:  newChunkWriter(conn),
+	}
+}
+
+// Close ends the publishing, if any, and closes the connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.unpublish()
+		c.conn.Close()
+	})
+	return nil
+}
+
+// safeServe serves a connection, recovering a panic so a single connection never takes
+// the server down.
+func (c *Conn) safeServe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rtmp: panic recovered: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return c.serve()
+}
+
+// serve performs the handshake then handles the messages until the connection breaks.
+func (c *Conn) serve() error {
+	c.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := serverHandshake(c.conn); err != nil {
+		return err
+	}
+	c.conn.SetDeadline(time.Time{})
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		m, err := c.reader.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.onMessage(m); err != nil {
+			return err
+		}
+		if err := c.acknowledge(); err != nil {
+			return err
+		}
+	}
+}
+
+// acknowledge sends an acknowledgement once a window of bytes is read.
+func (c *Conn) acknowledge() error {
+	if c.window == 0 || c.reader.read-c.acked < uint64(c.window) {
+		return nil
+	}
+	c.acked = c.reader.read
+	return c.writeControl(typeAck, uint32(c.reader.read))
+}
+
+// onMessage handles a message of the client.
+func (c *Conn) onMessage(m *message) error {
+	switch m.typeID {
+	case typeSetChunkSize:
+		if len(m.data) < 4 {
+			return errChunkSize
+		}
+		return c.reader.SetChunkSize(binary.BigEndian.Uint32(m.data) & 0x7fffffff)
+	case typeAbort:
+		if len(m.data) >= 4 {
+			c.reader.Abort(binary.BigEndian.Uint32(m.data))
+		}
+	case typeWindowAckSize:
+		if len(m.data) >= 4 {
+			c.window = binary.BigEndian.Uint32(m.data)
+		}
+	case typeCommandAMF3:
+		if len(m.data) > 0 {
+			return c.onCommand(m, m.data[1:])
+		}
+	case typeCommandAMF0:
+		return c.onCommand(m, m.data)
+	case typeDataAMF0:
+		return c.onData(m, m.data)
+	case typeDataAMF3:
+		if len(m.data) > 0 {
+			return c.onData(m, m.data[1:])
+		}
+	case typeAudio:
+		return c.write(&media.Packet{Type: media.PacketAudio, Timestamp: m.timestamp, Data: m.data})
+	case typeVideo:
+		return c.write(&media.Packet{Type: media.PacketVideo, Timestamp: m.timestamp, Data: m.data})
+	}
+	return nil
+}
+
+// write hands a packet over to the publisher.
+func (c *Conn) write(p *media.Packet) error {
+	if c.publisher == nil || len(p.Data) == 0 {
+		return nil
+	}
+	return c.publisher.WritePacket(p)
+}
+
+// onData handles a data message, of which only the metadata of the stream is kept.
+func (c *Conn) onData(m *message, data []byte) error {
+	values, err := DecodeAMF(data)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+
+	// The encoders send the metadata through @setDataFrame, which is stripped
+	if name, _ := values[0].(string); name == "@setDataFrame" {
+		data = data[3+len(name):]
+		values = values[1:]
+	}
+	if name, _ := arg(values, 0).(string); name == "onMetaData" {
+		return c.write(&media.Packet{Type: media.PacketMetadata, Timestamp: m.timestamp, Data: data})
+	}
+	return nil
+}
+
+// onCommand handles a command message.
+func (c *Conn) onCommand(m *message, data []byte) error {
+	values, err := DecodeAMF(data)
+	if err != nil || len(values) < 2 {
+		return err
+	}
+
+	name, _ := values[0].(string)
+	txn, _ := values[1].(float64)
+	args := values[2:]
+	switch name {
+	case "connect":
+		obj, _ := arg(args, 0).(Object)
+		return c.onConnect(txn, obj)
+	case "createStream":
+		c.streamID = 1
+		return c.writeCommand(0, "_result", txn, nil, c.streamID)
+	case "releaseStream", "FCPublish":
+		return c.writeCommand(0, "_result", txn, nil, undefined{})
+	case "publish":
+		name, _ := arg(args, 1).(string)
+		return c.onPublish(m.streamID, name)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		c.unpublish()
+	}
+	return nil
+}
+
+// arg returns an argument of a command, nil if missing.
+func arg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// onConnect accepts the connection to an application.
+func (c *Conn) onConnect(txn float64, obj Object) error {
+	c.app = strings.Trim(obj.String("app"), "/")
+	c.tcURL = obj.String("tcUrl")
+	if c.app == "" {
+		return errNotConnected
+	}
+
+	if err := c.writeControl(typeWindowAckSize, windowAckSize); err != nil {
+		return err
+	}
+	bandwidth := make([]byte, 5)
+	binary.BigEndian.PutUint32(bandwidth, windowAckSize)
+	bandwidth[4] = 2 // The dynamic limit type
+	if err := c.writeMessage(&message{csid: 2, typeID: typeSetPeerBandwidth, data: bandwidth}); err != nil {
+		return err
+	}
+	if err := c.writeControl(typeSetChunkSize, serverChunkSize); err != nil {
+		return err
+	}
+	c.writer.chunkSize = serverChunkSize
+
+	return c.writeCommand(0, "_result", txn,
+		Object{"fmsVer": "FMS/3,0,1,123", "capabilities": 31.0},
+		Object{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"description":    "Connection succeeded.",
+			"objectEncoding": obj.Number("objectEncoding"),
+		})
+}
+
+// onPublish starts publishing a stream, once accepted by the handler.
+func (c *Conn) onPublish(streamID uint32, name string) error {
+	if c.app == "" {
+		return errNotConnected
+	}
+	if c.publisher != nil || name == "" {
+		return c.writeStatus(streamID, "error", "NetStream.Publish.BadName", "already publishing")
+	}
+
+	req := &Request{App: c.app, Name: name, TcURL: c.tcURL, RemoteAddr: c.conn.RemoteAddr()}
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		req.Name = name[:i]
+		req.Query, _ = url.ParseQuery(name[i+1:])
+	}
+
+	publisher, err := c.handler.OnPublish(req)
+	if err != nil {
+		c.writeStatus(streamID, "error", "NetStream.Publish.BadName", err.Error())
+		return fmt.Errorf("rtmp: publish of %s refused: %v", req.Key(), err)
+	}
+
+	c.publisher = publisher
+	logging.Info("rtmp:", c.conn.RemoteAddr(), "publishing", req.Key())
+	return c.writeStatus(streamID, "status", "NetStream.Publish.Start", req.Key()+" is now published.")
+}
+
+// unpublish ends the publishing, if any.
+func (c *Conn) unpublish() {
+	if c.publisher != nil {
+		c.publisher.Close()
+		c.publisher = nil
+	}
+}
+
+// writeStatus sends an onStatus command.
+func (c *Conn) writeStatus(streamID uint32, level, code, description string) error {
+	return c.writeCommand(streamID, "onStatus", 0, nil, Object{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+// writeCommand sends an AMF0 command message.
+func (c *Conn) writeCommand(streamID uint32, name string, txn float64, values ...interface{}) error {
+	data := EncodeAMF(append([]interface{}{name, txn}, values...)...)
+	return c.writeMessage(&message{csid: 3, typeID: typeCommandAMF0, streamID: streamID, data: data})
+}
+
+// writeControl sends a protocol control message with a 32 bits value.
+func (c *Conn) writeControl(typeID uint8, value uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return c.writeMessage(&message{csid: 2, typeID: typeID, data: data})
+}
+
+func (c *Conn) writeMessage(m *message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return c.writer.WriteMessage(m)
+}
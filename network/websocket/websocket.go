@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
@@ -23,9 +24,11 @@ type websocketConn interface {
 // websocketConn represents a websocket connection.
 type websocketTransport struct {
 	sync.Mutex
-	socket  websocketConn
-	reader  io.Reader
-	closing chan bool
+	socket       websocketConn
+	reader       io.Reader
+	closing      chan bool
+	closeOnce    sync.Once
+	writeTimeout time.Duration // The deadline set on every write, if any.
 }
 
 const (
@@ -35,17 +38,51 @@ const (
 	closeGracePeriod = 10 * time.Second    // Time to wait before force close on connection.
 )
 
+// SubprotocolFLV is the subprotocol of the media clients playing FLV streams.
+const SubprotocolFLV = "flv"
+
+// The subprotocols of the mqtt and of the media clients, which tell them apart.
+var (
+	mqttSubprotocols  = []string{"mqtt", "mqttv3.1", "mqttv3"}
+	mediaSubprotocols = []string{SubprotocolFLV}
+)
+
 // The default upgrader to use
 var upgrader = &websocket.Upgrader{
-	Subprotocols: []string{"mqttv3.1", "mqttv3", "mqttv3"},
+	Subprotocols: append(append([]string{}, mqttSubprotocols...), mediaSubprotocols...),
 	CheckOrigin:  func(r *http.Request) bool { return true },
 }
 
-// TryUpgrade attempts to upgrade an HTTP request to mqtt over websocket.
+// offersOnly returns whether a client requested subprotocols, all of them from a set.
+func offersOnly(r *http.Request, set []string) bool {
+	requested := websocket.Subprotocols(r)
+	for _, protocol := range requested {
+		found := false
+		for _, s := range set {
+			found = found || protocol == s
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(requested) > 0
+}
+
+// IsUpgrade returns whether the client has requested an upgrade to websocket.
+func IsUpgrade(r *http.Request) bool {
+	return r != nil && websocket.IsWebSocketUpgrade(r)
+}
+
+// TryUpgrade attempts to upgrade an HTTP request to mqtt over websocket. The media
+// clients, which only request media subprotocols, are refused.
 func TryUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, bool) {
 	if w == nil || r == nil {
 		return nil, false
 	}
+	if offersOnly(r, mediaSubprotocols) {
+		http.Error(w, "media subprotocol on an mqtt endpoint", http.StatusBadRequest)
+		return nil, false
+	}
 
 	if ws, err := upgrader.Upgrade(w, r, nil); err == nil {
 		return newWebsocketConn(ws), true
@@ -54,6 +91,61 @@ func TryUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, bool) {
 	return nil, false
 }
 
+// UpgradeMedia upgrades an HTTP request of a media player, which only ever receives.
+// The connection is kept alive with pings, the writes time out and the messages of the
+// player must be read, if only to be discarded, for the pongs to be handled. The mqtt
+// clients, which only request mqtt subprotocols, are refused.
+func UpgradeMedia(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if offersOnly(r, mqttSubprotocols) {
+		http.Error(w, "mqtt subprotocol on a media endpoint", http.StatusBadRequest)
+		return nil, websocket.ErrBadHandshake
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newWebsocketConn(ws).(*websocketTransport)
+	conn.writeTimeout = writeWait
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					return
+				}
+			case <-conn.closing:
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+// Dial connects to a remote broker serving mqtt over websocket, with the TLS
+// configuration used for the "wss" scheme.
+func Dial(url string, config *tls.Config) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		Subprotocols:     []string{"mqtt"},
+		TLSClientConfig:  config,
+		HandshakeTimeout: writeWait,
+	}
+
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWebsocketConn(ws), nil
+}
+
 // newWebsocketConn creates a new transport from websocket.
 func newWebsocketConn(ws websocketConn) net.Conn {
 	conn := &websocketTransport{
@@ -118,6 +210,10 @@ func (c *websocketTransport) Write(b []byte) (n int, err error) {
 	c.Lock()
 	defer c.Unlock()
 
+	if c.writeTimeout > 0 {
+		c.socket.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
 	var w io.WriteCloser
 	if w, err = c.socket.NextWriter(websocket.BinaryMessage); err == nil {
 		if n, err = w.Write(b); err == nil {
@@ -129,9 +225,15 @@ func (c *websocketTransport) Write(b []byte) (n int, err error) {
 
 // Close terminates the connection.
 func (c *websocketTransport) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
 	return c.socket.Close()
 }
 
+// Transport returns the name of the transport.
+func (c *websocketTransport) Transport() string {
+	return "websocket"
+}
+
 // LocalAddr returns the local network address.
 func (c *websocketTransport) LocalAddr() net.Addr {
 	return c.socket.LocalAddr()
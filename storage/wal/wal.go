@@ -0,0 +1,558 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numb3r3/live-go/log"
+)
+
+// SyncPolicy represents when the log is flushed to the disk.
+type SyncPolicy string
+
+// The supported sync policies.
+const (
+	SyncAlways   SyncPolicy = "always"   // Every write is synced before returning.
+	SyncInterval SyncPolicy = "interval" // The log is synced periodically.
+	SyncNever    SyncPolicy = "never"    // The syncing is left to the operating system.
+)
+
+// Record types
+const (
+	recordPut    = byte(1)
+	recordDelete = byte(2)
+)
+
+const (
+	segmentExt = ".log"
+	headerSize = 4 + 4 // The CRC and the length of a record.
+	maxRecord  = 1 << 26
+)
+
+// Errors returned by the log.
+var (
+	ErrClosed         = errors.New("wal: log closed")
+	ErrRecordTooLarge = errors.New("wal: record too large")
+	ErrKeyTooLarge    = errors.New("wal: bucket or key too large")
+	errCorrupted      = errors.New("wal: corrupted record")
+)
+
+// Options represents the options of the log.
+type Options struct {
+	SegmentSize  int64         // The size after which a new segment is started.
+	Sync         SyncPolicy    // When the log is flushed to the disk.
+	SyncInterval time.Duration // The flush interval of the interval policy.
+	CompactRatio float64       // The ratio of superseded bytes which triggers a compaction.
+	CompactMin   int64         // The minimum size of the log before compacting.
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:  64 << 20,
+		Sync:         SyncInterval,
+		SyncInterval: time.Second,
+		CompactRatio: 0.5,
+		CompactMin:   16 << 20,
+	}
+}
+
+// Log represents a key-value store persisted as segmented append-only log files. Every
+// write appends a CRC-checked record, the latest values are kept in memory and the log
+// is replayed on startup. The superseded records are dropped by compacting the log.
+type Log struct {
+	sync.RWMutex
+	dir      string
+	opts     Options
+	data     map[string]map[string][]byte // The live values by bucket and key.
+	segments []int64                      // The ids of the segments, in order.
+	active   *os.File                     // The segment being appended to.
+	writer   *bufio.Writer                // The buffered writer of the active segment.
+	size     int64                        // The size of the active segment.
+	total    int64                        // The size of all of the segments.
+	live     int64                        // The size of the records holding live values.
+	dirty    bool                         // Whether some writes are not synced yet.
+	closing  chan struct{}
+	closed   bool
+}
+
+// Open opens the log in the directory, recovering its state from the existing segments.
+// A torn or corrupted record at the tail of the last segment is truncated.
+func Open(dir string, opts Options) (*Log, error) {
+	switch opts.Sync {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return nil, fmt.Errorf("wal: invalid sync interval %v", opts.SyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("wal: unknown sync policy '%s'", opts.Sync)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:     dir,
+		opts:    opts,
+		data:    make(map[string]map[string][]byte),
+		closing: make(chan struct{}),
+	}
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := l.roll(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// recover replays all of the segments in order.
+func (l *Log) recover() error {
+	files, err := filepath.Glob(filepath.Join(l.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		var id int64
+		if _, err := fmt.Sscanf(filepath.Base(file), "%016d"+segmentExt, &id); err == nil {
+			l.segments = append(l.segments, id)
+		}
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+
+	for i, id := range l.segments {
+		last := i == len(l.segments)-1
+		if err := l.replay(id, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay applies the records of a segment. A corrupted tail is truncated from the last
+// segment, which is where an interrupted write ends up, and skipped from the others.
+func (l *Log) replay(id int64, last bool) error {
+	path := l.segmentPath(id)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		typ, bucket, key, value, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if last {
+				logging.Warningf("wal: truncating segment %d at offset %d: %v", id, offset, err)
+				if err := f.Truncate(offset); err != nil {
+					return err
+				}
+			} else {
+				logging.Errorf("wal: skipping the tail of segment %d at offset %d: %v", id, offset, err)
+			}
+			break
+		}
+
+		l.apply(typ, bucket, key, value, n)
+		offset += n
+	}
+
+	l.total += offset
+	return nil
+}
+
+// apply applies a record to the in-memory state.
+func (l *Log) apply(typ byte, bucket, key string, value []byte, size int64) {
+	values := l.data[bucket]
+	if prev, ok := values[key]; ok {
+		l.live -= recordSize(bucket, key, prev)
+	}
+
+	switch typ {
+	case recordPut:
+		if values == nil {
+			values = make(map[string][]byte)
+			l.data[bucket] = values
+		}
+		values[key] = value
+		l.live += size
+	case recordDelete:
+		delete(values, key)
+		if len(values) == 0 {
+			delete(l.data, bucket)
+		}
+	}
+}
+
+// Put sets the value of a key in a bucket.
+func (l *Log) Put(bucket, key string, value []byte) error {
+	return l.write(recordPut, bucket, key, append([]byte(nil), value...))
+}
+
+// Delete removes a key from a bucket.
+func (l *Log) Delete(bucket, key string) error {
+	l.RLock()
+	_, ok := l.data[bucket][key]
+	l.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return l.write(recordDelete, bucket, key, nil)
+}
+
+// Get returns the value of a key in a bucket.
+func (l *Log) Get(bucket, key string) ([]byte, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	value, ok := l.data[bucket][key]
+	return value, ok
+}
+
+// ForEach calls the function for every key of a bucket, in the order of the keys, until
+// it returns false.
+func (l *Log) ForEach(bucket string, fn func(key string, value []byte) bool) {
+	l.RLock()
+	values := l.data[bucket]
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	l.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := l.Get(bucket, key); ok && !fn(key, value) {
+			return
+		}
+	}
+}
+
+// Buckets returns the names of the buckets having the prefix.
+func (l *Log) Buckets(prefix string) []string {
+	l.RLock()
+	defer l.RUnlock()
+
+	var buckets []string
+	for bucket := range l.data {
+		if strings.HasPrefix(bucket, prefix) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// write appends a record and applies it.
+func (l *Log) write(typ byte, bucket, key string, value []byte) error {
+	record, err := encodeRecord(typ, bucket, key, value)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	if l.size > 0 && l.size+int64(len(record)) > l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.writer.Write(record); err != nil {
+		return err
+	}
+
+	size := int64(len(record))
+	l.size += size
+	l.total += size
+	l.dirty = true
+	l.apply(typ, bucket, key, value, size)
+
+	switch l.opts.Sync {
+	case SyncAlways:
+		if err := l.sync(); err != nil {
+			return err
+		}
+	case SyncNever:
+		if err := l.writer.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if l.needsCompaction() {
+		return l.compact()
+	}
+	return nil
+}
+
+// roll starts a new active segment.
+func (l *Log) roll() error {
+	if l.active != nil {
+		if err := l.sync(); err != nil {
+			return err
+		}
+		l.active.Close()
+	}
+
+	var id int64 = 1
+	if n := len(l.segments); n > 0 {
+		id = l.segments[n-1] + 1
+	}
+
+	f, err := os.OpenFile(l.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.segments = append(l.segments, id)
+	l.active = f
+	l.writer = bufio.NewWriter(f)
+	l.size = 0
+	return nil
+}
+
+// Sync flushes the log to the disk.
+func (l *Log) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if l.opts.Sync != SyncNever {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+	}
+	l.dirty = false
+	return nil
+}
+
+// syncLoop periodically flushes the log to the disk.
+func (l *Log) syncLoop() {
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closing:
+			return
+		case <-ticker.C:
+			if err := l.Sync(); err != nil && err != ErrClosed {
+				logging.Error("wal: unable to sync", err)
+			}
+		}
+	}
+}
+
+// needsCompaction returns whether enough of the log is superseded to be compacted.
+func (l *Log) needsCompaction() bool {
+	if l.opts.CompactRatio <= 0 || l.total < l.opts.CompactMin {
+		return false
+	}
+	return float64(l.total-l.live)/float64(l.total) >= l.opts.CompactRatio
+}
+
+// Compact rewrites the live values into a new segment and removes the previous ones.
+func (l *Log) Compact() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.compact()
+}
+
+// compact writes the live values to a new segment, then removes the older segments from
+// the oldest, so an interrupted compaction never resurrects a deleted key.
+func (l *Log) compact() error {
+	previous := l.segments
+	if err := l.roll(); err != nil {
+		return err
+	}
+
+	l.total, l.live = 0, 0
+	for bucket, values := range l.data {
+		for key, value := range values {
+			record, err := encodeRecord(recordPut, bucket, key, value)
+			if err != nil {
+				return err
+			}
+			if _, err := l.writer.Write(record); err != nil {
+				return err
+			}
+			size := int64(len(record))
+			l.size += size
+			l.total += size
+			l.live += size
+		}
+	}
+
+	l.dirty = true
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+
+	for _, id := range previous {
+		if err := os.Remove(l.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.segments = l.segments[len(previous):]
+	logging.Infof("wal: compacted %d segments into segment %d", len(previous), l.segments[0])
+	return nil
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.closing)
+	err := l.sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Size returns the size of the log on disk, and the size of its live records.
+func (l *Log) Size() (total, live int64) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.total, l.live
+}
+
+func (l *Log) segmentPath(id int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d%s", id, segmentExt))
+}
+
+// ------------------------------------------------------------------------------------
+
+// encodeRecord encodes a record as the CRC and the length of its body, followed by the
+// body made of the type, the length-prefixed bucket and key, and the value.
+func encodeRecord(typ byte, bucket, key string, value []byte) ([]byte, error) {
+	if len(bucket) > math.MaxUint16 || len(key) > math.MaxUint16 {
+		return nil, ErrKeyTooLarge
+	}
+	bodySize := 1 + 2 + len(bucket) + 2 + len(key) + len(value)
+	if bodySize > maxRecord {
+		return nil, ErrRecordTooLarge
+	}
+	record := make([]byte, headerSize+bodySize)
+	body := record[headerSize:]
+
+	body[0] = typ
+	binary.BigEndian.PutUint16(body[1:], uint16(len(bucket)))
+	n := 3 + copy(body[3:], bucket)
+	binary.BigEndian.PutUint16(body[n:], uint16(len(key)))
+	n += 2 + copy(body[n+2:], key)
+	copy(body[n:], value)
+
+	binary.BigEndian.PutUint32(record[4:], uint32(bodySize))
+	binary.BigEndian.PutUint32(record[0:], crc32.ChecksumIEEE(record[4:]))
+	return record, nil
+}
+
+// readRecord reads and verifies the next record, returning its size on disk.
+func readRecord(r io.Reader) (typ byte, bucket, key string, value []byte, size int64, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorrupted
+		}
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 5 || length > maxRecord {
+		err = errCorrupted
+		return
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		err = errCorrupted
+		return
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:]) {
+		err = errCorrupted
+		return
+	}
+
+	typ = body[0]
+	bucketLen := int(binary.BigEndian.Uint16(body[1:]))
+	if 3+bucketLen+2 > len(body) {
+		err = errCorrupted
+		return
+	}
+	bucket = string(body[3 : 3+bucketLen])
+	n := 3 + bucketLen
+	keyLen := int(binary.BigEndian.Uint16(body[n:]))
+	n += 2
+	if n+keyLen > len(body) {
+		err = errCorrupted
+		return
+	}
+	key = string(body[n : n+keyLen])
+	value = body[n+keyLen:]
+	size = int64(headerSize) + int64(length)
+	return
+}
+
+// recordSize returns the size on disk of a put record.
+func recordSize(bucket, key string, value []byte) int64 {
+	return int64(headerSize + 1 + 2 + len(bucket) + 2 + len(key) + len(value))
+}
@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOptions returns options syncing every write, so the segments are complete on close.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Sync = SyncAlways
+	return opts
+}
+
+func openLog(t *testing.T, dir string, opts Options) *Log {
+	t.Helper()
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// lastSegment returns the path of the last segment holding records.
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if info, err := os.Stat(files[i]); err == nil && info.Size() > 0 {
+			return files[i]
+		}
+	}
+	t.Fatal("no segment with records")
+	return ""
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, testOptions())
+	for _, err := range []error{
+		l.Put("sessions", "a", []byte("1")),
+		l.Put("sessions", "b", []byte("2")),
+		l.Put("queue/a", "1", []byte("m")),
+		l.Put("sessions", "a", []byte("3")),
+		l.Delete("sessions", "b"),
+		l.Delete("queue/a", "1"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, dir, testOptions())
+	defer l.Close()
+	if v, ok := l.Get("sessions", "a"); !ok || string(v) != "3" {
+		t.Fatalf("a = %q, %v", v, ok)
+	}
+	if _, ok := l.Get("sessions", "b"); ok {
+		t.Fatal("deleted key replayed")
+	}
+	if buckets := l.Buckets(""); len(buckets) != 1 || buckets[0] != "sessions" {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for name, tear := range map[string]func(path string) error{
+		"garbage": func(path string) error {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 9, 1})
+			return err
+		},
+		"truncated": func(path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()-3)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, dir, testOptions())
+			l.Put("b", "kept", []byte("1"))
+			l.Put("b", "torn", []byte("2"))
+			l.Close()
+
+			path := lastSegment(t, dir)
+			if err := tear(path); err != nil {
+				t.Fatal(err)
+			}
+
+			l = openLog(t, dir, testOptions())
+			if _, ok := l.Get("b", "kept"); !ok {
+				t.Fatal("record before the torn tail lost")
+			}
+			if name == "truncated" {
+				if _, ok := l.Get("b", "torn"); ok {
+					t.Fatal("torn record replayed")
+				}
+			}
+			total, _ := l.Size()
+			if info, err := os.Stat(path); err != nil || info.Size() != total {
+				t.Fatalf("tail not truncated: size %d, replayed %d", info.Size(), total)
+			}
+
+			// The log keeps appending after the truncated tail
+			if err := l.Put("b", "after", []byte("3")); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			l = openLog(t, dir, testOptions())
+			defer l.Close()
+			if v, ok := l.Get("b", "after"); !ok || string(v) != "3" {
+				t.Fatalf("after = %q, %v", v, ok)
+			}
+		})
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.CompactRatio = 0
+	l := openLog(t, dir, opts)
+	for i := 0; i < 100; i++ {
+		if err := l.Put("b", fmt.Sprintf("k%d", i%10), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Delete("b", "k0")
+
+	before, live := l.Size()
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := l.Size()
+	if after >= before || after != live {
+		t.Fatalf("compacted from %d to %d bytes, %d live", before, after, live)
+	}
+	l.Close()
+
+	l = openLog(t, dir, opts)
+	defer l.Close()
+	if _, ok := l.Get("b", "k0"); ok {
+		t.Fatal("deleted key resurrected by the compaction")
+	}
+	for i := 1; i < 10; i++ {
+		if v, ok := l.Get("b", fmt.Sprintf("k%d", i)); !ok || string(v) != fmt.Sprint(90+i) {
+			t.Fatalf("k%d = %q, %v", i, v, ok)
+		}
+	}
+}
+
+func TestAutomaticCompaction(t *testing.T) {
+	opts := testOptions()
+	opts.CompactMin = 1
+	l := openLog(t, t.TempDir(), opts)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		l.Put("b", "k", []byte(fmt.Sprint(i)))
+	}
+	if total, live := l.Size(); total != live {
+		t.Fatalf("superseded records kept: %d bytes, %d live", total, live)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	l := openLog(t, t.TempDir(), testOptions())
+	defer l.Close()
+
+	long := strings.Repeat("k", 1<<16)
+	if err := l.Put("b", long, nil); err != ErrKeyTooLarge {
+		t.Fatalf("put with a long key: %v", err)
+	}
+	if err := l.Put(long, "k", nil); err != ErrKeyTooLarge {
+		t.Fatalf("put with a long bucket: %v", err)
+	}
+	if err := l.Put("b", "k", make([]byte, maxRecord)); err != ErrRecordTooLarge {
+		t.Fatalf("put with a large value: %v", err)
+	}
+	if buckets := l.Buckets(""); len(buckets) != 0 {
+		t.Fatalf("rejected records applied: %v", buckets)
+	}
+}
+
+func TestInvalidSync(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SyncInterval = 0
+	if _, err := Open(t.TempDir(), opts); err == nil {
+		t.Fatal("opened with a zero sync interval")
+	}
+	opts.Sync = "sometimes"
+	if _, err := Open(t.TempDir(), opts); err == nil {
+		t.Fatal("opened with an unknown sync policy")
+	}
+}